@@ -0,0 +1,244 @@
+package feeder
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"github.com/th3osmith/rss"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Number of archive documents followed when no depth is configured
+const DefaultBackfillDepth = 10
+
+// Subscribers implementing BackfillSubscriber receive historical items through
+// AddBackfillItem so that they can store them without notifying anybody.
+// Plain Subscribers get them through AddItem.
+type BackfillSubscriber interface {
+	Subscriber
+	AddBackfillItem(item *rss.Item) error
+}
+
+func (feed *Feed) Backfill(depth int) error {
+	return feed.BackfillContext(context.Background(), depth)
+}
+
+// BackfillContext walks the RFC 5005 archives of the feed (rel="prev-archive", or
+// rel="next" for paged feeds) and delivers the items found in at most depth
+// archive documents, oldest first.
+// Items of the current document are left to Update.
+// The current document is given by the source of the feed, the archives are
+// fetched over HTTP.
+// The delivered items are added to Seen after the ones already there, as long
+// as there is room. Delivery stops at the first error of a subscriber.
+func (feed *Feed) BackfillContext(ctx context.Context, depth int) error {
+
+	if depth <= 0 {
+		depth = DefaultBackfillDepth
+	}
+
+	known := make(map[string]struct{})
+	for id := range feed.feed.ItemMap {
+		known[id] = struct{}{}
+	}
+	for _, id := range feed.Seen {
+		known[id] = struct{}{}
+	}
+
+	source, ok := feed.source.(documentSource)
+	if !ok {
+		return fmt.Errorf("Backfill not supported by the source of %v", feed.Url)
+	}
+
+	body, base, err := source.document(ctx)
+	if err != nil {
+		return err
+	}
+
+	current, err := source.parse(body, base)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range current.Items {
+		known[item.ID] = struct{}{}
+	}
+
+	items := []*rss.Item{}
+	visited := map[string]bool{base: true}
+	next := archiveLink(body, base)
+
+	for i := 0; i < depth && next != "" && !visited[next]; i++ {
+
+		visited[next] = true
+
+		body, err = feed.fetchArchive(ctx, next)
+		if err != nil {
+			return err
+		}
+
+		archive, err := source.parse(body, next)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range archive.Items {
+			if _, ok := known[item.ID]; ok {
+				continue
+			}
+			known[item.ID] = struct{}{}
+			items = append(items, item)
+		}
+
+		next = archiveLink(body, next)
+	}
+
+	// Chronological order, the walk goes backward in time
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Date.Before(items[j].Date)
+	})
+
+	if feed.feed.ItemMap == nil {
+		feed.feed.ItemMap = make(map[string]struct{})
+	}
+
+	// Newest first, like Seen
+	delivered := []string{}
+
+	for _, item := range items {
+		if err = feed.backfillItem(item); err != nil {
+			break
+		}
+		feed.feed.ItemMap[item.ID] = struct{}{}
+		delivered = append([]string{item.ID}, delivered...)
+	}
+
+	feed.Seen = addOld(feed.Seen, delivered...)
+
+	return err
+}
+
+func (feed *Feed) backfillItem(item *rss.Item) error {
+
+	for _, sub := range feed.subscribers {
+		var err error
+		if bsub, ok := sub.(BackfillSubscriber); ok {
+			err = bsub.AddBackfillItem(item)
+		} else {
+			err = sub.AddItem(item)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Add ids of items older than the ones of seen at its end, the oldest are
+// left out when there is no room
+func addOld(seen []string, ids ...string) []string {
+
+	result := make([]string, 0, SeenLength)
+	for _, id := range seen {
+		if id != "" {
+			result = append(result, id)
+		}
+	}
+
+	for _, id := range ids {
+		if len(result) >= SeenLength {
+			break
+		}
+		result = append(result, id)
+	}
+
+	return result
+}
+
+func (feed *Feed) fetchArchive(ctx context.Context, link string) ([]byte, error) {
+
+	if u, err := url.Parse(link); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("Archive %v of %v can not be fetched, only HTTP archives are", link, feed.Url)
+	}
+
+	resp, err := httpGet(ctx, nil, link, feed.username, feed.password, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Find the document holding older entries, resolved against base.
+// Links inside items and entries are ignored.
+func archiveLink(body []byte, base string) string {
+
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	decoder.Strict = false
+
+	links := make(map[string]string)
+	depth := 0
+
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+
+		switch el := token.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(el.Name.Local)
+			if name == "item" || name == "entry" {
+				depth++
+			}
+			if name != "link" || depth > 0 {
+				continue
+			}
+
+			rel, href := "", ""
+			for _, attr := range el.Attr {
+				switch attr.Name.Local {
+				case "rel":
+					rel = attr.Value
+				case "href":
+					href = attr.Value
+				}
+			}
+			if rel != "" && href != "" {
+				links[rel] = href
+			}
+
+		case xml.EndElement:
+			name := strings.ToLower(el.Name.Local)
+			if name == "item" || name == "entry" {
+				depth--
+			}
+		}
+	}
+
+	href, ok := links["prev-archive"]
+	if !ok {
+		href = links["next"]
+	}
+	if href == "" {
+		return ""
+	}
+
+	baseUrl, err := url.Parse(base)
+	if err != nil {
+		return href
+	}
+
+	ref, err := url.Parse(href)
+	if err != nil {
+		return ""
+	}
+
+	return baseUrl.ResolveReference(ref).String()
+}
@@ -1,6 +1,7 @@
 package feeder
 
 import (
+	"context"
 	"github.com/th3osmith/rss"
 	"strings"
 	"time"
@@ -24,6 +25,7 @@ type Feed struct {
 	username    string
 	password    string
 	feed        *rss.Feed
+	source      Source
 	Url         string
 	Seen        []string
 }
@@ -31,40 +33,43 @@ type Feed struct {
 type FetchFunc func() (*rss.Feed, error)
 
 func NewFeed(url string) (*Feed, error) {
+	return NewFeedContext(context.Background(), url)
+}
 
-	fetchFunc := func() (*rss.Feed, error) {
-		return rss.Fetch(url)
-	}
-
-	feed := new(Feed)
-	feed.Url = url
-
-	return CreateFeedWithFunc(feed, fetchFunc)
+func NewFeedContext(ctx context.Context, url string) (*Feed, error) {
+	return NewFeedWithSourceContext(ctx, &HttpSource{Url: url})
 }
 
 func NewAuthFeed(url string, username string, password string) (*Feed, error) {
-	fetchFunc := func() (*rss.Feed, error) {
-		return rss.FetchBasicAuth(url, username, password)
-	}
+	return NewAuthFeedContext(context.Background(), url, username, password)
+}
+
+func NewAuthFeedContext(ctx context.Context, url string, username string, password string) (*Feed, error) {
 
 	feed := new(Feed)
-	feed.Url = url
 	feed.username = username
 	feed.password = password
 
-	return CreateFeedWithFunc(feed, fetchFunc)
+	return CreateFeedWithSourceContext(ctx, feed, &HttpSource{Url: url, Username: username, Password: password})
 }
 
 func NewFeedFromSeed(seed Seed) (feed *Feed, err error) {
+	return NewFeedFromSeedContext(context.Background(), seed)
+}
+
+// Restore a Feed and check its source, the current items are considered as
+// already delivered unless they are missing from the Seen list of the seed
+func NewFeedFromSeedContext(ctx context.Context, seed Seed) (feed *Feed, err error) {
 
 	// We disable caching because the first parsing is going to be discarded
 	caching := rss.CacheParsedItemIDs(false)
+	defer rss.CacheParsedItemIDs(caching)
 
-	if seed.Username != "" && seed.Password != "" {
-		feed, err = NewAuthFeed(seed.Url, seed.Username, seed.Password)
-	} else {
-		feed, err = NewFeed(seed.Url)
-	}
+	feed = new(Feed)
+	feed.username = seed.Username
+	feed.password = seed.Password
+
+	feed, err = CreateFeedWithSourceContext(ctx, feed, NewSourceFromSeed(seed))
 
 	if err != nil {
 		return nil, err
@@ -72,21 +77,63 @@ func NewFeedFromSeed(seed Seed) (feed *Feed, err error) {
 
 	feed.Clear()
 
+	// The discarded document must not be considered as already transferred.
+	// Streams can not be read again, their items are considered as delivered.
+	if source, ok := feed.source.(resettable); ok {
+		source.reset()
+	}
+
 	feed.Seen = seed.Seen
 	feed.feed.ItemMap = make(map[string]struct{})
 	for _, el := range seed.Seen {
 		feed.feed.ItemMap[el] = struct{}{}
 	}
 
-	rss.CacheParsedItemIDs(caching)
-
 	return feed, nil
 
 }
 
+// Restore a Feed without any network access, the source is only contacted at
+// the first Update
+func LoadFeedFromSeed(seed Seed) *Feed {
+
+	feed := new(Feed)
+	feed.Name = seed.Name
+	feed.Status = StatusOK
+	feed.username = seed.Username
+	feed.password = seed.Password
+	feed.source = NewSourceFromSeed(seed)
+	feed.Url = feed.source.Id()
+
+	feed.feed = &rss.Feed{Title: seed.Name, ItemMap: make(map[string]struct{})}
+	for _, el := range seed.Seen {
+		feed.feed.ItemMap[el] = struct{}{}
+	}
+
+	feed.Seen = append(make([]string, 0, SeenLength), seed.Seen...)
+
+	return feed
+}
+
+func NewFeedWithSource(source Source) (*Feed, error) {
+	return NewFeedWithSourceContext(context.Background(), source)
+}
+
+func NewFeedWithSourceContext(ctx context.Context, source Source) (*Feed, error) {
+	return CreateFeedWithSourceContext(ctx, new(Feed), source)
+}
+
 func CreateFeedWithFunc(feedIn *Feed, fetchFunc FetchFunc) (feed *Feed, err error) {
+	return CreateFeedWithSource(feedIn, &funcSource{id: feedIn.Url, fetch: fetchFunc})
+}
+
+func CreateFeedWithSource(feedIn *Feed, source Source) (feed *Feed, err error) {
+	return CreateFeedWithSourceContext(context.Background(), feedIn, source)
+}
 
-	rawFeed, err := fetchFunc()
+func CreateFeedWithSourceContext(ctx context.Context, feedIn *Feed, source Source) (feed *Feed, err error) {
+
+	rawFeed, err := source.Fetch(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -95,7 +142,9 @@ func CreateFeedWithFunc(feedIn *Feed, fetchFunc FetchFunc) (feed *Feed, err erro
 
 	feed.Name = rawFeed.Title
 	feed.Status = StatusOK
+	feed.Url = source.Id()
 	feed.feed = rawFeed
+	feed.source = source
 
 	feed.Seen = make([]string, 0, SeenLength)
 
@@ -109,16 +158,33 @@ func (feed *Feed) Register(subscriber Subscriber) {
 }
 
 func (feed *Feed) Update(force bool) (err error) {
+	return feed.UpdateContext(context.Background(), force)
+}
 
-	if force {
-		feed.feed.Refresh = time.Now()
+// Fetch the source and deliver the new items, a cancelled or expired context
+// does not change the Status of the feed. A document fetched before the
+// context ended is still delivered, the source may not give it again.
+// Without force nothing is done before the Refresh time of the feed.
+func (feed *Feed) UpdateContext(ctx context.Context, force bool) (err error) {
+
+	if !force && feed.feed.Refresh.After(time.Now()) {
+		return nil
 	}
 
 	unread := feed.feed.Unread
 
-	err = feed.feed.Update()
+	rawFeed, err := feed.source.Fetch(ctx)
+
+	if err == ErrNotModified {
+		feed.Status = StatusOK
+		return nil
+	}
 
 	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
 		if strings.Contains(err.Error(), "Code 404") {
 			feed.Status = StatusNotFound
 
@@ -135,6 +201,8 @@ func (feed *Feed) Update(force bool) (err error) {
 		return err
 	}
 
+	feed.merge(rawFeed)
+
 	if feed.feed.Unread > unread {
 		feed.ReadNew()
 	}
@@ -143,6 +211,39 @@ func (feed *Feed) Update(force bool) (err error) {
 
 }
 
+// Add the items not seen yet to the pending ones
+func (feed *Feed) merge(rawFeed *rss.Feed) {
+
+	feed.Name = rawFeed.Title
+	feed.Status = StatusOK
+	feed.feed.Refresh = rawFeed.Refresh
+
+	if feed.feed.ItemMap == nil {
+		feed.feed.ItemMap = make(map[string]struct{})
+	}
+
+	for _, item := range rawFeed.Items {
+		if _, ok := feed.feed.ItemMap[item.ID]; ok {
+			continue
+		}
+		feed.feed.Items = append(feed.feed.Items, item)
+		feed.feed.ItemMap[item.ID] = struct{}{}
+		feed.feed.Unread++
+	}
+
+}
+
+// Deliver items of a push source
+func (feed *Feed) Publish(items ...*rss.Item) {
+
+	feed.merge(&rss.Feed{Title: feed.Name, Refresh: feed.feed.Refresh, Items: items})
+
+	if feed.feed.Unread > 0 {
+		feed.ReadNew()
+	}
+
+}
+
 func (feed *Feed) ReadNew() {
 
 	ids := []string{}
@@ -175,6 +276,8 @@ type Seed struct {
 	Seen     []string
 	Username string
 	Password string
+	Scrape   *ScrapeConfig
+	Name     string
 }
 
 // Add new element in the beginning and remove elements beyond the capacity
@@ -184,5 +287,17 @@ func AddNew(s []string, e ...string) []string {
 }
 
 func (feed *Feed) ExportSeed() Seed {
-	return Seed{feed.Url, feed.Seen, feed.username, feed.password}
+
+	seed := Seed{feed.Url, feed.Seen, feed.username, feed.password, nil, feed.Name}
+
+	if source, ok := feed.source.(*ScrapeSource); ok {
+		config := source.Config
+		seed.Scrape = &config
+	}
+
+	return seed
+}
+
+func (feed *Feed) Source() Source {
+	return feed.source
 }
@@ -1,15 +1,18 @@
 package feeder_test
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"github.com/th3osmith/greader/feeder"
 	"github.com/th3osmith/rss"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 var counter int
@@ -118,6 +121,430 @@ func TestFeed(t *testing.T) {
 
 }
 
+func TestBackfill(t *testing.T) {
+
+	feed, err := feeder.NewFeed("http://localhost:3000/archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := new(feeder.TestSubscriber)
+	feed.Register(sub)
+
+	err = feed.Backfill(5)
+	if err != nil {
+		t.Error(err)
+	}
+
+	control := []string{"http://localhost:3000/posts/1", "http://localhost:3000/posts/2", "http://localhost:3000/posts/3"}
+
+	if len(sub.Backfilled) != len(control) {
+		t.Fatal("Wrong number of backfilled items.", len(sub.Backfilled))
+	}
+
+	for idx, el := range control {
+		if sub.Backfilled[idx].ID != el {
+			t.Error("Backfill not in chronological order.", idx, sub.Backfilled[idx].ID)
+		}
+	}
+
+	if len(sub.Items) != 0 {
+		t.Error("Backfilled items delivered as new items.", len(sub.Items))
+	}
+
+	// Backfilled items are not delivered again after a reload
+	restored := feeder.LoadFeedFromSeed(feed.ExportSeed())
+	sub = new(feeder.TestSubscriber)
+	restored.Register(sub)
+
+	if err = restored.Backfill(5); err != nil || len(sub.Backfilled) != 0 {
+		t.Error("Backfilled items not registered as seen.", err, len(sub.Backfilled))
+	}
+
+	// Errors of the subscribers
+	feed, err = feeder.NewFeed("http://localhost:3000/archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed.Register(&failingSubscriber{accepted: 1})
+
+	if err = feed.Backfill(5); err == nil {
+		t.Error("Subscriber error ignored.")
+	}
+
+	seed := feed.ExportSeed()
+	if len(seed.Seen) != 1 || seed.Seen[0] != control[0] {
+		t.Error("Wrong items registered as seen after an error.", seed.Seen)
+	}
+
+	// Sources other than HTTP give the current document
+	page, err := ioutil.ReadFile("testdata/archive_0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page = []byte(strings.Replace(string(page), `href="/archive/1"`, `href="http://localhost:3000/archive/1"`, 1))
+
+	feed, err = feeder.NewFeedWithSource(&feeder.ReaderSource{Name: "-", Reader: strings.NewReader(string(page))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub = new(feeder.TestSubscriber)
+	feed.Register(sub)
+
+	if err = feed.Backfill(5); err != nil || len(sub.Backfilled) != len(control) {
+		t.Error("Backfill of a stream failed.", err, len(sub.Backfilled))
+	}
+
+	// Relative archive links of a file can not be fetched
+	feed, err = feeder.NewFeedWithSource(&feeder.FileSource{Path: "testdata/archive_0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = feed.Backfill(5); err == nil || !strings.Contains(err.Error(), "only HTTP archives") {
+		t.Error("Relative archive link of a file fetched.", err)
+	}
+
+	// Depth limit
+	feed, err = feeder.NewFeed("http://localhost:3000/archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub = new(feeder.TestSubscriber)
+	feed.Register(sub)
+
+	feed.Backfill(1)
+
+	if len(sub.Backfilled) != 1 || sub.Backfilled[0].ID != "http://localhost:3000/posts/3" {
+		t.Error("Backfill depth not honored.", len(sub.Backfilled))
+	}
+
+}
+
+// Accepts the first items only
+type failingSubscriber struct {
+	accepted int
+}
+
+func (s *failingSubscriber) AddItem(item *rss.Item) error {
+	if s.accepted == 0 {
+		return fmt.Errorf("Refused %v", item.ID)
+	}
+	s.accepted--
+	return nil
+}
+
+var scrapeConfig = feeder.ScrapeConfig{
+	Item:    "article.post",
+	Title:   "h2",
+	Link:    "h2 a",
+	Date:    "time",
+	Content: ".body",
+}
+
+func TestScrape(t *testing.T) {
+
+	page, err := ioutil.ReadFile("testdata/scrape_0.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	feed, err := feeder.Scrape(page, "http://localhost:3000/blog", scrapeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if feed.Title != "Team Blog" {
+		t.Error("Wrong page title.", feed.Title)
+	}
+
+	if len(feed.Items) != 4 {
+		t.Fatal("Wrong number of items.", len(feed.Items))
+	}
+
+	control := []string{"http://localhost:3000/blog/third-post", "http://localhost:3000/blog/second-post", "http://example.com/first-post", "Untitled draft"}
+
+	for idx, el := range control {
+		if feed.Items[idx].ID != el {
+			t.Error("Wrong item ID.", idx, feed.Items[idx].ID)
+		}
+	}
+
+	item := feed.Items[0]
+
+	if item.Title != "Third post" || item.Content != "<p>Third <em>content</em></p>" {
+		t.Error("Wrong item extraction.", item.Title, item.Content)
+	}
+
+	if !item.Date.Equal(time.Date(2015, 10, 2, 10, 0, 0, 0, time.UTC)) {
+		t.Error("Wrong datetime attribute parsing.", item.Date)
+	}
+
+	if !feed.Items[1].Date.Equal(time.Date(2015, 10, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("Wrong date text parsing.", feed.Items[1].Date)
+	}
+
+	_, err = feeder.Scrape(page, "http://localhost:3000/blog", feeder.ScrapeConfig{})
+	if err == nil {
+		t.Error("Missing item selector not detected")
+	}
+
+}
+
+func TestScrapedFeed(t *testing.T) {
+
+	feed, err := feeder.NewScrapedFeed("http://localhost:3000/blog", scrapeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if feed.Name != "Team Blog" || feed.Status != feeder.StatusOK {
+		t.Error("Error during scraped Feed Init", feed.Name)
+	}
+
+	sub := new(feeder.TestSubscriber)
+	feed.Register(sub)
+
+	feed.Clear()
+	feed.Update(true)
+
+	if len(sub.Items) != 4 {
+		t.Error("Subscriber did not get scraped items.", len(sub.Items))
+	}
+
+	// Seeds keep the selectors
+	seed := feed.ExportSeed()
+
+	if seed.Scrape == nil || seed.Scrape.Item != "article.post" {
+		t.Fatal("Scrape config not exported", seed)
+	}
+
+	feedA, err := feeder.NewFeedFromSeed(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subA := new(feeder.TestSubscriber)
+	feedA.Register(subA)
+
+	feedA.Update(true)
+
+	if len(subA.Items) != 0 {
+		t.Error("Seen items delivered again.", len(subA.Items))
+	}
+
+}
+
+func TestFileSource(t *testing.T) {
+
+	feed, err := feeder.NewFeedWithSource(&feeder.FileSource{Path: "testdata/hn_0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if feed.Name != "Hacker News" || !strings.HasPrefix(feed.Url, "file://") {
+		t.Error("Error during file Feed Init", feed.Name, feed.Url)
+	}
+
+	sub := new(feeder.TestSubscriber)
+	feed.Register(sub)
+
+	err = feed.Update(true)
+	if err != nil || len(sub.Items) != 0 {
+		t.Error("Unchanged file fetched again.", err, len(sub.Items))
+	}
+
+	// Too soon to refresh
+	if err = feed.Update(false); err != nil {
+		t.Error("Update before the Refresh time failed.", err)
+	}
+
+	// Seeds point back to the file
+	feedA, err := feeder.NewFeedFromSeed(feed.ExportSeed())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := feedA.Source().(*feeder.FileSource); !ok || feedA.Url != feed.Url {
+		t.Error("File source not restored from Seed", feedA.Url)
+	}
+
+}
+
+func TestReaderSource(t *testing.T) {
+
+	f, err := os.Open("testdata/hn_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	feed, err := feeder.NewFeedWithSource(&feeder.ReaderSource{Name: "-", Reader: f})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if feed.Name != "Hacker News" || feed.Url != "-" {
+		t.Error("Error during reader Feed Init", feed.Name, feed.Url)
+	}
+
+	if err = feed.Update(true); err != nil {
+		t.Error("Exhausted reader not handled.", err)
+	}
+
+	// Stdin is only read once when restoring
+	stdin := os.Stdin
+	defer func() { os.Stdin = stdin }()
+
+	if os.Stdin, err = os.Open("testdata/hn_1"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Stdin.Close()
+
+	feedA, err := feeder.NewFeedFromSeed(feed.ExportSeed())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = feedA.Update(true); err != nil || feedA.Status != feeder.StatusOK {
+		t.Error("Stdin read again after restoring.", err)
+	}
+
+}
+
+func TestConditionalSource(t *testing.T) {
+
+	source := &feeder.HttpSource{Url: "http://localhost:3000/etag"}
+
+	if !source.Capabilities().Conditional {
+		t.Error("HTTP sources are conditional")
+	}
+
+	feed, err := feeder.NewFeedWithSource(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = source.Fetch(context.Background())
+	if err != feeder.ErrNotModified {
+		t.Error("Conditional GET not used.", err)
+	}
+
+	if err = feed.Update(true); err != nil || feed.Status != feeder.StatusOK {
+		t.Error("Not modified document badly handled.", err)
+	}
+
+}
+
+func TestPublish(t *testing.T) {
+
+	feed, err := feeder.NewFeedWithSource(&feeder.FileSource{Path: "testdata/hn_0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed.Clear()
+
+	sub := new(feeder.TestSubscriber)
+	feed.Register(sub)
+
+	item := &rss.Item{ID: "pushed", Title: "Pushed item"}
+	feed.Publish(item)
+	feed.Publish(item)
+
+	if len(sub.Items) != 1 || sub.Items[0] != item {
+		t.Error("Published item badly delivered.", len(sub.Items))
+	}
+
+	if feed.Seen[0] != "pushed" {
+		t.Error("Published item not registered as seen.", feed.Seen)
+	}
+
+}
+
+func TestUpdateContext(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := feeder.NewFeedContext(ctx, "http://localhost:3000/hang")
+	if err == nil {
+		t.Error("Construction deadline not honored")
+	}
+
+	// Restoring does not touch the network
+	seed := feeder.Seed{Url: "http://localhost:3000/hang", Name: "Hanging", Seen: []string{"a"}}
+	feed := feeder.LoadFeedFromSeed(seed)
+
+	if feed.Name != "Hanging" || feed.Url != seed.Url || feed.Status != feeder.StatusOK {
+		t.Error("Error during offline Feed Init", feed)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	err = feed.UpdateContext(ctx, true)
+
+	if err != context.Canceled || time.Since(start) > time.Second {
+		t.Error("Cancellation not honored.", err)
+	}
+
+	if feed.Status != feeder.StatusOK {
+		t.Error("Cancellation changed the Status", feed.Status)
+	}
+
+	// First update of an offline feed
+	feed = feeder.LoadFeedFromSeed(feeder.Seed{Url: "http://localhost:3000/etag"})
+
+	sub := new(feeder.TestSubscriber)
+	feed.Register(sub)
+
+	err = feed.UpdateContext(context.Background(), false)
+	if err != nil || len(sub.Items) != 30 || feed.Name != "Hacker News" {
+		t.Error("Offline feed badly updated.", err, len(sub.Items))
+	}
+
+	// Items fetched when the context ends are not lost
+	source := &cancelSource{FileSource: feeder.FileSource{Path: "testdata/hn_0"}}
+	feed, err = feeder.NewFeedWithSource(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed.Clear()
+
+	sub = new(feeder.TestSubscriber)
+	feed.Register(sub)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	source.FileSource = feeder.FileSource{Path: "testdata/hn_1"}
+	source.cancel = cancel
+
+	err = feed.UpdateContext(ctx, true)
+	if err != nil || len(sub.Items) == 0 {
+		t.Error("Items fetched before the cancellation lost.", err, len(sub.Items))
+	}
+
+}
+
+// Cancels the context of the update once the document is fetched
+type cancelSource struct {
+	feeder.FileSource
+	cancel context.CancelFunc
+}
+
+func (s *cancelSource) Fetch(ctx context.Context) (*rss.Feed, error) {
+	rawFeed, err := s.FileSource.Fetch(ctx)
+	if s.cancel != nil {
+		s.cancel()
+	}
+	return rawFeed, err
+}
+
 func TestMain(m *testing.M) {
 	rss.CacheParsedItemIDs(false)
 	counter = 0
@@ -132,6 +559,11 @@ func TestMain(m *testing.M) {
 func startServer() {
 	http.Handle("/hn", http.HandlerFunc(hnHandler))
 	http.Handle("/auth/hn", authHandler(http.HandlerFunc(hnHandler)))
+	http.Handle("/archive", http.HandlerFunc(archiveHandler))
+	http.Handle("/archive/", http.HandlerFunc(archiveHandler))
+	http.Handle("/blog", http.HandlerFunc(blogHandler))
+	http.Handle("/etag", http.HandlerFunc(etagHandler))
+	http.Handle("/hang", http.HandlerFunc(hangHandler))
 	http.Handle("/e500", http.HandlerFunc(errorHandler))
 	http.Handle("/e404", http.HandlerFunc(notFoundHandler))
 	http.ListenAndServe(":3000", nil)
@@ -150,6 +582,43 @@ func hnHandler(w http.ResponseWriter, r *http.Request) {
 	io.Copy(w, f)
 }
 
+// Serve the current document and the archives of an RFC 5005 feed
+func archiveHandler(w http.ResponseWriter, r *http.Request) {
+	file := "testdata/archive_0"
+	if strings.HasPrefix(r.URL.Path, "/archive/") {
+		file = "testdata/archive_" + strings.TrimPrefix(r.URL.Path, "/archive/")
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	io.Copy(w, f)
+}
+
+func blogHandler(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "testdata/scrape_0.html")
+}
+
+// Always the same document, with support of conditional requests
+func etagHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("If-None-Match") == `"hn_0"` {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("ETag", `"hn_0"`)
+	http.ServeFile(w, r, "testdata/hn_0")
+}
+
+// Never answer before the client gives up
+func hangHandler(w http.ResponseWriter, r *http.Request) {
+	<-r.Context().Done()
+}
+
 func errorHandler(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "Error 500", http.StatusInternalServerError)
 }
@@ -0,0 +1,197 @@
+package feeder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/th3osmith/rss"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CSS selectors used to extract items from a page without feed.
+// Item selects the item containers, the other selectors are applied inside
+// each container. Link and Date use the href and datetime attributes when
+// present and the text otherwise.
+type ScrapeConfig struct {
+	Item       string
+	Title      string
+	Link       string
+	Date       string
+	Content    string
+	DateFormat string // time layout of the dates, common formats are tried if empty
+}
+
+var dateLayouts = []string{
+	time.RFC3339,
+	time.RFC1123Z,
+	time.RFC1123,
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"January 2, 2006",
+	"2 January 2006",
+	"Jan 2, 2006",
+}
+
+// HTML page turned into a feed with a ScrapeConfig
+type ScrapeSource struct {
+	Url      string
+	Config   ScrapeConfig
+	Username string
+	Password string
+	Client   *http.Client // http.DefaultClient if nil
+}
+
+func NewScrapedFeed(url string, config ScrapeConfig) (*Feed, error) {
+	return NewFeedWithSource(&ScrapeSource{Url: url, Config: config})
+}
+
+func (s *ScrapeSource) Fetch(ctx context.Context) (*rss.Feed, error) {
+
+	body, _, err := s.document(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.parse(body, s.Url)
+}
+
+func (s *ScrapeSource) document(ctx context.Context) ([]byte, string, error) {
+
+	resp, err := httpGet(ctx, s.Client, s.Url, s.Username, s.Password, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	return body, s.Url, err
+}
+
+// Archive pages are scraped like the current one
+func (s *ScrapeSource) parse(body []byte, url string) (*rss.Feed, error) {
+	return Scrape(body, url, s.Config)
+}
+
+func (s *ScrapeSource) Id() string {
+	return s.Url
+}
+
+func (s *ScrapeSource) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+// Scrape extracts the items of an HTML page, links are resolved against pageUrl
+func Scrape(page []byte, pageUrl string, config ScrapeConfig) (*rss.Feed, error) {
+
+	if config.Item == "" {
+		return nil, errors.New("Scraping requires an item selector")
+	}
+
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(page))
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := url.Parse(pageUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	feed := new(rss.Feed)
+	feed.Title = strings.TrimSpace(doc.Find("title").First().Text())
+	feed.Link = pageUrl
+	feed.UpdateURL = pageUrl
+
+	ids := make(map[string]struct{})
+
+	doc.Find(config.Item).Each(func(i int, sel *goquery.Selection) {
+
+		item := new(rss.Item)
+
+		item.Title = strings.TrimSpace(find(sel, config.Title).Text())
+
+		link, _ := sel.Attr("href")
+		if config.Link != "" {
+			link = attrOrText(sel.Find(config.Link).First(), "href")
+		}
+
+		if link != "" {
+			if ref, err := url.Parse(link); err == nil {
+				link = base.ResolveReference(ref).String()
+			}
+			item.Link = link
+		}
+
+		if config.Date != "" {
+			date := attrOrText(sel.Find(config.Date).First(), "datetime")
+			item.Date = parseDate(date, config.DateFormat)
+		}
+
+		if config.Content != "" {
+			item.Content, _ = sel.Find(config.Content).First().Html()
+			item.Content = strings.TrimSpace(item.Content)
+		}
+
+		item.ID = item.Link
+		if item.ID == "" {
+			item.ID = item.Title
+		}
+
+		// Without a way to identify it the item would be delivered at every update
+		if item.ID == "" {
+			return
+		}
+
+		if _, ok := ids[item.ID]; ok {
+			return
+		}
+
+		ids[item.ID] = struct{}{}
+		feed.Items = append(feed.Items, item)
+	})
+
+	feed.Unread = uint32(len(feed.Items))
+
+	return feed, nil
+}
+
+// An empty title selector designates the container itself
+func find(sel *goquery.Selection, selector string) *goquery.Selection {
+	if selector == "" {
+		return sel
+	}
+	return sel.Find(selector).First()
+}
+
+func attrOrText(sel *goquery.Selection, attr string) string {
+	if value, ok := sel.Attr(attr); ok {
+		return strings.TrimSpace(value)
+	}
+	return strings.TrimSpace(sel.Text())
+}
+
+func parseDate(value string, layout string) time.Time {
+
+	if value == "" {
+		return time.Time{}
+	}
+
+	layouts := dateLayouts
+	if layout != "" {
+		layouts = []string{layout}
+	}
+
+	for _, l := range layouts {
+		if date, err := time.Parse(l, value); err == nil {
+			return date
+		}
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,332 @@
+package feeder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/th3osmith/rss"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Returned by conditional sources when the document did not change since the
+// last fetch
+var ErrNotModified = errors.New("Not modified")
+
+type Capabilities struct {
+	Push        bool // Items arrive on their own and are delivered with Feed.Publish
+	Conditional bool // Fetch can return ErrNotModified
+}
+
+// A Source provides the documents of a Feed
+type Source interface {
+	Fetch(ctx context.Context) (*rss.Feed, error)
+	Id() string // Identifies the source, stored as the Url of the Feed
+	Capabilities() Capabilities
+}
+
+// Sources able to fetch again the document they already gave
+type resettable interface {
+	reset()
+}
+
+// Sources giving the documents walked by Backfill
+type documentSource interface {
+	// Current document, even if not modified, and the URL its links are
+	// relative to
+	document(ctx context.Context) (body []byte, base string, err error)
+	// Items of the current document or of one of its archives
+	parse(body []byte, url string) (*rss.Feed, error)
+}
+
+// RSS or Atom document served over HTTP, conditional GET is used when the
+// server provides an ETag or a Last-Modified header
+type HttpSource struct {
+	Url          string
+	Username     string
+	Password     string
+	Client       *http.Client // http.DefaultClient if nil
+	etag         string
+	lastModified string
+}
+
+func (s *HttpSource) Fetch(ctx context.Context) (*rss.Feed, error) {
+
+	header := make(http.Header)
+	if s.etag != "" {
+		header.Set("If-None-Match", s.etag)
+	}
+	if s.lastModified != "" {
+		header.Set("If-Modified-Since", s.lastModified)
+	}
+
+	resp, err := httpGet(ctx, s.Client, s.Url, s.Username, s.Password, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, ErrNotModified
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	rawFeed, err := rss.Parse(body)
+	if err != nil {
+		return nil, err
+	}
+
+	s.etag = resp.Header.Get("ETag")
+	s.lastModified = resp.Header.Get("Last-Modified")
+
+	return rawFeed, nil
+}
+
+func (s *HttpSource) document(ctx context.Context) ([]byte, string, error) {
+
+	resp, err := httpGet(ctx, s.Client, s.Url, s.Username, s.Password, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	return body, s.Url, err
+}
+
+func (s *HttpSource) parse(body []byte, url string) (*rss.Feed, error) {
+	return rss.Parse(body)
+}
+
+func (s *HttpSource) reset() {
+	s.etag = ""
+	s.lastModified = ""
+}
+
+func (s *HttpSource) Id() string {
+	return s.Url
+}
+
+func (s *HttpSource) Capabilities() Capabilities {
+	return Capabilities{Conditional: true}
+}
+
+// RSS or Atom document stored on disk, unchanged files are not parsed again
+type FileSource struct {
+	Path    string
+	modTime time.Time
+}
+
+func (s *FileSource) Fetch(ctx context.Context) (*rss.Feed, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.modTime.IsZero() && !info.ModTime().After(s.modTime) {
+		return nil, ErrNotModified
+	}
+
+	body, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	rawFeed, err := rss.Parse(body)
+	if err != nil {
+		return nil, err
+	}
+
+	s.modTime = info.ModTime()
+
+	return rawFeed, nil
+}
+
+func (s *FileSource) document(ctx context.Context) ([]byte, string, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	body, err := ioutil.ReadFile(s.Path)
+
+	return body, s.Id(), err
+}
+
+func (s *FileSource) parse(body []byte, url string) (*rss.Feed, error) {
+	return rss.Parse(body)
+}
+
+func (s *FileSource) reset() {
+	s.modTime = time.Time{}
+}
+
+func (s *FileSource) Id() string {
+	path, err := filepath.Abs(s.Path)
+	if err != nil {
+		path = s.Path
+	}
+	return "file://" + path
+}
+
+func (s *FileSource) Capabilities() Capabilities {
+	return Capabilities{Conditional: true}
+}
+
+// Document read once from a stream, later fetches return ErrNotModified
+type ReaderSource struct {
+	Name   string
+	Reader io.Reader
+	done   bool
+	body   []byte // Kept for Backfill
+}
+
+func NewStdinSource() *ReaderSource {
+	return &ReaderSource{Name: "-", Reader: os.Stdin}
+}
+
+func (s *ReaderSource) Fetch(ctx context.Context) (*rss.Feed, error) {
+
+	if s.done {
+		return nil, ErrNotModified
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	body, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+
+	s.done = true
+
+	return rss.Parse(body)
+}
+
+func (s *ReaderSource) read() ([]byte, error) {
+
+	if s.body != nil {
+		return s.body, nil
+	}
+
+	body, err := ioutil.ReadAll(s.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	s.body = body
+
+	return body, nil
+}
+
+func (s *ReaderSource) document(ctx context.Context) ([]byte, string, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	body, err := s.read()
+
+	return body, s.Name, err
+}
+
+func (s *ReaderSource) parse(body []byte, url string) (*rss.Feed, error) {
+	return rss.Parse(body)
+}
+
+func (s *ReaderSource) Id() string {
+	return s.Name
+}
+
+func (s *ReaderSource) Capabilities() Capabilities {
+	return Capabilities{Conditional: true}
+}
+
+// Adapter for the FetchFunc extension point
+type funcSource struct {
+	id    string
+	fetch FetchFunc
+}
+
+func (s *funcSource) Fetch(ctx context.Context) (*rss.Feed, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.fetch()
+}
+
+func (s *funcSource) Id() string {
+	return s.id
+}
+
+func (s *funcSource) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+// Build the Source described by a Seed
+func NewSourceFromSeed(seed Seed) Source {
+
+	if seed.Scrape != nil {
+		return &ScrapeSource{Url: seed.Url, Config: *seed.Scrape, Username: seed.Username, Password: seed.Password}
+	}
+
+	if seed.Url == "-" {
+		return NewStdinSource()
+	}
+
+	if strings.HasPrefix(seed.Url, "file://") {
+		return &FileSource{Path: strings.TrimPrefix(seed.Url, "file://")}
+	}
+
+	return &HttpSource{Url: seed.Url, Username: seed.Username, Password: seed.Password}
+}
+
+func httpGet(ctx context.Context, client *http.Client, url string, username string, password string, header http.Header) (*http.Response, error) {
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	if username != "" && password != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotModified {
+		resp.Body.Close()
+		return nil, fmt.Errorf("HTTP Error. Status Code %d", resp.StatusCode)
+	}
+
+	return resp, nil
+}
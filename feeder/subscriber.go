@@ -9,7 +9,8 @@ type Subscriber interface {
 }
 
 type TestSubscriber struct {
-	Items []*rss.Item
+	Items      []*rss.Item
+	Backfilled []*rss.Item
 }
 
 func (s *TestSubscriber) AddItem(item *rss.Item) (err error) {
@@ -18,3 +19,10 @@ func (s *TestSubscriber) AddItem(item *rss.Item) (err error) {
 	return
 
 }
+
+func (s *TestSubscriber) AddBackfillItem(item *rss.Item) (err error) {
+
+	s.Backfilled = append(s.Backfilled, item)
+	return
+
+}
@@ -0,0 +1,182 @@
+package ingest_test
+
+import (
+	"github.com/th3osmith/greader/feeder"
+	"github.com/th3osmith/greader/ingest"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+const newsletter = "From: Weekly News <news@example.com>\r\n" +
+	"To: weekly@greader.local\r\n" +
+	"Subject: =?UTF-8?Q?Issue_42_=E2=80=94_Go?=\r\n" +
+	"Date: Fri, 02 Oct 2015 10:00:00 +0000\r\n" +
+	"Message-Id: <issue42@example.com>\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"alt\"\r\n" +
+	"\r\n" +
+	"--alt\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Hello readers\r\n" +
+	"--alt\r\n" +
+	"Content-Type: multipart/related; boundary=\"rel\"\r\n" +
+	"\r\n" +
+	"--rel\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"<p>Hello <b>readers</b></p><img src=3D\"cid:logo@example.com\">\r\n" +
+	"--rel\r\n" +
+	"Content-Type: image/png\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"Content-Id: <logo@example.com>\r\n" +
+	"\r\n" +
+	"iVBORw0KGgo=\r\n" +
+	"--rel--\r\n" +
+	"--alt--\r\n"
+
+func TestParseMessage(t *testing.T) {
+
+	item, err := ingest.ParseMessage(strings.NewReader(newsletter))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if item.Title != "Issue 42 — Go" {
+		t.Error("Subject badly decoded.", item.Title)
+	}
+
+	if item.ID != "issue42@example.com" {
+		t.Error("Message-Id not used as ID.", item.ID)
+	}
+
+	if item.Summary != "Hello readers" {
+		t.Error("Text part not used as summary.", item.Summary)
+	}
+
+	if !strings.Contains(item.Content, "<p>Hello <b>readers</b></p>") ||
+		!strings.Contains(item.Content, `src="data:image/png;base64,iVBORw0KGgo="`) {
+		t.Error("HTML part or inline image badly handled.", item.Content)
+	}
+
+	plain := "From: a@example.com\r\nSubject: Plain\r\n\r\n1 < 2\r\n"
+
+	item, err = ingest.ParseMessage(strings.NewReader(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if item.Content != "<pre>1 &lt; 2</pre>" || item.ID == "" {
+		t.Error("Text only message badly handled.", item.Content, item.ID)
+	}
+
+	latin := "From: a@example.com\r\nSubject: Latin\r\n" +
+		"Content-Type: text/plain; charset=ISO-8859-1\r\n\r\nCaf\xe9 \x80 5\r\n"
+
+	item, err = ingest.ParseMessage(strings.NewReader(latin))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if item.Summary != "Café € 5" {
+		t.Error("Latin-1 part not converted to UTF-8.", item.Summary)
+	}
+
+	unknown := "From: a@example.com\r\nSubject: Unknown\r\n" +
+		"Content-Type: text/plain; charset=koi8-r\r\n\r\n\xf0\xd2\xc9\r\n"
+
+	if _, err = ingest.ParseMessage(strings.NewReader(unknown)); err == nil {
+		t.Error("Unsupported charset accepted.")
+	}
+
+}
+
+func TestSMTP(t *testing.T) {
+
+	server := ingest.NewServer("greader.local")
+
+	feed, err := server.AddFeed("Weekly <weekly@greader.local>", "Weekly News")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if feed.Name != "Weekly News" || feed.Url != "mailto:weekly@greader.local" {
+		t.Error("Error during virtual Feed Init", feed.Name, feed.Url)
+	}
+
+	if _, err = server.AddFeed("weekly@greader.local", "Duplicate"); err == nil {
+		t.Error("Duplicate address not detected")
+	}
+
+	sub := new(feeder.TestSubscriber)
+	feed.Register(sub)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- server.Serve(l)
+	}()
+
+	err = smtp.SendMail(l.Addr().String(), nil, "news@example.com", []string{"weekly@greader.local"}, []byte(newsletter))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Unknown recipients are rejected
+	err = smtp.SendMail(l.Addr().String(), nil, "news@example.com", []string{"nobody@greader.local"}, []byte(newsletter))
+	if err == nil || !strings.Contains(err.Error(), "550") {
+		t.Error("Unknown recipient accepted.", err)
+	}
+
+	// Commands out of order are refused
+	conn, err := textproto.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = conn.ReadResponse(220); err != nil {
+		t.Error(err)
+	}
+
+	for _, cmd := range []string{"RCPT TO:<weekly@greader.local>", "DATA"} {
+		id, _ := conn.Cmd("%s", cmd)
+		conn.StartResponse(id)
+		code, _, _ := conn.ReadResponse(0)
+		conn.EndResponse(id)
+
+		if code != 503 {
+			t.Error("Command accepted before MAIL FROM.", cmd, code)
+		}
+	}
+
+	conn.Close()
+
+	// Already delivered messages are not duplicated
+	err = smtp.SendMail(l.Addr().String(), nil, "news@example.com", []string{"weekly@greader.local"}, []byte(newsletter))
+	if err != nil {
+		t.Error(err)
+	}
+
+	server.Close()
+
+	if err = <-done; err != ingest.ErrServerClosed {
+		t.Error("Bad error on Close.", err)
+	}
+
+	if len(sub.Items) != 1 || sub.Items[0].ID != "issue42@example.com" {
+		t.Error("Newsletter not delivered to the feed.", len(sub.Items))
+	}
+
+	if feed.Seen[0] != "issue42@example.com" {
+		t.Error("Newsletter not registered as seen.", feed.Seen)
+	}
+
+}
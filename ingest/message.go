@@ -0,0 +1,180 @@
+package ingest
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/th3osmith/rss"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Parts of a message useful to build an item
+type content struct {
+	html   string
+	text   string
+	inline map[string]string // Content-ID -> data URI
+}
+
+var wordDecoder = new(mime.WordDecoder)
+
+// ParseMessage turns an email into an item.
+// The HTML part is used as content, with inline images embedded as data URIs,
+// the text part as summary (and as content when there is no HTML part).
+func ParseMessage(r io.Reader) (*rss.Item, error) {
+
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	item := new(rss.Item)
+
+	item.Title, err = wordDecoder.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		item.Title = msg.Header.Get("Subject")
+	}
+
+	if date, err := msg.Header.Date(); err == nil {
+		item.Date = date
+	} else {
+		item.Date = time.Now()
+	}
+
+	c := &content{inline: make(map[string]string)}
+
+	err = c.readPart(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), "", msg.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	item.Summary = strings.TrimSpace(c.text)
+	item.Content = c.html
+
+	if item.Content == "" && item.Summary != "" {
+		item.Content = "<pre>" + html.EscapeString(item.Summary) + "</pre>"
+	}
+
+	for cid, uri := range c.inline {
+		item.Content = strings.Replace(item.Content, "cid:"+cid, uri, -1)
+	}
+
+	item.ID = strings.Trim(msg.Header.Get("Message-Id"), "<> ")
+	if item.ID == "" {
+		sum := sha1.Sum([]byte(msg.Header.Get("From") + item.Title + item.Date.String() + item.Content))
+		item.ID = hex.EncodeToString(sum[:])
+	}
+
+	return item, nil
+}
+
+func (c *content) readPart(contentType string, encoding string, contentId string, body io.Reader) error {
+
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			err = c.readPart(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part.Header.Get("Content-Id"), part)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := ioutil.ReadAll(decodeTransfer(encoding, body))
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case mediaType == "text/html" && c.html == "":
+		c.html, err = decodeCharset(params["charset"], data)
+
+	case mediaType == "text/plain" && c.text == "":
+		c.text, err = decodeCharset(params["charset"], data)
+
+	case strings.HasPrefix(mediaType, "image/") && contentId != "":
+		cid := strings.Trim(contentId, "<> ")
+		c.inline[cid] = fmt.Sprintf("data:%s;base64,%s", mediaType, base64.StdEncoding.EncodeToString(data))
+	}
+
+	return err
+}
+
+// Characters of windows-1252 between 0x80 and 0x9F, where Latin-1 has control codes
+var windows1252 = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8D, 'Ž', 0x8F,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9D, 'ž', 'Ÿ',
+}
+
+// Convert a text part to UTF-8
+func decodeCharset(charset string, data []byte) (string, error) {
+
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return string(data), nil
+
+	case "iso-8859-1", "latin1", "latin-1", "windows-1252", "cp1252":
+		// Latin-1 bytes are the first 256 code points, mails labelled as such
+		// are often windows-1252 so its extra characters are converted too
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+			if b >= 0x80 && b <= 0x9F {
+				runes[i] = windows1252[b-0x80]
+			}
+		}
+		return string(runes), nil
+	}
+
+	return "", fmt.Errorf("Unsupported charset %q", charset)
+}
+
+func decodeTransfer(encoding string, body io.Reader) io.Reader {
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		// Line breaks are ignored by the decoder
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+
+	return body
+}
+
+// Keep only the address of a "Name <address>" string
+func parseAddress(address string) (string, error) {
+
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.ToLower(parsed.Address), nil
+}
@@ -0,0 +1,315 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/th3osmith/greader/feeder"
+	"github.com/th3osmith/rss"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default maximum size of a message in bytes
+const DefaultMaxSize = 10 << 20
+
+var ErrServerClosed = errors.New("Ingest server closed")
+
+// A Mailbox is the push source of the virtual feed associated to an address
+type Mailbox struct {
+	Address string
+	Name    string
+}
+
+func (m *Mailbox) Fetch(ctx context.Context) (*rss.Feed, error) {
+	return &rss.Feed{Title: m.Name, UpdateURL: m.Id()}, nil
+}
+
+func (m *Mailbox) Id() string {
+	return "mailto:" + m.Address
+}
+
+func (m *Mailbox) Capabilities() feeder.Capabilities {
+	return feeder.Capabilities{Push: true}
+}
+
+// Minimal SMTP server delivering the newsletters it receives to the feed
+// mapped to their recipient
+type Server struct {
+	Hostname    string
+	MaxSize     int64
+	ReadTimeout time.Duration
+	feeds       map[string]*feeder.Feed
+	mu          sync.Mutex // Protects feeds and serializes the deliveries
+	listener    net.Listener
+	closed      bool
+}
+
+func NewServer(hostname string) *Server {
+	return &Server{
+		Hostname:    hostname,
+		MaxSize:     DefaultMaxSize,
+		ReadTimeout: 5 * time.Minute,
+		feeds:       make(map[string]*feeder.Feed),
+	}
+}
+
+// Create the virtual feed receiving the messages sent to address
+func (s *Server) AddFeed(address string, name string) (*feeder.Feed, error) {
+
+	address, err := parseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	feed, err := feeder.NewFeedWithSource(&Mailbox{Address: address, Name: name})
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.feeds[address]; ok {
+		return nil, fmt.Errorf("Address %v already mapped", address)
+	}
+
+	s.feeds[address] = feed
+
+	return feed, nil
+}
+
+func (s *Server) Feed(address string) (*feeder.Feed, bool) {
+
+	address, err := parseAddress(address)
+	if err != nil {
+		return nil, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	feed, ok := s.feeds[address]
+	return feed, ok
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+func (s *Server) Serve(l net.Listener) error {
+
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		go s.handle(conn)
+	}
+}
+
+// Stop accepting connections, sessions in progress are not interrupted
+func (s *Server) Close() error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+
+	if s.listener == nil {
+		return nil
+	}
+
+	return s.listener.Close()
+}
+
+// State of an SMTP session
+type session struct {
+	mail       bool // MAIL FROM received, the reverse path can be empty
+	from       string
+	recipients []*feeder.Feed
+}
+
+func (s *Server) handle(netConn net.Conn) {
+
+	defer netConn.Close()
+
+	conn := textproto.NewConn(netConn)
+	state := new(session)
+
+	reply := func(code int, msg string) bool {
+		return conn.PrintfLine("%d %s", code, msg) == nil
+	}
+
+	if !reply(220, s.Hostname+" ESMTP greader") {
+		return
+	}
+
+	for {
+		if s.ReadTimeout > 0 {
+			netConn.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+		}
+
+		line, err := conn.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg := line, ""
+		if idx := strings.Index(line, " "); idx >= 0 {
+			verb, arg = line[:idx], strings.TrimSpace(line[idx+1:])
+		}
+
+		switch strings.ToUpper(verb) {
+
+		case "HELO":
+			reply(250, s.Hostname)
+
+		case "EHLO":
+			conn.PrintfLine("250-%s", s.Hostname)
+			conn.PrintfLine("250-SIZE %d", s.MaxSize)
+			reply(250, "8BITMIME")
+
+		case "MAIL":
+			from, ok := pathArg(arg, "FROM:")
+			if !ok {
+				reply(501, "Syntax: MAIL FROM:<address>")
+				continue
+			}
+			state = &session{mail: true, from: from}
+			reply(250, "OK")
+
+		case "RCPT":
+			if !state.mail {
+				reply(503, "Bad sequence of commands")
+				continue
+			}
+
+			to, ok := pathArg(arg, "TO:")
+			if !ok {
+				reply(501, "Syntax: RCPT TO:<address>")
+				continue
+			}
+
+			feed, ok := s.Feed(to)
+			if !ok {
+				reply(550, "No such mailbox")
+				continue
+			}
+
+			state.recipients = append(state.recipients, feed)
+			reply(250, "OK")
+
+		case "DATA":
+			if !state.mail {
+				reply(503, "Bad sequence of commands")
+				continue
+			}
+
+			if len(state.recipients) == 0 {
+				reply(503, "Need RCPT before DATA")
+				continue
+			}
+
+			reply(354, "End data with <CR><LF>.<CR><LF>")
+
+			dot := conn.DotReader()
+			data, err := ioutil.ReadAll(io.LimitReader(dot, s.MaxSize+1))
+			if err != nil {
+				return
+			}
+
+			if int64(len(data)) > s.MaxSize {
+				// Drain the rest of the message
+				io.Copy(ioutil.Discard, dot)
+				reply(552, "Message too large")
+				state = new(session)
+				continue
+			}
+
+			if err := s.deliver(data, state.recipients); err != nil {
+				log.Printf("[Ingest] Error parsing message from %v: %v\n", state.from, err)
+				reply(554, "Unable to parse message")
+			} else {
+				reply(250, "OK")
+			}
+
+			state = new(session)
+
+		case "RSET":
+			state = new(session)
+			reply(250, "OK")
+
+		case "NOOP":
+			reply(250, "OK")
+
+		case "QUIT":
+			reply(221, "Bye")
+			return
+
+		default:
+			reply(502, "Command not implemented")
+		}
+	}
+}
+
+func (s *Server) deliver(data []byte, recipients []*feeder.Feed) error {
+
+	item, err := ParseMessage(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	// Feeds are not safe for concurrent use
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, feed := range recipients {
+		feed.Publish(item)
+	}
+
+	return nil
+}
+
+// Extract the address of "FROM:<address> PARAMS"
+func pathArg(arg string, prefix string) (string, bool) {
+
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+
+	path := strings.TrimSpace(arg[len(prefix):])
+
+	if idx := strings.Index(path, ">"); strings.HasPrefix(path, "<") && idx > 0 {
+		path = path[1:idx]
+	} else if idx := strings.Index(path, " "); idx >= 0 {
+		path = path[:idx]
+	}
+
+	return path, true
+}
@@ -19,10 +19,31 @@ func Serve() {
 
 	// Pure Test
 	mux := pure.NewPureMux()
-	h := pure_test.NewPureHandler()
+	mux.Use(pure.Logging(), pure.Recover())
+	limiter := pure.NewRateLimiter(pure.RateLimits{
+		PerConnection: map[string]pure.Rate{"*/*": {Requests: 20, Per: time.Second, Burst: 50}},
+		InFlight:      8,
+	})
+	mux.Use(limiter.Middleware())
+	mux.Watch(limiter)
+	h := pure_test.NewPushHandler(mux)
 	mux.RegisterHandler("data", h)
 
-	http.Handle("/pure", pure.WebsocketHandler(*mux))
+	idSchema := pure.Schema{Fields: map[string]pure.Field{"id": {Type: pure.String, Required: true}}}
+	for _, action := range []string{"create", "retrieve", "update", "delete"} {
+		if err := mux.RegisterSchema("data", action, idSchema); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	options := pure.DefaultWebsocketOptions()
+	options.Auth = []pure.Authenticator{pure.SingleUser("tata", "yoyo")}
+	http.Handle("/pure", pure.NewWebsocketHandler(mux, options))
+
+	// For the clients behind proxies breaking websockets
+	sessionOptions := pure.DefaultSessionOptions()
+	sessionOptions.Auth = options.Auth
+	http.Handle("/pure/http", pure.NewSessionHandler(mux, sessionOptions))
 
 	yes := singleUserAuthenticator{"tata", "yoyo"}
 	http.Handle("/protected", loggingHandler(recoverHandler(yes.authHandler(http.HandlerFunc(testHandler)))))
@@ -70,7 +91,8 @@ func websocketEchoHandler(w http.ResponseWriter, r *http.Request) {
 		messageType, p, err := conn.ReadMessage()
 		if err != nil {
 			log.Printf("[WebSocket] Error Reading message: %v\n", err)
-			continue
+			conn.Close()
+			return
 		}
 		if err = conn.WriteMessage(messageType, p); err != nil {
 			log.Printf("[WebSocket] Error Eriting message %v (%v): %v\n", string(p), messageType, err)
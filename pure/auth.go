@@ -0,0 +1,92 @@
+package pure
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// Action of the first message of a connection authenticated by token, the
+// token is in RequestMap["token"]
+const AuthenticateAction = "authenticate"
+
+// User of a connection, given to the handlers in PureReq.Identity
+type Identity struct {
+	Name  string
+	Roles []string
+}
+
+func (id *Identity) HasRole(role string) bool {
+
+	if id == nil {
+		return false
+	}
+
+	for _, r := range id.Roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Connections knowing their user
+type IdentifiedConnection interface {
+	PureConnection
+	Identity() *Identity
+}
+
+// Identity of the user of conn, nil if anonymous
+func IdentityOf(conn PureConnection) *Identity {
+	if c, ok := conn.(IdentifiedConnection); ok {
+		return c.Identity()
+	}
+	return nil
+}
+
+// Find the user of a websocket upgrade request, nil if there is none
+type Authenticator interface {
+	Authenticate(r *http.Request) *Identity
+}
+
+// Check the credentials of the Authorization header
+type BasicAuthenticator func(username string, password string) *Identity
+
+func (auth BasicAuthenticator) Authenticate(r *http.Request) *Identity {
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil
+	}
+
+	return auth(username, password)
+}
+
+// Find the user of a session cookie
+type CookieAuthenticator struct {
+	Name   string // Name of the cookie
+	Lookup func(value string) *Identity
+}
+
+func (auth CookieAuthenticator) Authenticate(r *http.Request) *Identity {
+
+	cookie, err := r.Cookie(auth.Name)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+
+	return auth.Lookup(cookie.Value)
+}
+
+// Find the user of the token sent in the first message
+type TokenAuthenticator func(token string) *Identity
+
+// Single user with a password, like the /protected part of the server
+func SingleUser(username string, password string, roles ...string) BasicAuthenticator {
+	return func(u string, p string) *Identity {
+		if subtle.ConstantTimeCompare([]byte(u), []byte(username)) == 1 && subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1 {
+			return &Identity{Name: username, Roles: roles}
+		}
+		return nil
+	}
+}
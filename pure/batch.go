@@ -0,0 +1,197 @@
+package pure
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+var ErrNoTransaction = errors.New("Handler does not support transactions")
+
+// Handlers supporting transactions can take part in atomic batches.
+// The operations of the transaction are given the Transaction in PureReq.Tx
+type TransactionalHandler interface {
+	PureHandler
+	Begin(PureReq) (Transaction, error)
+}
+
+type Transaction interface {
+	Commit() error
+	Rollback() error
+}
+
+// Response sent to a connection other than the requester
+type pendingMsg struct {
+	conn PureConnection
+	msg  PureMsg
+}
+
+// A batch holds its operations in Msg.Batch and answers with one message whose
+// Batch holds the response of every operation, in order.
+// With RequestMap["atomic"] set to true every operation must succeed and be
+// handled by a TransactionalHandler: the transactions are committed together
+// or all rolled back.
+// Atomicity only holds per DataType: the transactions are committed one after
+// the other, when a commit fails the DataTypes committed before stay applied.
+// Their operations keep their responses, the others are ROLLED_BACK, and the
+// batch fails with PARTIALLY_COMMITTED and the DataTypes applied in
+// ResponseMap["committed"].
+// The operations of a batch sent in a transaction are part of it.
+func (p *PureMux) handleBatch(m PureReq, rw *PureResponseWriter) {
+
+	rw.msg.Batch = make([]PureMsg, 0, len(m.Msg.Batch))
+
+	// Already atomic in a transaction
+	atomic, _ := m.Msg.RequestMap["atomic"].(bool)
+	atomic = atomic && m.open == nil
+
+	txs := make(map[string]Transaction)
+	txOrder := []string{}
+	pending := []pendingMsg{}
+
+	for _, op := range m.Msg.Batch {
+
+		req := PureReq{Msg: op, Conn: m.Conn, Tx: m.Tx, Identity: m.Identity, Context: m.Context, Version: m.Version, open: m.open}
+
+		if atomic && req.Tx == nil && op.Action != "batch" {
+			if p.handler(req) == nil {
+				rw.msg.Batch = append(rw.msg.Batch, ErrorMsg(op, CodeUnknownDataType, fmt.Sprintf("No handler for %q", op.DataType)))
+				rw.Fail()
+				break
+			}
+
+			tx, err := p.transaction(req, txs)
+			if err != nil {
+				log.Printf("[Pure] Error starting transaction on %v: %v\n", op.DataType, err)
+				rw.msg.Batch = append(rw.msg.Batch, failedMsg(op, CodeNoTransaction, err.Error()))
+				rw.Fail()
+				break
+			}
+
+			if _, ok := txs[op.DataType]; !ok {
+				txs[op.DataType] = tx
+				txOrder = append(txOrder, op.DataType)
+			}
+			req.Tx = tx
+		}
+
+		var opRw *PureResponseWriter
+
+		if op.Action == "batch" {
+			rw.msg.Batch = append(rw.msg.Batch, ErrorMsg(op, CodeUnknownAction, "Batches can not be nested"))
+			rw.Fail()
+		} else if opRw = p.dispatch(req); opRw == nil {
+			rw.msg.Batch = append(rw.msg.Batch, ErrorMsg(op, CodeUnknownDataType, fmt.Sprintf("No handler for %q", op.DataType)))
+			rw.Fail()
+		} else {
+			rw.msg.Batch = append(rw.msg.Batch, opRw.GetMsg())
+			if !opRw.success {
+				rw.Fail()
+			}
+
+			for _, conn := range opRw.Conns() {
+				if conn != m.Conn {
+					pending = append(pending, pendingMsg{conn, opRw.msgFor(conn)})
+				}
+			}
+		}
+
+		if atomic && !rw.success {
+			break
+		}
+	}
+
+	// Operations skipped after a failure
+	for _, op := range m.Msg.Batch[len(rw.msg.Batch):] {
+		rw.msg.Batch = append(rw.msg.Batch, failedMsg(op, CodeRolledBack, "Skipped after a failure"))
+	}
+
+	committed := make(map[string]bool)
+
+	if atomic {
+		if rw.success {
+			for idx, dataType := range txOrder {
+				if err := txs[dataType].Commit(); err != nil {
+					log.Printf("[Pure] Error committing transaction on %v: %v\n", dataType, err)
+					rw.Fail()
+					// Later transactions can still be cancelled
+					for _, remaining := range txOrder[idx+1:] {
+						txs[remaining].Rollback()
+					}
+					break
+				}
+				committed[dataType] = true
+			}
+		} else {
+			for _, dataType := range txOrder {
+				txs[dataType].Rollback()
+			}
+		}
+
+		// Nothing happened, even for the operations that went well, but on the
+		// DataTypes committed before a failed commit
+		if !rw.success {
+			for idx, op := range rw.msg.Batch {
+				if op.Action == ProtocolErrorAction || committed[op.DataType] {
+					continue
+				}
+				if op.ErrorCode() == "" {
+					rw.msg.Batch[idx] = failedMsg(m.Msg.Batch[idx], CodeRolledBack, "Rolled back")
+				} else {
+					rw.msg.Batch[idx].Action = GetResponseAction(m.Msg.Batch[idx].Action, false)
+					rw.msg.Batch[idx].ResponseMap = make(map[string]interface{})
+				}
+			}
+
+			if len(committed) > 0 {
+				applied := []string{}
+				for _, dataType := range txOrder {
+					if committed[dataType] {
+						applied = append(applied, dataType)
+					}
+				}
+				rw.FailWith(CodePartialCommit, fmt.Sprintf("Commit failed, %v applied", applied))
+				rw.AddValue("committed", applied)
+			}
+
+			for _, pm := range pending {
+				if committed[pm.msg.DataType] {
+					m.send(pm.conn, pm.msg)
+				}
+			}
+
+			return
+		}
+	}
+
+	for _, pm := range pending {
+		m.send(pm.conn, pm.msg)
+	}
+}
+
+// Transaction of the handler of the request, started if needed
+func (p *PureMux) transaction(req PureReq, txs map[string]Transaction) (Transaction, error) {
+
+	if tx, ok := txs[req.Msg.DataType]; ok {
+		return tx, nil
+	}
+
+	handler, ok := p.handler(req).(TransactionalHandler)
+	if !ok {
+		return nil, ErrNoTransaction
+	}
+
+	return handler.Begin(req)
+}
+
+// Response to an operation that could not be run or was cancelled
+func failedMsg(op PureMsg, code string, message string) PureMsg {
+	return PureMsg{
+		Action:         GetResponseAction(op.Action, false),
+		DataType:       op.DataType,
+		LogList:        []LogMessage{{Level: Error, Code: code, Message: message}},
+		ResponseMap:    make(map[string]interface{}),
+		TransactionMap: op.TransactionMap,
+		RequestId:      op.RequestId,
+	}
+}
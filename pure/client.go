@@ -0,0 +1,621 @@
+package pure
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrClientClosed = errors.New("Pure client closed")
+
+// Messages not read from Pushes are kept up to that number
+const PushBuffer = 64
+
+// Request waiting for its response
+type call struct {
+	resp chan PureMsg
+	done chan struct{} // Closed when nobody waits anymore
+}
+
+// Client side of the protocol.
+// Call sends a request and waits for the response with the same RequestId,
+// every other message (pushes, changes made by other clients) is delivered on
+// Pushes.
+type Client struct {
+	send    func(PureMsg) error
+	close   func() error
+	mu      sync.Mutex
+	counter uint64
+	pending map[string]*call
+	pushes  chan PureMsg
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newClient() *Client {
+	return &Client{
+		pending: make(map[string]*call),
+		pushes:  make(chan PureMsg, PushBuffer),
+		done:    make(chan struct{}),
+	}
+}
+
+// Connect to a pure websocket endpoint ("ws://host/pure")
+func Dial(ctx context.Context, url string, header http.Header) (*Client, error) {
+	return DialCodec(ctx, url, header, JSON)
+}
+
+// Connect asking for the encoding of codec, the server can fall back to JSON
+func DialCodec(ctx context.Context, url string, header http.Header, codec Codec) (*Client, error) {
+
+	t := &wsTransport{url: url, header: header, codec: codec}
+	if err := t.dial(ctx, nil); err != nil {
+		return nil, err
+	}
+
+	c := newClient()
+	c.send = t.send
+	c.close = t.close
+
+	go func() {
+		defer c.Close()
+		for {
+			msg, err := t.read()
+			if err != nil {
+				return
+			}
+			c.receive(msg)
+		}
+	}()
+
+	return c, nil
+}
+
+// Connect to a websocket endpoint with sessions. The connection is
+// reestablished when it drops, the messages sent in the meantime are
+// received on reconnection. Calls made while disconnected fail.
+// The SESSION messages are delivered on Pushes, "resumed" is false when the
+// session expired and the state kept by the server (subscriptions...) was lost.
+func DialSession(ctx context.Context, url string, header http.Header, codec Codec) (*Client, error) {
+
+	t := &wsTransport{url: url, header: header, codec: codec}
+	if err := t.dial(ctx, nil); err != nil {
+		return nil, err
+	}
+
+	c := newClient()
+	c.send = t.send
+	c.close = t.close
+
+	go func() {
+		defer c.Close()
+
+		var session string
+		var seq uint64
+
+		for {
+			msg, err := t.read()
+
+			if err != nil {
+				// Closed by the client
+				select {
+				case <-c.done:
+					return
+				default:
+				}
+
+				resume := make(http.Header)
+				resume.Set(SessionHeader, session)
+				resume.Set(SeqHeader, strconv.FormatUint(seq, 10))
+
+				if !t.redial(resume, c.done) {
+					return
+				}
+				continue
+			}
+
+			if msg.Action == SessionAction {
+				session, _ = msg.ResponseMap["session"].(string)
+				if resumed, _ := msg.ResponseMap["resumed"].(bool); !resumed {
+					seq = 0
+				}
+			}
+
+			// Already received before the reconnection
+			if msg.Seq != 0 {
+				if msg.Seq <= seq {
+					continue
+				}
+				seq = msg.Seq
+			}
+
+			c.receive(msg)
+		}
+	}()
+
+	return c, nil
+}
+
+// Websocket of a client, replaced when reconnecting
+type wsTransport struct {
+	url         string
+	header      http.Header
+	codec       Codec
+	mu          sync.Mutex // Protects conn and serializes the writes
+	conn        *websocket.Conn
+	negotiated  Codec
+	messageType int
+}
+
+func (t *wsTransport) dial(ctx context.Context, extra http.Header) error {
+
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{t.codec.Name()}
+	dialer.EnableCompression = true
+
+	header := make(http.Header)
+	for key, values := range t.header {
+		header[key] = values
+	}
+	for key, values := range extra {
+		header[key] = values
+	}
+
+	conn, _, err := dialer.DialContext(ctx, t.url, header)
+	if err != nil {
+		return err
+	}
+
+	codec := codecFor(conn.Subprotocol(), []Codec{t.codec})
+
+	messageType := websocket.TextMessage
+	if codec.Binary() {
+		messageType = websocket.BinaryMessage
+	}
+
+	t.mu.Lock()
+	t.conn, t.negotiated, t.messageType = conn, codec, messageType
+	t.mu.Unlock()
+
+	return nil
+}
+
+// Dial again until it works or done is closed
+func (t *wsTransport) redial(extra http.Header, done chan struct{}) bool {
+
+	delay := 100 * time.Millisecond
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := t.dial(ctx, extra)
+		cancel()
+
+		if err == nil {
+			select {
+			case <-done:
+				// Closed while dialing
+				t.close()
+				return false
+			default:
+				return true
+			}
+		}
+
+		log.Printf("[Pure] Error reconnecting to %v: %v\n", t.url, err)
+
+		select {
+		case <-done:
+			return false
+		case <-time.After(delay):
+		}
+
+		if delay < 5*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+func (t *wsTransport) send(msg PureMsg) error {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	data, err := t.negotiated.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return t.conn.WriteMessage(t.messageType, data)
+}
+
+// Next message, an error means that the connection is over
+func (t *wsTransport) read() (PureMsg, error) {
+
+	t.mu.Lock()
+	conn, codec := t.conn, t.negotiated
+	t.mu.Unlock()
+
+	for {
+		_, p, err := conn.ReadMessage()
+		if err != nil {
+			return PureMsg{}, err
+		}
+
+		msg := PureMsg{}
+		if err := codec.Unmarshal(p, &msg); err != nil {
+			log.Printf("[Pure] Error (%v) Unmarshalling message: %v\n", err, string(p))
+			continue
+		}
+
+		return msg, nil
+	}
+}
+
+func (t *wsTransport) close() error {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	return t.conn.Close()
+}
+
+// Client of a SessionHandler ("http://host/pure/http"), for networks where
+// websockets do not work. Pushes are long-polled.
+func DialHTTP(ctx context.Context, url string, header http.Header) (*Client, error) {
+
+	var session string
+
+	do := func(ctx context.Context, method string, url string, body []byte) (*http.Response, error) {
+
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		if session != "" {
+			req.Header.Set(SessionHeader, session)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode >= 300 {
+			resp.Body.Close()
+			return nil, statusError(resp.StatusCode)
+		}
+
+		return resp, nil
+	}
+
+	resp, err := do(ctx, "POST", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	session = resp.Header.Get(SessionHeader)
+
+	c := newClient()
+	polling, stop := context.WithCancel(context.Background())
+
+	c.send = func(msg PureMsg) error {
+
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+
+		resp, err := do(context.Background(), "POST", url, data)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		msgs := []PureMsg{}
+		if err := json.NewDecoder(resp.Body).Decode(&msgs); err != nil {
+			return err
+		}
+
+		// The caller must be waiting to receive the chunks of the response
+		go func() {
+			for _, msg := range msgs {
+				c.receive(msg)
+			}
+		}()
+
+		return nil
+	}
+
+	c.close = func() error {
+		stop()
+		resp, err := do(context.Background(), "DELETE", url, nil)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	go func() {
+		var since uint64
+
+		for polling.Err() == nil {
+			resp, err := do(polling, "GET", fmt.Sprintf("%v?since=%d", url, since), nil)
+			// The session expired
+			if err == statusError(http.StatusNotFound) {
+				c.Close()
+				return
+			}
+
+			if err != nil {
+				if polling.Err() == nil {
+					log.Printf("[Pure] Error polling %v: %v\n", url, err)
+					time.Sleep(time.Second)
+				}
+				continue
+			}
+
+			poll := struct {
+				Seq      uint64
+				Messages []PureMsg
+			}{}
+			err = json.NewDecoder(resp.Body).Decode(&poll)
+			resp.Body.Close()
+
+			if err != nil {
+				log.Printf("[Pure] Error reading poll of %v: %v\n", url, err)
+				continue
+			}
+
+			for _, msg := range poll.Messages {
+				c.receive(msg)
+			}
+			since = poll.Seq
+		}
+	}()
+
+	return c, nil
+}
+
+type statusError int
+
+func (status statusError) Error() string {
+	return fmt.Sprintf("HTTP Error. Status Code %d", int(status))
+}
+
+// Client talking to mux directly, without network
+func NewLocalClient(mux *PureMux) *Client {
+	return NewAuthLocalClient(mux, nil)
+}
+
+// Local client of an already authenticated user
+func NewAuthLocalClient(mux *PureMux, identity *Identity) *Client {
+
+	c := newClient()
+	conn := &localConn{client: c, muxer: mux, identity: identity}
+
+	// The caller must be waiting to receive the chunks of the response
+	c.send = func(msg PureMsg) error {
+		go conn.Handle(msg)
+		return nil
+	}
+	c.close = func() error {
+		mux.Disconnect(conn)
+		return nil
+	}
+
+	mux.Connect(conn)
+
+	return c
+}
+
+// Send msg and wait for its response. A RequestId is given to msg if it has
+// none.
+// Protocol errors are responses too, the error is only set when no response
+// could be received.
+// The chunks of streamed responses are dropped, only the final message is
+// returned. See Stream.
+func (c *Client) Call(ctx context.Context, msg PureMsg) (PureMsg, error) {
+	return c.Stream(ctx, msg, nil)
+}
+
+// Like Call, the chunks of the response are given to chunk as they arrive
+func (c *Client) Stream(ctx context.Context, msg PureMsg, chunk func(PureMsg)) (PureMsg, error) {
+
+	if err := ctx.Err(); err != nil {
+		return PureMsg{}, err
+	}
+
+	c.mu.Lock()
+	if msg.RequestId == "" {
+		c.counter++
+		msg.RequestId = strconv.FormatUint(c.counter, 10)
+	}
+	if _, ok := c.pending[msg.RequestId]; ok {
+		c.mu.Unlock()
+		return PureMsg{}, errors.New("RequestId already in use: " + msg.RequestId)
+	}
+	pending := &call{resp: make(chan PureMsg, 1), done: make(chan struct{})}
+	c.pending[msg.RequestId] = pending
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, msg.RequestId)
+		c.mu.Unlock()
+		close(pending.done)
+	}()
+
+	select {
+	case <-c.done:
+		return PureMsg{}, ErrClientClosed
+	default:
+	}
+
+	if err := c.send(msg); err != nil {
+		return PureMsg{}, err
+	}
+
+	for {
+		select {
+		case m := <-pending.resp:
+			if !m.More {
+				return m, nil
+			}
+			if chunk != nil {
+				chunk(m)
+			}
+		case <-ctx.Done():
+			// The server can stop working on it
+			c.send(PureMsg{Action: AbortAction, RequestId: msg.RequestId})
+			return PureMsg{}, ctx.Err()
+		case <-c.done:
+			return PureMsg{}, ErrClientClosed
+		}
+	}
+}
+
+// Tell the server the versions and the capabilities the client wants, returns
+// the version chosen and the capabilities granted
+func (c *Client) Hello(ctx context.Context, versions []int, capabilities []string) (int, []string, error) {
+
+	asked := make([]interface{}, 0, len(versions))
+	for _, v := range versions {
+		asked = append(asked, v)
+	}
+
+	wanted := make([]interface{}, 0, len(capabilities))
+	for _, capability := range capabilities {
+		wanted = append(wanted, capability)
+	}
+
+	resp, err := c.Call(ctx, PureMsg{Action: HelloAction, RequestMap: map[string]interface{}{"versions": asked, "capabilities": wanted}})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if resp.Action != GetResponseAction(HelloAction, true) {
+		return 0, nil, fmt.Errorf("Hello failed: %v, server versions: %v", resp.ErrorCode(), resp.ResponseMap["versions"])
+	}
+
+	version, _ := toFloat(resp.ResponseMap["version"])
+
+	granted := []string{}
+	switch list := resp.ResponseMap["capabilities"].(type) {
+	case []string:
+		granted = list
+	case []interface{}:
+		for _, capability := range list {
+			if name, ok := capability.(string); ok {
+				granted = append(granted, name)
+			}
+		}
+	}
+
+	return int(version), granted, nil
+}
+
+// Send the token of a server using token authentication, must be the first
+// message
+func (c *Client) Authenticate(ctx context.Context, token string) error {
+
+	resp, err := c.Call(ctx, PureMsg{Action: AuthenticateAction, RequestMap: map[string]interface{}{"token": token}})
+	if err != nil {
+		return err
+	}
+
+	if resp.Action != GetResponseAction(AuthenticateAction, true) {
+		return errors.New("Authentication failed: " + resp.ErrorCode())
+	}
+
+	return nil
+}
+
+// Messages that are not the response of a Call. The channel is closed with
+// the client.
+func (c *Client) Pushes() <-chan PureMsg {
+	return c.pushes
+}
+
+func (c *Client) Close() error {
+
+	err := ErrClientClosed
+
+	c.once.Do(func() {
+		close(c.done)
+		err = c.close()
+
+		c.mu.Lock()
+		close(c.pushes)
+		c.mu.Unlock()
+	})
+
+	return err
+}
+
+func (c *Client) receive(msg PureMsg) {
+
+	c.mu.Lock()
+
+	// Pushes is closed
+	select {
+	case <-c.done:
+		c.mu.Unlock()
+		return
+	default:
+	}
+
+	if pending, ok := c.pending[msg.RequestId]; ok && msg.RequestId != "" {
+		if !msg.More {
+			delete(c.pending, msg.RequestId)
+		}
+		c.mu.Unlock()
+
+		// Chunks wait for the caller
+		select {
+		case pending.resp <- msg:
+		case <-pending.done:
+		}
+		return
+	}
+
+	defer c.mu.Unlock()
+
+	select {
+	case c.pushes <- msg:
+	default:
+		log.Printf("[Pure] Pushes not read, dropping %v %v message\n", msg.DataType, msg.Action)
+	}
+}
+
+// Connection of a local client
+type localConn struct {
+	client   *Client
+	muxer    *PureMux
+	identity *Identity
+}
+
+func (c *localConn) Send(msg PureMsg) {
+	c.client.receive(msg)
+}
+
+func (c *localConn) Handle(msg PureMsg) {
+	c.muxer.Handle(PureReq{Msg: msg, Conn: c, Identity: c.identity})
+}
+
+func (c *localConn) Identity() *Identity {
+	return c.identity
+}
@@ -0,0 +1,162 @@
+package pure
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/ugorji/go/codec"
+	"reflect"
+)
+
+// Encoding of the messages, negotiated with the websocket subprotocol.
+// Decoded messages hold the same values whatever the codec: numbers are
+// float64, objects map[string]interface{} and binary values base64 strings,
+// like with encoding/json.
+type Codec interface {
+	Name() string // Websocket subprotocol
+	Binary() bool // Messages are sent in binary frames
+	Marshal(msg PureMsg) ([]byte, error)
+	Unmarshal(data []byte, msg *PureMsg) error
+}
+
+var (
+	JSON        Codec = jsonCodec{}
+	MessagePack Codec = &binaryCodec{name: "pure.msgpack", handle: msgpackHandle()}
+	CBOR        Codec = &binaryCodec{name: "pure.cbor", handle: cborHandle()}
+)
+
+// Codecs offered by default, in order of preference of the server
+var DefaultCodecs = []Codec{JSON, MessagePack, CBOR}
+
+// Codec of a subprotocol, JSON when the client did not ask for one
+func codecFor(subprotocol string, codecs []Codec) Codec {
+	for _, c := range codecs {
+		if c.Name() == subprotocol {
+			return c
+		}
+	}
+	return JSON
+}
+
+func codecNames(codecs []Codec) []string {
+	names := make([]string, 0, len(codecs))
+	for _, c := range codecs {
+		names = append(names, c.Name())
+	}
+	return names
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "pure.json"
+}
+
+func (jsonCodec) Binary() bool {
+	return false
+}
+
+func (jsonCodec) Marshal(msg PureMsg) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) Unmarshal(data []byte, msg *PureMsg) error {
+	return json.Unmarshal(data, msg)
+}
+
+type binaryCodec struct {
+	name   string
+	handle codec.Handle
+}
+
+func msgpackHandle() codec.Handle {
+	h := new(codec.MsgpackHandle)
+	// Strings and binary values are told apart, like in CBOR
+	h.WriteExt = true
+	h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	return h
+}
+
+func cborHandle() codec.Handle {
+	h := new(codec.CborHandle)
+	h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	return h
+}
+
+func (c *binaryCodec) Name() string {
+	return c.name
+}
+
+func (c *binaryCodec) Binary() bool {
+	return true
+}
+
+func (c *binaryCodec) Marshal(msg PureMsg) ([]byte, error) {
+
+	var data []byte
+	err := codec.NewEncoderBytes(&data, c.handle).Encode(msg)
+
+	return data, err
+}
+
+func (c *binaryCodec) Unmarshal(data []byte, msg *PureMsg) error {
+
+	if err := codec.NewDecoderBytes(data, c.handle).Decode(msg); err != nil {
+		return err
+	}
+
+	normalizeMsg(msg)
+
+	return nil
+}
+
+// Give the free form maps the types encoding/json would have used
+func normalizeMsg(msg *PureMsg) {
+
+	for key, value := range msg.RequestMap {
+		msg.RequestMap[key] = normalize(value)
+	}
+
+	for key, value := range msg.ResponseMap {
+		msg.ResponseMap[key] = normalize(value)
+	}
+
+	for idx := range msg.Batch {
+		normalizeMsg(&msg.Batch[idx])
+	}
+}
+
+func normalize(value interface{}) interface{} {
+
+	switch v := value.(type) {
+
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = normalize(elem)
+		}
+		return v
+
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			m[fmt.Sprint(key)] = normalize(elem)
+		}
+		return m
+
+	case []interface{}:
+		for idx, elem := range v {
+			v[idx] = normalize(elem)
+		}
+		return v
+
+	// encoding/json sends []byte as base64 strings
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	}
+
+	if f, ok := toFloat(value); ok {
+		return f
+	}
+
+	return value
+}
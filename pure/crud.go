@@ -0,0 +1,524 @@
+package pure
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"reflect"
+	"sync"
+)
+
+// Storage of the objects of a CRUDHandler, saverstore adapts saver.DbManager.
+// Objects are pointers to structs, Retrieve fills dst, a pointer to such a
+// pointer. Retrieve and Update fail with sql.ErrNoRows when there is no
+// object with the id, an Update changing nothing succeeds.
+type Store interface {
+	Save(obj interface{}) error
+	Retrieve(ID int, dst interface{}) error
+	Update(obj interface{}) error
+	Delete(obj interface{}) error
+	Flush(obj interface{}) (int64, error)
+}
+
+// Stores able to run operations in a transaction, for the atomic batches and
+// the transactions of the clients. saverstore adapts saver.DbManager.
+// Begin and the operations of the transactions run while other operations
+// of the store do.
+type TransactionalStore interface {
+	Store
+	Begin() (StoreTx, error)
+}
+
+// Operations applied to the store on Commit. Commit runs alone with the
+// store, unless the transaction is a MergingTx.
+type StoreTx interface {
+	Store
+	Transaction
+}
+
+// Transactions committed in two steps: Apply commits them in the database
+// while the store is in use, Merge then updates the objects the store keeps
+// in memory and runs alone with it.
+type MergingTx interface {
+	StoreTx
+	Apply() error
+	Merge()
+}
+
+// Stores able to list objects for the retrieve requests with a query,
+// saverstore adapts saver.DbManager. dst is a pointer to a slice of pointers
+// to structs.
+type Finder interface {
+	Find(p Page, dst interface{}) error
+}
+
+// Handler of the objects of a struct type kept in a Store.
+//
+//	create    RequestMap holds the fields of the new object
+//	retrieve  the object of RequestMap["id"], or the objects of the query of
+//	          RequestMap["query"] if the Store is a Finder (see QueryKey)
+//	update    sets the fields of RequestMap on the object of RequestMap["id"]
+//	delete    the object of RequestMap["id"]
+//	flush     every object of the type, the number deleted is in
+//	          ResponseMap["flushed"]
+//
+// The fields are named like the fields of the struct, ResponseMap holds the
+// object after the operation. ManyToOne relations are given by the id of the
+// target, OneToMany ones are left out.
+// Only the writable fields can be set, the id never is.
+// The changes are published to the subscribers of the DataType.
+// With a TransactionalStore the handler takes part in atomic batches and
+// transactions.
+type CRUDHandler struct {
+	mux      *PureMux
+	store    Store
+	objType  reflect.Type
+	id       string
+	writable map[string]bool
+	mu       sync.Mutex // Stores like DbManager are not safe for concurrent use
+}
+
+// obj is a pointer to a struct of the type handled, mux can be nil to publish
+// nothing
+func NewCRUDHandler(mux *PureMux, store Store, obj interface{}, writable ...string) *CRUDHandler {
+
+	objType := reflect.TypeOf(obj).Elem()
+
+	h := &CRUDHandler{
+		mux:      mux,
+		store:    store,
+		objType:  objType,
+		id:       idField(objType),
+		writable: make(map[string]bool),
+	}
+
+	for _, name := range writable {
+		if name == h.id {
+			panic("The id of " + objType.Name() + " can not be writable")
+		}
+		if _, ok := objType.FieldByName(name); !ok {
+			panic("No field " + name + " in " + objType.Name())
+		}
+		h.writable[name] = true
+	}
+
+	return h
+}
+
+func (h *CRUDHandler) Create(m PureReq, rw ResponseWriter) {
+
+	rww := rw.(*PureResponseWriter)
+
+	obj := reflect.New(h.objType)
+	if !h.set(obj.Elem(), m.Msg.RequestMap, rww) {
+		return
+	}
+
+	store, unlock := h.storeOf(m)
+	err := store.Save(obj.Interface())
+	unlock()
+
+	if err != nil {
+		h.fail(m, rww, err)
+		return
+	}
+
+	h.respond(m, rww, obj, true)
+}
+
+func (h *CRUDHandler) Retrieve(m PureReq, rw ResponseWriter) {
+
+	rww := rw.(*PureResponseWriter)
+
+	if q, errs := ParseQuery(m.Msg); q != nil || len(errs) > 0 {
+		h.list(m, rww, q, errs)
+		return
+	}
+
+	store, unlock := h.storeOf(m)
+	obj, ok := h.retrieve(store, m, rww)
+	unlock()
+
+	if ok {
+		h.respond(m, rww, obj, false)
+	}
+}
+
+func (h *CRUDHandler) list(m PureReq, rw *PureResponseWriter, q *Query, errs []LogMessage) {
+
+	if len(errs) > 0 {
+		for _, e := range errs {
+			rw.FieldError(e.Field, e.Code, e.Message)
+		}
+		return
+	}
+
+	store, unlock := h.storeOf(m)
+	defer unlock()
+
+	finder, ok := store.(Finder)
+	if !ok {
+		rw.FieldError(QueryKey, CodeInvalid, fmt.Sprintf("%v can not be listed", m.Msg.DataType))
+		return
+	}
+
+	fields := objectMap(reflect.New(h.objType).Elem())
+	for _, field := range q.UsedFields() {
+		if _, ok := fields[field]; !ok {
+			rw.FieldError(QueryKey, CodeInvalid, fmt.Sprintf("Unknown field %v", field))
+			return
+		}
+	}
+
+	dst := reflect.New(reflect.SliceOf(reflect.PtrTo(h.objType)))
+
+	err := finder.Find(q.Page(), dst.Interface())
+
+	if err != nil {
+		h.fail(m, rw, err)
+		return
+	}
+
+	objects := dst.Elem()
+	items := []interface{}{}
+
+	for i := 0; i < objects.Len() && i < q.Limit; i++ {
+		items = append(items, q.Project(objectMap(objects.Index(i).Elem()), h.id))
+	}
+
+	rw.AddValue("items", items)
+
+	// One more than asked for was found
+	if objects.Len() > q.Limit {
+		rw.AddValue("cursor", q.NextCursor(objectMap(objects.Index(q.Limit-1).Elem()), h.id))
+	}
+}
+
+func (h *CRUDHandler) Update(m PureReq, rw ResponseWriter) {
+
+	rww := rw.(*PureResponseWriter)
+
+	values := make(map[string]interface{}, len(m.Msg.RequestMap))
+	for key, value := range m.Msg.RequestMap {
+		if key != "id" {
+			values[key] = value
+		}
+	}
+
+	store, unlock := h.storeOf(m)
+	obj, ok := h.retrieve(store, m, rww)
+	if !ok {
+		unlock()
+		return
+	}
+
+	// The object of the cache is only changed when the values are valid
+	changed := reflect.New(h.objType)
+	changed.Elem().Set(obj.Elem())
+
+	if !h.set(changed.Elem(), values, rww) {
+		unlock()
+		return
+	}
+
+	err := store.Update(changed.Interface())
+	if err == nil {
+		obj.Elem().Set(changed.Elem())
+	}
+	unlock()
+
+	if err != nil {
+		h.fail(m, rww, err)
+		return
+	}
+
+	h.respond(m, rww, obj, true)
+}
+
+func (h *CRUDHandler) Delete(m PureReq, rw ResponseWriter) {
+
+	rww := rw.(*PureResponseWriter)
+
+	store, unlock := h.storeOf(m)
+	obj, ok := h.retrieve(store, m, rww)
+	if !ok {
+		unlock()
+		return
+	}
+	err := store.Delete(obj.Interface())
+	unlock()
+
+	if err != nil {
+		h.fail(m, rww, err)
+		return
+	}
+
+	id := obj.Elem().FieldByName(h.id).Interface()
+	rww.AddValue("id", id)
+
+	h.publish(m, map[string]interface{}{"id": id})
+}
+
+func (h *CRUDHandler) Flush(m PureReq, rw ResponseWriter) {
+
+	rww := rw.(*PureResponseWriter)
+
+	store, unlock := h.storeOf(m)
+	flushed, err := store.Flush(reflect.New(h.objType).Interface())
+	unlock()
+
+	if err != nil {
+		h.fail(m, rww, err)
+		return
+	}
+
+	rww.AddValue("flushed", flushed)
+
+	h.publish(m, map[string]interface{}{"flushed": flushed})
+}
+
+func (h *CRUDHandler) Begin(m PureReq) (Transaction, error) {
+
+	store, ok := h.store.(TransactionalStore)
+	if !ok {
+		return nil, ErrNoTransaction
+	}
+
+	tx, err := store.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	return &crudTx{StoreTx: tx, handler: h}, nil
+}
+
+// Transaction begun by a CRUDHandler, the commit changes the store then
+// publishes the changes made in the transaction
+type crudTx struct {
+	StoreTx
+	handler *CRUDHandler
+	changes []change
+}
+
+// Change published once committed
+type change struct {
+	dataType string
+	event    string
+	data     map[string]interface{}
+}
+
+func (t *crudTx) Commit() error {
+
+	if err := t.commit(); err != nil {
+		return err
+	}
+
+	for _, c := range t.changes {
+		t.handler.mux.Publish(c.dataType, c.event, c.data)
+	}
+	t.changes = nil
+
+	return nil
+}
+
+// The database is committed without the lock of the handler, the operations
+// holding it may wait for rows locked by the transaction
+func (t *crudTx) commit() error {
+
+	mu := &t.handler.mu
+
+	tx, ok := t.StoreTx.(MergingTx)
+	if !ok {
+		mu.Lock()
+		defer mu.Unlock()
+		return t.StoreTx.Commit()
+	}
+
+	if err := tx.Apply(); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	tx.Merge()
+	mu.Unlock()
+
+	return nil
+}
+
+func (t *crudTx) Rollback() error {
+	t.changes = nil
+	return t.StoreTx.Rollback()
+}
+
+// Store for the request, its transaction if it is in one. unlock is called
+// once done with it.
+func (h *CRUDHandler) storeOf(m PureReq) (store Store, unlock func()) {
+
+	// Operations of a transaction are already run one at a time
+	if tx, ok := m.Tx.(*crudTx); ok {
+		return tx.StoreTx, func() {}
+	}
+
+	h.mu.Lock()
+
+	return h.store, h.mu.Unlock
+}
+
+// Object of RequestMap["id"], the response fails when there is none
+func (h *CRUDHandler) retrieve(store Store, m PureReq, rw *PureResponseWriter) (reflect.Value, bool) {
+
+	n, ok := toFloat(m.Msg.RequestMap["id"])
+	if !ok || n != math.Trunc(n) {
+		rw.FieldError("id", CodeInvalid, "id must be an integer")
+		return reflect.Value{}, false
+	}
+
+	dst := reflect.New(reflect.PtrTo(h.objType))
+	if err := store.Retrieve(int(n), dst.Interface()); err != nil {
+		h.fail(m, rw, err)
+		return reflect.Value{}, false
+	}
+
+	return dst.Elem(), true
+}
+
+// Set the fields of obj, a struct, with values. Every field error is reported.
+func (h *CRUDHandler) set(obj reflect.Value, values map[string]interface{}, rw *PureResponseWriter) bool {
+
+	valid := true
+
+	for name, value := range values {
+		if !h.writable[name] {
+			rw.FieldError(name, CodeForbidden, fmt.Sprintf("%v can not be written", name))
+			valid = false
+			continue
+		}
+
+		if err := setField(obj.FieldByName(name), value); err != "" {
+			rw.FieldError(name, CodeInvalid, fmt.Sprintf("%v must be %v", name, err))
+			valid = false
+		}
+	}
+
+	return valid
+}
+
+func (h *CRUDHandler) respond(m PureReq, rw *PureResponseWriter, obj reflect.Value, publish bool) {
+
+	data := objectMap(obj.Elem())
+
+	for key, value := range data {
+		rw.AddValue(key, value)
+	}
+
+	if publish {
+		h.publish(m, data)
+	}
+}
+
+// Publish a change to the subscribers, on commit for the requests in a
+// transaction
+func (h *CRUDHandler) publish(m PureReq, data map[string]interface{}) {
+
+	if h.mux == nil {
+		return
+	}
+
+	if tx, ok := m.Tx.(*crudTx); ok {
+		tx.changes = append(tx.changes, change{m.Msg.DataType, m.Msg.Action, data})
+		return
+	}
+
+	h.mux.Publish(m.Msg.DataType, m.Msg.Action, data)
+}
+
+func (h *CRUDHandler) fail(m PureReq, rw *PureResponseWriter, err error) {
+
+	if err == sql.ErrNoRows {
+		rw.FailWith(CodeNotFound, fmt.Sprintf("No %v %v", m.Msg.DataType, m.Msg.RequestMap["id"]))
+		return
+	}
+
+	log.Printf("[Pure] Error on %v %v: %v\n", m.Msg.Action, m.Msg.DataType, err)
+	rw.FailWith(CodeInternal, err.Error())
+}
+
+// Name of the id field, found like saver does
+func idField(objType reflect.Type) string {
+
+	for i := 0; i < objType.NumField(); i++ {
+		if objType.Field(i).Tag.Get("id") != "" {
+			return objType.Field(i).Name
+		}
+	}
+
+	return "Id"
+}
+
+// Values of the fields of obj, a struct
+func objectMap(obj reflect.Value) map[string]interface{} {
+
+	data := make(map[string]interface{})
+
+	for i := 0; i < obj.NumField(); i++ {
+		field := obj.Type().Field(i)
+
+		switch field.Tag.Get("type") {
+		case "OneToMany":
+			continue
+		case "ManyToOne":
+			if target := obj.Field(i); !target.IsNil() {
+				data[field.Name] = target.Elem().FieldByName(idField(target.Type().Elem())).Interface()
+			} else {
+				data[field.Name] = nil
+			}
+		default:
+			if field.PkgPath == "" {
+				data[field.Name] = obj.Field(i).Interface()
+			}
+		}
+	}
+
+	return data
+}
+
+// Reason why value does not fit in field, empty if it was set
+func setField(field reflect.Value, value interface{}) string {
+
+	switch field.Kind() {
+
+	case reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			return "a string"
+		}
+		field.SetString(s)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := toFloat(value)
+		if !ok || n != math.Trunc(n) || field.OverflowInt(int64(n)) {
+			return "an integer"
+		}
+		field.SetInt(int64(n))
+
+	case reflect.Float32, reflect.Float64:
+		n, ok := toFloat(value)
+		if !ok {
+			return "a number"
+		}
+		field.SetFloat(n)
+
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return "a boolean"
+		}
+		field.SetBool(b)
+
+	default:
+		return "set by the server"
+	}
+
+	return ""
+}
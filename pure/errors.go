@@ -0,0 +1,95 @@
+package pure
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+)
+
+// Machine readable codes of the LogMessages attached to failed responses
+const (
+	CodeMalformed          = "MALFORMED_MESSAGE"
+	CodeUnknownDataType    = "UNKNOWN_DATATYPE"
+	CodeUnknownAction      = "UNKNOWN_ACTION"
+	CodeInternal           = "INTERNAL_ERROR"
+	CodeInvalid            = "INVALID"
+	CodeNotFound           = "NOT_FOUND"
+	CodeConflict           = "CONFLICT"
+	CodeNoTransaction      = "NO_TRANSACTION"
+	CodeRolledBack         = "ROLLED_BACK"
+	CodePartialCommit      = "PARTIALLY_COMMITTED"
+	CodeUnauthenticated    = "UNAUTHENTICATED"
+	CodeForbidden          = "FORBIDDEN"
+	CodeRateLimited        = "RATE_LIMITED"
+	CodeAborted            = "ABORTED"
+	CodeUnsupportedVersion = "UNSUPPORTED_VERSION"
+)
+
+// Reply to a message that could not be given to a handler
+func ErrorMsg(request PureMsg, code string, message string) PureMsg {
+	return PureMsg{
+		Action:         ProtocolErrorAction,
+		DataType:       request.DataType,
+		LogList:        []LogMessage{{Level: Error, Code: code, Message: message}},
+		ResponseMap:    make(map[string]interface{}),
+		TransactionMap: request.TransactionMap,
+		RequestId:      request.RequestId,
+	}
+}
+
+// Error entries of the LogList
+func (m PureMsg) Errors() []LogMessage {
+
+	errs := []LogMessage{}
+	for _, entry := range m.LogList {
+		if entry.Level == Error {
+			errs = append(errs, entry)
+		}
+	}
+
+	return errs
+}
+
+// Code of the first error that does not concern a single field, or of the
+// first field error
+func (m PureMsg) ErrorCode() string {
+
+	code := ""
+	for _, entry := range m.Errors() {
+		if entry.Field == "" {
+			return entry.Code
+		}
+		if code == "" {
+			code = entry.Code
+		}
+	}
+
+	return code
+}
+
+// Field level errors, by field name
+func (m PureMsg) FieldErrors() map[string]LogMessage {
+
+	fields := make(map[string]LogMessage)
+	for _, entry := range m.Errors() {
+		if entry.Field != "" {
+			if _, ok := fields[entry.Field]; !ok {
+				fields[entry.Field] = entry
+			}
+		}
+	}
+
+	return fields
+}
+
+// Turn a panic of a handler into an internal error response
+func recoverHandler(m PureReq, rw *PureResponseWriter) {
+
+	if err := recover(); err != nil {
+		log.Printf("[Pure] Panic Recovery in %v/%v: %+v\n%s", m.Msg.DataType, m.Msg.Action, err, debug.Stack())
+
+		// Partial results and additional destinations are dropped
+		*rw = *NewResponseWriter(m)
+		rw.ProtocolError(CodeInternal, fmt.Sprintf("Internal error while handling %v", m.Msg.Action))
+	}
+}
@@ -0,0 +1,188 @@
+package pure
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Handles a request that was routed to a handler
+type HandlerFunc func(PureReq, *PureResponseWriter)
+
+// Wraps the handling of every request, like loggingHandler and recoverHandler
+// do for HTTP. Batches go through the middlewares, then each of their
+// operations.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Add middlewares to the chain, the first one sees the request first
+func (p *PureMux) Use(middlewares ...Middleware) {
+	p.middlewares = append(p.middlewares, middlewares...)
+}
+
+// Actions handled by the mux rather than by the handler of a DataType
+var protocolActions = map[string]bool{HelloAction: true, BeginAction: true, CommitAction: true, RollbackAction: true, "batch": true}
+
+// Role of the connections without identity
+const AnonymousRole = "anonymous"
+
+// Decides whether a user can run an action on a DataType
+type Policy interface {
+	Allow(id *Identity, dataType string, action string) bool
+}
+
+type PolicyFunc func(id *Identity, dataType string, action string) bool
+
+func (f PolicyFunc) Allow(id *Identity, dataType string, action string) bool {
+	return f(id, dataType, action)
+}
+
+// Actions allowed to each role, by DataType. "*" matches any DataType or
+// action.
+//
+//	RolePolicy{
+//		"reader": {"*": {"retrieve", "subscribe", "unsubscribe"}},
+//		"admin":  {"*": {"*"}},
+//	}
+type RolePolicy map[string]map[string][]string
+
+func (p RolePolicy) Allow(id *Identity, dataType string, action string) bool {
+
+	roles := []string{AnonymousRole}
+	if id != nil {
+		roles = id.Roles
+	}
+
+	for _, role := range roles {
+		for _, dt := range []string{dataType, "*"} {
+			for _, a := range p[role][dt] {
+				if a == action || a == "*" {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// Refuse the requests not allowed by policy with a FORBIDDEN error.
+// Connections with an identity can always use the actions of the protocol
+// (hello, begin, commit, rollback and batch), the anonymous ones only if
+// policy allows them. The operations of a batch are checked one by one.
+func Authorize(policy Policy) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(m PureReq, rw *PureResponseWriter) {
+
+			if protocolActions[m.Msg.Action] && m.Identity != nil {
+				next(m, rw)
+				return
+			}
+
+			if !policy.Allow(m.Identity, m.Msg.DataType, m.Msg.Action) {
+				rw.FailWith(CodeForbidden, fmt.Sprintf("%v not allowed on %v", m.Msg.Action, m.Msg.DataType))
+				return
+			}
+
+			next(m, rw)
+		}
+	}
+}
+
+// Log every request with its outcome and duration
+func Logging() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(m PureReq, rw *PureResponseWriter) {
+
+			t1 := time.Now()
+
+			next(m, rw)
+
+			user := AnonymousRole
+			if m.Identity != nil {
+				user = m.Identity.Name
+			}
+
+			resp := rw.GetMsg()
+			log.Printf("[Pure] %v %v by %v: %v %v %v\n", m.Msg.Action, m.Msg.DataType, user, resp.Action, resp.ErrorCode(), time.Since(t1))
+		}
+	}
+}
+
+// Turn the panics of the next handlers into internal errors, so that the
+// middlewares placed before see a failed response
+func Recover() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(m PureReq, rw *PureResponseWriter) {
+			defer recoverHandler(m, rw)
+			next(m, rw)
+		}
+	}
+}
+
+type ActionStats struct {
+	Count    int64
+	Failures int64
+	Duration time.Duration // Total time spent handling the requests
+}
+
+// Request counts by "DataType/action". Metrics can be published with
+// expvar.Publish.
+type Metrics struct {
+	mu    sync.Mutex
+	stats map[string]ActionStats
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{stats: make(map[string]ActionStats)}
+}
+
+func (metrics *Metrics) Middleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(m PureReq, rw *PureResponseWriter) {
+
+			t1 := time.Now()
+
+			next(m, rw)
+
+			key := m.Msg.DataType + "/" + m.Msg.Action
+
+			metrics.mu.Lock()
+			defer metrics.mu.Unlock()
+
+			stats := metrics.stats[key]
+			stats.Count++
+			if !rw.Success() {
+				stats.Failures++
+			}
+			stats.Duration += time.Since(t1)
+			metrics.stats[key] = stats
+		}
+	}
+}
+
+// Copy of the current stats
+func (metrics *Metrics) Snapshot() map[string]ActionStats {
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	snapshot := make(map[string]ActionStats, len(metrics.stats))
+	for key, stats := range metrics.stats {
+		snapshot[key] = stats
+	}
+
+	return snapshot
+}
+
+// JSON of the stats, for expvar
+func (metrics *Metrics) String() string {
+
+	data, err := json.Marshal(metrics.Snapshot())
+	if err != nil {
+		return "{}"
+	}
+
+	return string(data)
+}
@@ -1,11 +1,8 @@
 package pure
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"github.com/gorilla/websocket"
-	"log"
-	"net/http"
 )
 
 const (
@@ -13,12 +10,20 @@ const (
 	Debug = iota
 )
 
+// Action of the responses to requests the mux could not understand
+const ProtocolErrorAction = "ERROR"
+
+// Code and Field are set on errors, Field is the RequestMap key concerned
 type LogMessage struct {
 	Level   int
 	Id      int
 	Message string
+	Code    string `json:",omitempty"`
+	Field   string `json:",omitempty"`
 }
 
+// RequestId is chosen by the client and copied to the response sent back to
+// it, the messages sent to other connections do not have one
 type PureMsg struct {
 	Action         string
 	DataType       string
@@ -26,6 +31,13 @@ type PureMsg struct {
 	RequestMap     map[string]interface{}
 	ResponseMap    map[string]interface{}
 	TransactionMap map[string]string
+	Batch          []PureMsg `json:",omitempty"`
+	Event          string    `json:",omitempty"`
+	RequestId      string    `json:",omitempty"`
+	Chunk          int       `json:",omitempty"` // Position of the part of a streamed response, from 1
+	More           bool      `json:",omitempty"` // Other chunks follow
+	Seq            uint64    `json:",omitempty"` // Position of the message in the stream of a session
+	Version        int       `json:",omitempty"` // Protocol version, left out for ProtocolVersion (see HelloAction)
 }
 
 // Can implement user check
@@ -35,55 +47,260 @@ type PureConnection interface {
 }
 
 // msg can be nil if resp to no request
+// Tx is set when the request is part of a transaction of the handler
+// Identity is the user of the connection, nil if anonymous
+// Context is cancelled when the client aborts the request or goes away
+// Version is the protocol version spoken by the client
 type PureReq struct {
-	Msg  PureMsg
-	Conn PureConnection
+	Msg      PureMsg
+	Conn     PureConnection
+	Tx       Transaction
+	Identity *Identity
+	Context  context.Context
+	Version  int
+	open     *openTx // Transaction of TransactionMap
 }
 
-// The handler can implement PUSH by keeping track of the owner of data
+// The handler can implement PUSH by keeping track of the owner of data, or
+// by publishing its changes to the subscribers with PureMux.Publish
 type PureHandler interface {
 	Create(PureReq, ResponseWriter)
 	Retrieve(PureReq, ResponseWriter)
-	Update(PureReq)
-	Delete(PureReq)
-	Flush(PureReq)
+	Update(PureReq, ResponseWriter)
+	Delete(PureReq, ResponseWriter)
+	Flush(PureReq, ResponseWriter)
+}
+
+// Handlers can be told about the connections coming and going
+type ConnectHandler interface {
+	OnConnect(PureConnection)
+}
+
+type DisconnectHandler interface {
+	OnDisconnect(PureConnection)
 }
 
 type PureMux struct {
-	handlers map[string]PureHandler
+	handlers    map[string]PureHandler
+	subs        *subscriptions
+	txs         *transactions
+	versions    *versions
+	middlewares []Middleware
+	schemas     map[string]Schema   // By DataType/action
+	watchers    []DisconnectHandler // Told about the connections going away
 }
 
 func (p *PureMux) Handle(m PureReq) {
 
-	handler, ok := p.handlers[m.Msg.DataType]
+	var rw *PureResponseWriter
 
+	if m.Identity == nil {
+		m.Identity = IdentityOf(m.Conn)
+	}
+
+	if m.Context == nil {
+		m.Context = context.Background()
+	}
+
+	// The version picks the handler and the format of the responses, it is
+	// checked before the middlewares. Refusing a version changes nothing and
+	// tells nothing the client did not send.
+	version, ok := p.versions.of(m)
 	if !ok {
-		fmt.Println("Error Handler not Found")
+		m.Conn.Send(ErrorMsg(m.Msg, CodeUnsupportedVersion, fmt.Sprintf("Unsupported version %v", version)))
 		return
 	}
+	m.Version = version
+
+	if id := m.Msg.TransactionMap[TransactionKey]; id != "" && m.Msg.Action != CommitAction && m.Msg.Action != RollbackAction {
+		if m.open = p.txs.get(id, m.Conn); m.open == nil {
+			rw = NewResponseWriter(m)
+			rw.FailWith(CodeNoTransaction, fmt.Sprintf("No transaction %q", id))
+			m.Conn.Send(rw.GetMsg())
+			return
+		}
+	}
 
-	rw := &PureResponseWriter{msg: &PureMsg{ResponseMap: make(map[string]interface{})}}
-	rw.connections = append(rw.connections, m.Conn)
-	rw.msg.TransactionMap = m.Msg.TransactionMap
-	rw.msg.DataType = m.Msg.DataType
-	rw.msg.Action = m.Msg.Action
-	rw.success = true
+	switch m.Msg.Action {
+	case AbortAction:
+		// Aborts are handled by the connections running the requests
+		return
+	case HelloAction:
+		rw = p.protocol(m, p.negotiate)
+	case BeginAction, CommitAction, RollbackAction:
+		rw = p.protocol(m, p.handleTransaction)
+	case "batch":
+		rw = p.protocol(m, p.handleBatch)
+	default:
+		rw = p.dispatch(m)
+	}
 
-	if m.Msg.Action == "create" {
-		handler.Create(m, rw)
+	if rw == nil {
+		m.Conn.Send(ErrorMsg(m.Msg, CodeUnknownDataType, fmt.Sprintf("No handler for %q", m.Msg.DataType)))
+		return
+	}
+
+	for _, conn := range rw.Conns() {
+		m.send(conn, rw.msgFor(conn))
+	}
+
+}
+
+// Changes made in a transaction are sent to the other connections on commit
+func (m PureReq) send(conn PureConnection, msg PureMsg) {
+
+	if m.open != nil && conn != m.Conn {
+		m.open.later(conn, msg)
+		return
+	}
+
+	conn.Send(msg)
+}
+
+// Run the handler of the request, nil if there is none
+func (p *PureMux) dispatch(m PureReq) (rw *PureResponseWriter) {
+
+	handler := p.handler(m)
+
+	if handler == nil {
+		return nil
+	}
+
+	rw = NewResponseWriter(m)
 
-	} else if m.Msg.Action == "retrieve" {
+	if m.Context.Err() != nil {
+		rw.FailWith(CodeAborted, "Request aborted")
+		return rw
+	}
+
+	if m.open != nil && m.Tx == nil {
+		tx, err := m.open.acquire(p, m)
+		if err != nil {
+			rw.FailWith(CodeNoTransaction, err.Error())
+			return rw
+		}
+		defer m.open.release()
+		m.Tx = tx
+	}
+
+	defer recoverHandler(m, rw)
+
+	p.chain(func(m PureReq, rw *PureResponseWriter) {
+		p.serve(handler, m, rw)
+	})(m, rw)
+
+	return rw
+}
+
+// Run a request of the protocol itself through the middlewares, like the
+// requests of the handlers
+func (p *PureMux) protocol(m PureReq, handle HandlerFunc) (rw *PureResponseWriter) {
+
+	rw = NewResponseWriter(m)
+
+	defer recoverHandler(m, rw)
+
+	p.chain(handle)(m, rw)
+
+	return rw
+}
+
+// Wrap the last step of the handling of a request in the middlewares
+func (p *PureMux) chain(serve HandlerFunc) HandlerFunc {
+
+	// The first middleware is the outermost
+	for i := len(p.middlewares) - 1; i >= 0; i-- {
+		serve = p.middlewares[i](serve)
+	}
+
+	return serve
+}
+
+func (p *PureMux) serve(handler PureHandler, m PureReq, rw *PureResponseWriter) {
+
+	if schema, ok := p.schemas[m.Msg.DataType+"/"+m.Msg.Action]; ok {
+		if errs := schema.Validate(m.Msg.RequestMap); len(errs) > 0 {
+			for _, e := range errs {
+				rw.FieldError(e.Field, e.Code, e.Message)
+			}
+			return
+		}
+	}
+
+	switch m.Msg.Action {
+	case "create":
+		handler.Create(m, rw)
+	case "retrieve":
 		handler.Retrieve(m, rw)
+	case "update":
+		handler.Update(m, rw)
+	case "delete":
+		handler.Delete(m, rw)
+	case "flush":
+		handler.Flush(m, rw)
+	case "subscribe":
+		p.subscribe(m, rw)
+	case "unsubscribe":
+		p.unsubscribe(m, rw)
+	default:
+		rw.ProtocolError(CodeUnknownAction, fmt.Sprintf("Unknown action: %q", m.Msg.Action))
 	}
+}
 
-	for _, conn := range rw.Conns() {
-		conn.Send(rw.GetMsg())
+// A new connection is ready
+func (p *PureMux) Connect(conn PureConnection) {
+	for _, handler := range p.allHandlers() {
+		if h, ok := handler.(ConnectHandler); ok {
+			h.OnConnect(conn)
+		}
 	}
+}
+
+// Forget everything about a connection that went away
+func (p *PureMux) Disconnect(conn PureConnection) {
 
+	p.subs.drop(conn)
+	p.txs.drop(conn)
+	p.versions.drop(conn)
+
+	for _, handler := range p.allHandlers() {
+		if h, ok := handler.(DisconnectHandler); ok {
+			h.OnDisconnect(conn)
+		}
+	}
+
+	for _, watcher := range p.watchers {
+		watcher.OnDisconnect(conn)
+	}
+}
+
+// Tell watchers about the connections going away, like the handlers. For
+// middlewares keeping state by connection.
+func (p *PureMux) Watch(watchers ...DisconnectHandler) {
+	p.watchers = append(p.watchers, watchers...)
+}
+
+// Handlers of every DataType and version
+func (p *PureMux) allHandlers() []PureHandler {
+
+	handlers := []PureHandler{}
+	for _, handler := range p.handlers {
+		handlers = append(handlers, handler)
+	}
+
+	p.versions.Lock()
+	for _, byVersion := range p.versions.handlers {
+		for _, handler := range byVersion {
+			handlers = append(handlers, handler)
+		}
+	}
+	p.versions.Unlock()
+
+	return handlers
 }
 
 func NewPureMux() *PureMux {
-	return &PureMux{handlers: make(map[string]PureHandler)}
+	return &PureMux{handlers: make(map[string]PureHandler), subs: newSubscriptions(), txs: newTransactions(), versions: newVersions(), schemas: make(map[string]Schema)}
 }
 
 func (p *PureMux) RegisterHandler(dataType string, handler PureHandler) {
@@ -106,6 +323,11 @@ func (c *GoConn) Handle(msg PureMsg) {
 	c.Muxer.Handle(req)
 }
 
+// The connection is not used anymore
+func (c *GoConn) Close() {
+	c.Muxer.Disconnect(c)
+}
+
 func (c *GoConn) SendReq(msg PureMsg) {
 	c.Handle(msg)
 }
@@ -125,9 +347,31 @@ type PureResponseWriter struct {
 	msg         *PureMsg
 	connections []PureConnection
 	success     bool
+	protocol    bool
+	chunks      int
+}
+
+// Response to m, sent back to the connection of the request
+func NewResponseWriter(m PureReq) *PureResponseWriter {
+
+	rw := &PureResponseWriter{msg: &PureMsg{ResponseMap: make(map[string]interface{})}}
+	rw.connections = append(rw.connections, m.Conn)
+	rw.msg.TransactionMap = m.Msg.TransactionMap
+	rw.msg.DataType = m.Msg.DataType
+	rw.msg.Action = m.Msg.Action
+	rw.msg.RequestId = m.Msg.RequestId
+	rw.msg.Version = versionField(m.Version)
+	rw.success = true
+
+	return rw
 }
 
 func (rw *PureResponseWriter) AddConn(conn PureConnection) {
+	for _, c := range rw.connections {
+		if c == conn {
+			return
+		}
+	}
 	rw.connections = append(rw.connections, conn)
 }
 
@@ -136,112 +380,111 @@ func (rw *PureResponseWriter) Conns() []PureConnection {
 }
 
 func (rw *PureResponseWriter) GetMsg() PureMsg {
-	rw.msg.Action = GetResponseAction(rw.msg.Action, rw.success)
-	return *rw.msg
-}
-
-func (rw *PureResponseWriter) AddValue(key string, value interface{}) {
-	rw.msg.ResponseMap[key] = value
+	msg := *rw.msg
+	msg.Action = GetResponseAction(rw.msg.Action, rw.success)
+	if rw.protocol {
+		msg.Action = ProtocolErrorAction
+	}
+	// Completion marker of a streamed response
+	if rw.chunks > 0 {
+		msg.Chunk = rw.chunks + 1
+	}
+	return msg
 }
 
-func (rw *PureResponseWriter) Fail() {
-	rw.success = false
+// Send part of the response to the requester right away, for large results.
+// The response sent when the handler returns is the last chunk, the only one
+// without More.
+func (rw *PureResponseWriter) Chunk(values map[string]interface{}) {
+
+	rw.chunks++
+
+	rw.connections[0].Send(PureMsg{
+		Action:         GetResponseAction(rw.msg.Action, true),
+		DataType:       rw.msg.DataType,
+		ResponseMap:    values,
+		TransactionMap: rw.msg.TransactionMap,
+		RequestId:      rw.msg.RequestId,
+		Chunk:          rw.chunks,
+		More:           true,
+		Version:        rw.msg.Version,
+	})
 }
 
-var ResponseAction = map[bool]map[string]string{
-	true: map[string]string{
-		"create":   "CREATED",
-		"delete":   "DELETED",
-		"update":   "UPDATED",
-		"retrieve": "RETRIEVED",
-		"flush":    "FLUSHED",
-	},
-	false: map[string]string{
-		"create":   "CREATE_FAIL",
-		"delete":   "DELETE_FAIL",
-		"update":   "UPDATE_FAIL",
-		"retrieve": "RETRIEVE_FAIL",
-		"flush":    "FLUSHED_FAIL",
-	},
+// The RequestId only means something to the requester
+func (rw *PureResponseWriter) msgFor(conn PureConnection) PureMsg {
+	msg := rw.GetMsg()
+	if len(rw.connections) > 0 && conn != rw.connections[0] {
+		msg.RequestId = ""
+	}
+	return msg
 }
 
-func GetResponseAction(requestAction string, success bool) string {
-	return ResponseAction[success][requestAction]
+func (rw *PureResponseWriter) AddValue(key string, value interface{}) {
+	rw.msg.ResponseMap[key] = value
 }
 
-type HttpHandler struct {
-	muxer PureMux
+func (rw *PureResponseWriter) Fail() {
+	rw.success = false
 }
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+// The request is not valid for the protocol and could not be handled
+func (rw *PureResponseWriter) ProtocolError(code string, message string) {
+	rw.success = false
+	rw.protocol = true
+	rw.msg.LogList = append(rw.msg.LogList, LogMessage{Level: Error, Code: code, Message: message})
 }
 
-func (handler HttpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		fmt.Fprintf(w, "Upgrade failed: %v", err)
-		return
-	}
-
-	// Create the PureConnection
-	// Every message from this conn will be handled here so no need to store it outside
-	pureConn := WebsocketConn{Conn: conn, Muxer: &handler.muxer}
-
-	for {
-
-		// We might want to add logging at sone point
-		// TODO
-
-		//  Discard message Type, if not text the unmarshaling will fail anyway
-		_, p, err := conn.ReadMessage()
-		if err != nil {
-			log.Printf("[WebSocket] Error Reading message: %v\n", err)
-			continue
-		}
-
-		msg := PureMsg{}
-
-		err = json.Unmarshal(p, &msg)
-
-		if err != nil {
-			log.Printf("[WebSocket] Error (%v) Unmarshalling message: %v\n", err, string(p))
-			continue
-		}
-
-		// Pass the request to the Pureconn that will transmit it to the Muxer
-		// The Muxer will then use the PureConn to send the response
-		pureConn.Handle(msg)
-	}
-
+// Fail and tell why
+func (rw *PureResponseWriter) FailWith(code string, message string) {
+	rw.success = false
+	rw.msg.LogList = append(rw.msg.LogList, LogMessage{Level: Error, Code: code, Message: message})
 }
 
-func WebsocketHandler(mux PureMux) (handler http.Handler) {
-	handler = HttpHandler{muxer: mux}
-	return
+// Fail because of the value of a field of the RequestMap, can be called for
+// several fields
+func (rw *PureResponseWriter) FieldError(field string, code string, message string) {
+	rw.success = false
+	rw.msg.LogList = append(rw.msg.LogList, LogMessage{Level: Error, Code: code, Field: field, Message: message})
 }
 
-// For now we will keep no state I thinkm but in the future we might wanna keep track of the progression
-// of the different transactions the Client has with the server
-type WebsocketConn struct {
-	Conn  *websocket.Conn
-	Muxer *PureMux
+func (rw *PureResponseWriter) Success() bool {
+	return rw.success
 }
 
-func (c *WebsocketConn) Send(msg PureMsg) {
-
-	// Serialization of the PureMsg
-	jsonMsg, err := json.Marshal(msg)
-	if err != nil {
-		log.Printf("Error serializing Websocket response %v", msg)
-	}
-
-	// Send using the websocket conn
-	c.Conn.WriteMessage(websocket.TextMessage, []byte(jsonMsg))
+var ResponseAction = map[bool]map[string]string{
+	true: map[string]string{
+		"create":       "CREATED",
+		"delete":       "DELETED",
+		"update":       "UPDATED",
+		"retrieve":     "RETRIEVED",
+		"flush":        "FLUSHED",
+		"batch":        "BATCHED",
+		"subscribe":    "SUBSCRIBED",
+		"unsubscribe":  "UNSUBSCRIBED",
+		"authenticate": "AUTHENTICATED",
+		"hello":        "HELLO",
+		"begin":        "BEGUN",
+		"commit":       "COMMITTED",
+		"rollback":     "ROLLED_BACK",
+	},
+	false: map[string]string{
+		"create":       "CREATE_FAIL",
+		"delete":       "DELETE_FAIL",
+		"update":       "UPDATE_FAIL",
+		"retrieve":     "RETRIEVE_FAIL",
+		"flush":        "FLUSHED_FAIL",
+		"batch":        "BATCH_FAIL",
+		"subscribe":    "SUBSCRIBE_FAIL",
+		"unsubscribe":  "UNSUBSCRIBE_FAIL",
+		"authenticate": "AUTHENTICATE_FAIL",
+		"hello":        "HELLO_FAIL",
+		"begin":        "BEGIN_FAIL",
+		"commit":       "COMMIT_FAIL",
+		"rollback":     "ROLLBACK_FAIL",
+	},
 }
 
-func (c *WebsocketConn) Handle(msg PureMsg) {
-	req := PureReq{Msg: msg, Conn: c}
-	c.Muxer.Handle(req)
+func GetResponseAction(requestAction string, success bool) string {
+	return ResponseAction[success][requestAction]
 }
@@ -1,15 +1,54 @@
 package pure_test
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"github.com/gorilla/websocket"
 	"github.com/th3osmith/greader/pure"
+	"github.com/th3osmith/greader/pure/saverstore"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type MyHandler struct {
 	data  map[string]interface{}
 	conns []pure.PureConnection
 	owner map[string]pure.PureConnection
+	mux   *pure.PureMux // Changes are published when set
+}
+
+func NewPureHandler() MyHandler {
+	return MyHandler{data: make(map[string]interface{}), owner: make(map[string]pure.PureConnection)}
+}
+
+func NewPushHandler(mux *pure.PureMux) MyHandler {
+	h := NewPureHandler()
+	h.mux = mux
+	return h
+}
+
+func (h MyHandler) publish(m pure.PureReq, id string) {
+	if h.mux != nil {
+		h.mux.Publish(m.Msg.DataType, m.Msg.Action, map[string]interface{}{"id": id, "value": h.data[id]})
+	}
 }
 
 func (h MyHandler) Create(m pure.PureReq, rw pure.ResponseWriter) {
@@ -17,24 +56,67 @@ func (h MyHandler) Create(m pure.PureReq, rw pure.ResponseWriter) {
 	fmt.Println("Create")
 	rww := rw.(*pure.PureResponseWriter)
 	msg := m.Msg
-	id := msg.RequestMap["id"].(string)
+	id, ok := msg.RequestMap["id"].(string)
+
+	if !ok {
+		rww.FieldError("id", pure.CodeInvalid, "id must be a string")
+		return
+	}
 
 	if _, ok := h.data[id]; ok {
-		rww.Fail()
+		rww.FailWith(pure.CodeConflict, "id already used")
 		return
 	}
 
 	h.data[id] = msg.RequestMap["value"]
 	h.owner[id] = m.Conn
+	h.publish(m, id)
 
 	return
 
 }
-func (h MyHandler) Update(m pure.PureReq) {
+func (h MyHandler) Update(m pure.PureReq, rw pure.ResponseWriter) {
+
+	fmt.Println("Update")
+	rww := rw.(*pure.PureResponseWriter)
+	id := m.Msg.RequestMap["id"].(string)
+
+	if _, ok := h.data[id]; !ok {
+		rww.FailWith(pure.CodeNotFound, "Unknown id")
+		return
+	}
+
+	h.data[id] = m.Msg.RequestMap["value"]
+	rww.AddValue("data", h.data[id])
+	h.publish(m, id)
+
+	// The Owner is told about the modification
+	if owner, ok := h.owner[id]; ok {
+		rw.AddConn(owner)
+	}
+
 	return
 
 }
-func (h MyHandler) Delete(m pure.PureReq) {
+func (h MyHandler) Delete(m pure.PureReq, rw pure.ResponseWriter) {
+
+	fmt.Println("Delete")
+	rww := rw.(*pure.PureResponseWriter)
+	id := m.Msg.RequestMap["id"].(string)
+
+	if _, ok := h.data[id]; !ok {
+		rww.FailWith(pure.CodeNotFound, "Unknown id")
+		return
+	}
+
+	if owner, ok := h.owner[id]; ok {
+		rw.AddConn(owner)
+	}
+
+	h.publish(m, id)
+	delete(h.data, id)
+	delete(h.owner, id)
+
 	return
 
 }
@@ -65,7 +147,17 @@ func (h MyHandler) Retrieve(m pure.PureReq, rw pure.ResponseWriter) {
 	return
 
 }
-func (h MyHandler) Flush(m pure.PureReq) {
+func (h MyHandler) Flush(m pure.PureReq, rw pure.ResponseWriter) {
+
+	fmt.Println("Flush")
+	rww := rw.(*pure.PureResponseWriter)
+	rww.AddValue("flushed", len(h.data))
+
+	for id := range h.data {
+		delete(h.data, id)
+		delete(h.owner, id)
+	}
+
 	return
 
 }
@@ -110,3 +202,3136 @@ func TestPureMux(t *testing.T) {
 	}
 
 }
+
+// Handler writing in a transaction when there is one
+type TxHandler struct {
+	MyHandler
+	rollbacks  int
+	failCommit bool
+}
+
+type memTx struct {
+	handler *TxHandler
+	pending map[string]interface{}
+}
+
+func (tx *memTx) Commit() error {
+	if tx.handler.failCommit {
+		return errors.New("Disk full")
+	}
+	for id, value := range tx.pending {
+		tx.handler.data[id] = value
+	}
+	return nil
+}
+
+func (tx *memTx) Rollback() error {
+	tx.handler.rollbacks++
+	return nil
+}
+
+func (h *TxHandler) Begin(m pure.PureReq) (pure.Transaction, error) {
+	return &memTx{handler: h, pending: make(map[string]interface{})}, nil
+}
+
+func (h *TxHandler) Create(m pure.PureReq, rw pure.ResponseWriter) {
+
+	if m.Tx == nil {
+		h.MyHandler.Create(m, rw)
+		return
+	}
+
+	tx := m.Tx.(*memTx)
+	id := m.Msg.RequestMap["id"].(string)
+
+	_, inData := h.data[id]
+	_, inTx := tx.pending[id]
+
+	if inData || inTx {
+		rw.(*pure.PureResponseWriter).Fail()
+		return
+	}
+
+	tx.pending[id] = m.Msg.RequestMap["value"]
+
+}
+
+func createMsg(dataType string, id string, value string) pure.PureMsg {
+	return pure.PureMsg{DataType: dataType, Action: "create", RequestMap: map[string]interface{}{"id": id, "value": value}}
+}
+
+func TestBatch(t *testing.T) {
+
+	mux := pure.NewPureMux()
+	h := NewPureHandler()
+	mux.RegisterHandler("data", h)
+
+	c1 := pure.GoConn{Response: make(chan pure.PureMsg, 1), Muxer: mux}
+
+	batch := pure.PureMsg{Action: "batch", Batch: []pure.PureMsg{
+		createMsg("data", "a", "1"),
+		createMsg("data", "a", "2"),
+		createMsg("unknown", "b", "3"),
+		createMsg("data", "c", "4"),
+	}}
+
+	c1.SendReq(batch)
+	resp := c1.ReadResp()
+
+	if resp.Action != "BATCH_FAIL" || len(resp.Batch) != 4 {
+		t.Fatal("Batch badly answered", resp)
+	}
+
+	control := []string{"CREATED", "CREATE_FAIL", "ERROR", "CREATED"}
+	for idx, el := range control {
+		if resp.Batch[idx].Action != el {
+			t.Error("Wrong operation status", idx, resp.Batch[idx])
+		}
+	}
+
+	if h.data["a"] != "1" || h.data["c"] != "4" {
+		t.Error("Operations not applied", h.data)
+	}
+
+	batch = pure.PureMsg{Action: "batch", Batch: []pure.PureMsg{createMsg("data", "d", "5")}}
+	c1.SendReq(batch)
+	resp = c1.ReadResp()
+
+	if resp.Action != "BATCHED" || resp.Batch[0].Action != "CREATED" {
+		t.Error("Successful batch badly answered", resp)
+	}
+
+}
+
+func TestAtomicBatch(t *testing.T) {
+
+	mux := pure.NewPureMux()
+	h := &TxHandler{MyHandler: NewPureHandler()}
+	mux.RegisterHandler("tx", h)
+	mux.RegisterHandler("data", NewPureHandler())
+
+	c1 := pure.GoConn{Response: make(chan pure.PureMsg, 1), Muxer: mux}
+
+	atomic := map[string]interface{}{"atomic": true}
+
+	// The second operation fails, nothing is applied
+	c1.SendReq(pure.PureMsg{Action: "batch", RequestMap: atomic, Batch: []pure.PureMsg{
+		createMsg("tx", "a", "1"),
+		createMsg("tx", "a", "2"),
+		createMsg("tx", "b", "3"),
+	}})
+	resp := c1.ReadResp()
+
+	if resp.Action != "BATCH_FAIL" || len(resp.Batch) != 3 {
+		t.Fatal("Atomic batch badly answered", resp)
+	}
+
+	for idx, op := range resp.Batch {
+		if op.Action != "CREATE_FAIL" {
+			t.Error("Rolled back operation reported as successful", idx, op)
+		}
+	}
+
+	if len(h.data) != 0 || h.rollbacks != 1 {
+		t.Error("Transaction not rolled back", h.data, h.rollbacks)
+	}
+
+	c1.SendReq(pure.PureMsg{Action: "batch", RequestMap: atomic, Batch: []pure.PureMsg{
+		createMsg("tx", "a", "1"),
+		createMsg("tx", "b", "2"),
+	}})
+	resp = c1.ReadResp()
+
+	if resp.Action != "BATCHED" || h.data["a"] != "1" || h.data["b"] != "2" {
+		t.Error("Transaction not committed", resp, h.data)
+	}
+
+	// Handlers without transactions can not take part in atomic batches
+	c1.SendReq(pure.PureMsg{Action: "batch", RequestMap: atomic, Batch: []pure.PureMsg{
+		createMsg("tx", "c", "1"),
+		createMsg("data", "c", "2"),
+	}})
+	resp = c1.ReadResp()
+
+	if resp.Action != "BATCH_FAIL" || h.data["c"] != nil || h.rollbacks != 2 {
+		t.Error("Non transactional handler accepted in atomic batch", resp, h.data)
+	}
+
+	c1.SendReq(pure.PureMsg{Action: "batch", RequestMap: atomic, Batch: []pure.PureMsg{
+		createMsg("tx", "c", "1"),
+		createMsg("nothing", "c", "2"),
+	}})
+	resp = c1.ReadResp()
+
+	if resp.Action != "BATCH_FAIL" || h.data["c"] != nil || len(resp.Batch) != 2 || resp.Batch[1].ErrorCode() != pure.CodeUnknownDataType {
+		t.Error("Wrong error for an unknown DataType in atomic batch", resp, h.data)
+	}
+
+	// Commits are per DataType, the ones before a failed commit stay
+	broken := &TxHandler{MyHandler: NewPureHandler(), failCommit: true}
+	mux.RegisterHandler("broken", broken)
+
+	c1.SendReq(pure.PureMsg{Action: "batch", RequestMap: atomic, Batch: []pure.PureMsg{
+		createMsg("tx", "d", "1"),
+		createMsg("broken", "d", "2"),
+		createMsg("tx", "e", "3"),
+	}})
+	resp = c1.ReadResp()
+
+	if resp.Action != "BATCH_FAIL" || resp.ErrorCode() != pure.CodePartialCommit || !reflect.DeepEqual(resp.ResponseMap["committed"], []string{"tx"}) {
+		t.Error("Partial commit reported as a rollback", resp)
+	}
+
+	if resp.Batch[0].Action != "CREATED" || resp.Batch[1].ErrorCode() != pure.CodeRolledBack || resp.Batch[2].Action != "CREATED" {
+		t.Error("Wrong operations of a partial commit", resp.Batch)
+	}
+
+	if h.data["d"] != "1" || h.data["e"] != "3" || broken.data["d"] != nil {
+		t.Error("Wrong data after a partial commit", h.data, broken.data)
+	}
+
+}
+
+func inTx(msg pure.PureMsg, id string) pure.PureMsg {
+	msg.TransactionMap = map[string]string{pure.TransactionKey: id}
+	return msg
+}
+
+func TestTransactions(t *testing.T) {
+
+	mux := pure.NewPureMux()
+	h := &TxHandler{MyHandler: NewPureHandler()}
+	mux.RegisterHandler("tx", h)
+	mux.RegisterHandler("data", NewPureHandler())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	owner := pure.NewLocalClient(mux)
+	defer owner.Close()
+	client := pure.NewLocalClient(mux)
+	defer client.Close()
+	other := pure.NewLocalClient(mux)
+	defer other.Close()
+
+	if resp, err := owner.Call(ctx, createMsg("tx", "a", "1")); err != nil || resp.Action != "CREATED" {
+		t.Fatal("Create failed", resp, err)
+	}
+
+	begin := func(c *pure.Client) string {
+		resp, err := c.Call(ctx, pure.PureMsg{Action: pure.BeginAction})
+		if err != nil || resp.Action != "BEGUN" || resp.TransactionMap[pure.TransactionKey] == "" {
+			t.Fatal("Begin failed", resp, err)
+		}
+		return resp.TransactionMap[pure.TransactionKey]
+	}
+
+	id := begin(client)
+
+	for _, test := range []struct {
+		name   string
+		client *pure.Client
+		msg    pure.PureMsg
+		action string
+		code   string
+	}{
+		{"Create", client, inTx(createMsg("tx", "b", "2"), id), "CREATED", ""},
+		{"Retrieve", client, inTx(pure.PureMsg{DataType: "tx", Action: "retrieve", RequestMap: map[string]interface{}{"id": "a"}}, id), "RETRIEVED", ""},
+		// The transaction goes on after a failure
+		{"Not transactional", client, inTx(createMsg("data", "b", "2"), id), "CREATE_FAIL", pure.CodeNoTransaction},
+		{"Other connection", other, inTx(createMsg("tx", "c", "2"), id), "CREATE_FAIL", pure.CodeNoTransaction},
+		{"Unknown", client, inTx(createMsg("tx", "c", "2"), "nope"), "CREATE_FAIL", pure.CodeNoTransaction},
+		{"Batch", client, inTx(pure.PureMsg{Action: "batch", RequestMap: map[string]interface{}{"atomic": true}, Batch: []pure.PureMsg{createMsg("tx", "c", "3")}}, id), "BATCHED", ""},
+	} {
+		resp, err := test.client.Call(ctx, test.msg)
+		if err != nil || resp.Action != test.action || resp.ErrorCode() != test.code {
+			t.Error(test.name, "Wrong response", resp, err)
+		}
+	}
+
+	// Nothing is applied nor told to the owner before the commit
+	if h.data["b"] != nil || h.data["c"] != nil {
+		t.Error("Operations applied before the commit", h.data)
+	}
+
+	select {
+	case push := <-owner.Pushes():
+		t.Error("Owner told before the commit", push)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	resp, err := client.Call(ctx, inTx(pure.PureMsg{Action: pure.CommitAction}, id))
+	if err != nil || resp.Action != "COMMITTED" || h.data["b"] != "2" || h.data["c"] != "3" {
+		t.Error("Transaction not committed", resp, err, h.data)
+	}
+
+	if push := waitPush(t, owner, "RETRIEVED"); push.ResponseMap["data"] != "1" {
+		t.Error("Wrong message held until the commit", push)
+	}
+
+	resp, err = client.Call(ctx, inTx(pure.PureMsg{Action: pure.CommitAction}, id))
+	if err != nil || resp.Action != "COMMIT_FAIL" || resp.ErrorCode() != pure.CodeNoTransaction {
+		t.Error("Transaction committed twice", resp, err)
+	}
+
+	// Rollback
+	id = begin(client)
+	client.Call(ctx, inTx(createMsg("tx", "d", "4"), id))
+
+	resp, err = client.Call(ctx, inTx(pure.PureMsg{Action: pure.RollbackAction}, id))
+	if err != nil || resp.Action != "ROLLED_BACK" || h.data["d"] != nil || h.rollbacks != 1 {
+		t.Error("Transaction not rolled back", resp, err, h.data, h.rollbacks)
+	}
+
+	// Connection closed
+	leaving := pure.NewLocalClient(mux)
+	id = begin(leaving)
+	leaving.Call(ctx, inTx(createMsg("tx", "e", "5"), id))
+	leaving.Close()
+
+	if h.data["e"] != nil || h.rollbacks != 2 {
+		t.Error("Transaction of a closed connection not rolled back", h.data, h.rollbacks)
+	}
+
+	// Timeout
+	mux.SetTransactionTimeout(50 * time.Millisecond)
+	id = begin(client)
+	client.Call(ctx, inTx(createMsg("tx", "f", "6"), id))
+
+	if push := waitPush(t, client, pure.ProtocolErrorAction); push.ErrorCode() != pure.CodeRolledBack || push.TransactionMap[pure.TransactionKey] != id {
+		t.Error("Wrong timeout message", push)
+	}
+
+	if h.data["f"] != nil || h.rollbacks != 3 {
+		t.Error("Transaction not rolled back on timeout", h.data, h.rollbacks)
+	}
+
+	resp, err = client.Call(ctx, inTx(createMsg("tx", "f", "6"), id))
+	if err != nil || resp.ErrorCode() != pure.CodeNoTransaction {
+		t.Error("Timed out transaction still open", resp, err)
+	}
+
+	// Commits are per DataType, the ones before a failed commit stay
+	mux.SetTransactionTimeout(0)
+	broken := &TxHandler{MyHandler: NewPureHandler(), failCommit: true}
+	mux.RegisterHandler("broken", broken)
+
+	id = begin(client)
+	client.Call(ctx, inTx(createMsg("tx", "g", "7"), id))
+	client.Call(ctx, inTx(createMsg("broken", "g", "8"), id))
+
+	resp, err = client.Call(ctx, inTx(pure.PureMsg{Action: pure.CommitAction}, id))
+	if err != nil || resp.Action != "COMMIT_FAIL" || resp.ErrorCode() != pure.CodePartialCommit || !reflect.DeepEqual(resp.ResponseMap["committed"], []string{"tx"}) {
+		t.Error("Partial commit reported as a rollback", resp, err)
+	}
+
+	if h.data["g"] != "7" || broken.data["g"] != nil {
+		t.Error("Wrong data after a partial commit", h.data, broken.data)
+	}
+
+	// Open transactions of a connection
+	mux.SetMaxTransactions(2)
+	first := begin(other)
+	begin(other)
+
+	if resp, err := other.Call(ctx, pure.PureMsg{Action: pure.BeginAction}); err != nil || resp.Action != "BEGIN_FAIL" || resp.ErrorCode() != pure.CodeRateLimited {
+		t.Error("Too many transactions opened", resp, err)
+	}
+
+	begin(client)
+	other.Call(ctx, inTx(pure.PureMsg{Action: pure.RollbackAction}, first))
+	begin(other)
+}
+
+// Send a request and wait for its response
+type roundTrip func(pure.PureMsg) pure.PureMsg
+
+func testVerbs(t *testing.T, name string, do roundTrip) {
+
+	mm := map[string]interface{}{"id": "tata", "value": "yoyo"}
+
+	steps := []struct {
+		action string
+		value  string
+		status string
+		data   interface{}
+	}{
+		{"create", "yoyo", "CREATED", nil},
+		{"retrieve", "", "RETRIEVED", "yoyo"},
+		{"update", "toto", "UPDATED", "toto"},
+		{"retrieve", "", "RETRIEVED", "toto"},
+		{"delete", "", "DELETED", nil},
+		{"retrieve", "", "RETRIEVE_FAIL", nil},
+		{"update", "toto", "UPDATE_FAIL", nil},
+		{"delete", "", "DELETE_FAIL", nil},
+		{"create", "yoyo", "CREATED", nil},
+		{"flush", "", "FLUSHED", nil},
+		{"retrieve", "", "RETRIEVE_FAIL", nil},
+		{"destroy", "", "ERROR", nil},
+	}
+
+	for idx, step := range steps {
+		mm["value"] = step.value
+		resp := do(pure.PureMsg{DataType: "data", Action: step.action, RequestMap: mm})
+
+		if resp.Action != step.status {
+			t.Error(name, "Wrong status", idx, step.action, resp)
+		}
+
+		if step.data != nil && resp.ResponseMap["data"] != step.data {
+			t.Error(name, "Wrong data", idx, step.action, resp)
+		}
+	}
+
+}
+
+func TestVerbsGoConn(t *testing.T) {
+
+	mux := pure.NewPureMux()
+	mux.RegisterHandler("data", NewPureHandler())
+
+	c1 := pure.GoConn{Response: make(chan pure.PureMsg, 1), Muxer: mux}
+
+	testVerbs(t, "GoConn", func(msg pure.PureMsg) pure.PureMsg {
+		c1.SendReq(msg)
+		return c1.ReadResp()
+	})
+
+}
+
+func TestVerbsWebsocketConn(t *testing.T) {
+
+	mux := pure.NewPureMux()
+	mux.RegisterHandler("data", NewPureHandler())
+
+	server := httptest.NewServer(pure.WebsocketHandler(mux))
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	defer ws.Close()
+
+	testVerbs(t, "WebsocketConn", func(msg pure.PureMsg) pure.PureMsg {
+		resp := pure.PureMsg{}
+		if err := ws.WriteJSON(msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := ws.ReadJSON(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	})
+
+}
+
+func TestErrors(t *testing.T) {
+
+	mux := pure.NewPureMux()
+	mux.RegisterHandler("data", NewPureHandler())
+
+	c1 := pure.GoConn{Response: make(chan pure.PureMsg, 1), Muxer: mux}
+
+	c1.SendReq(createMsg("data", "a", "1"))
+	c1.ReadResp()
+
+	c1.SendReq(createMsg("data", "a", "1"))
+	resp := c1.ReadResp()
+
+	if resp.Action != "CREATE_FAIL" || resp.ErrorCode() != pure.CodeConflict {
+		t.Error("Failure reason not transmitted", resp)
+	}
+
+	c1.SendReq(pure.PureMsg{DataType: "data", Action: "create", RequestMap: map[string]interface{}{"id": 42}})
+	resp = c1.ReadResp()
+
+	if field, ok := resp.FieldErrors()["id"]; !ok || field.Code != pure.CodeInvalid {
+		t.Error("Field error not transmitted", resp)
+	}
+
+	c1.SendReq(createMsg("nothing", "a", "1"))
+	resp = c1.ReadResp()
+
+	if resp.Action != pure.ProtocolErrorAction || resp.ErrorCode() != pure.CodeUnknownDataType {
+		t.Error("Unknown DataType badly answered", resp)
+	}
+
+	// The handler panics on the type assertion of the id
+	c1.SendReq(pure.PureMsg{DataType: "data", Action: "retrieve", RequestMap: map[string]interface{}{}})
+	resp = c1.ReadResp()
+
+	if resp.Action != pure.ProtocolErrorAction || resp.ErrorCode() != pure.CodeInternal {
+		t.Error("Handler panic badly answered", resp)
+	}
+
+	// The mux is still working
+	c1.SendReq(pure.PureMsg{DataType: "data", Action: "retrieve", RequestMap: map[string]interface{}{"id": "a"}})
+	resp = c1.ReadResp()
+
+	if resp.Action != "RETRIEVED" {
+		t.Error("Mux broken after a panic", resp)
+	}
+
+}
+
+func TestMalformedMessage(t *testing.T) {
+
+	mux := pure.NewPureMux()
+	mux.RegisterHandler("data", NewPureHandler())
+
+	server := httptest.NewServer(pure.WebsocketHandler(mux))
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	defer ws.Close()
+
+	ws.WriteMessage(websocket.TextMessage, []byte("{\"Action\": 42"))
+
+	resp := pure.PureMsg{}
+	if err := ws.ReadJSON(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Action != pure.ProtocolErrorAction || resp.ErrorCode() != pure.CodeMalformed {
+		t.Error("Malformed message badly answered", resp)
+	}
+
+}
+
+func TestSubscriptions(t *testing.T) {
+
+	mux := pure.NewPureMux()
+	mux.RegisterHandler("data", NewPushHandler(mux))
+
+	c1 := pure.GoConn{Response: make(chan pure.PureMsg, 1), Muxer: mux}
+	c2 := pure.GoConn{Response: make(chan pure.PureMsg, 1), Muxer: mux}
+
+	c2.SendReq(pure.PureMsg{DataType: "data", Action: "subscribe", RequestMap: map[string]interface{}{"id": "tata"}})
+	resp := c2.ReadResp()
+
+	subId, ok := resp.ResponseMap["subscription"].(string)
+	if resp.Action != "SUBSCRIBED" || !ok {
+		t.Fatal("Subscription failed", resp)
+	}
+
+	c1.SendReq(createMsg("data", "tata", "yoyo"))
+	c1.ReadResp()
+
+	push := c2.ReadResp()
+	if push.Action != pure.PushAction || push.Event != "create" || push.ResponseMap["value"] != "yoyo" {
+		t.Error("Change not pushed", push)
+	}
+
+	// Filtered out
+	c1.SendReq(createMsg("data", "toto", "yoyo"))
+	c1.ReadResp()
+
+	select {
+	case push = <-c2.Response:
+		t.Error("Filter not applied", push)
+	default:
+	}
+
+	// Only the owner of a subscription can cancel it
+	c1.SendReq(pure.PureMsg{DataType: "data", Action: "unsubscribe", RequestMap: map[string]interface{}{"subscription": subId}})
+	if resp = c1.ReadResp(); resp.Action != "UNSUBSCRIBE_FAIL" {
+		t.Error("Subscription of another connection cancelled", resp)
+	}
+
+	c2.SendReq(pure.PureMsg{DataType: "data", Action: "unsubscribe", RequestMap: map[string]interface{}{"subscription": subId}})
+	if resp = c2.ReadResp(); resp.Action != "UNSUBSCRIBED" {
+		t.Error("Unsubscription failed", resp)
+	}
+
+	c1.SendReq(pure.PureMsg{DataType: "data", Action: "update", RequestMap: map[string]interface{}{"id": "tata", "value": "titi"}})
+	c1.ReadResp()
+
+	select {
+	case push = <-c2.Response:
+		t.Error("Change pushed after unsubscription", push)
+	default:
+	}
+
+	// Subscriptions are removed with the connection
+	c2.SendReq(pure.PureMsg{DataType: "data", Action: "subscribe", RequestMap: map[string]interface{}{}})
+	c2.ReadResp()
+	c2.Close()
+
+	mux.Publish("data", "update", map[string]interface{}{"id": "tata"})
+
+	select {
+	case push = <-c2.Response:
+		t.Error("Change pushed to a closed connection", push)
+	default:
+	}
+
+	c1.SendReq(pure.PureMsg{DataType: "nothing", Action: "subscribe"})
+	if resp = c1.ReadResp(); resp.ErrorCode() != pure.CodeUnknownDataType {
+		t.Error("Subscription to unknown DataType accepted", resp)
+	}
+
+}
+
+// Handler following the connections
+type LifecycleHandler struct {
+	MyHandler
+	connected    chan pure.PureConnection
+	disconnected chan pure.PureConnection
+}
+
+func NewLifecycleHandler() LifecycleHandler {
+	return LifecycleHandler{NewPureHandler(), make(chan pure.PureConnection, 10), make(chan pure.PureConnection, 10)}
+}
+
+func (h LifecycleHandler) OnConnect(conn pure.PureConnection) {
+	h.connected <- conn
+}
+
+func (h LifecycleHandler) OnDisconnect(conn pure.PureConnection) {
+	h.disconnected <- conn
+}
+
+func dial(t *testing.T, server *httptest.Server) *websocket.Conn {
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	return ws
+}
+
+func waitConn(t *testing.T, c chan pure.PureConnection, what string) pure.PureConnection {
+	select {
+	case conn := <-c:
+		return conn
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for", what)
+	}
+	return nil
+}
+
+func TestWebsocketLifecycle(t *testing.T) {
+
+	mux := pure.NewPureMux()
+	h := NewLifecycleHandler()
+	mux.RegisterHandler("data", h)
+
+	handler := pure.NewWebsocketHandler(mux, pure.DefaultWebsocketOptions())
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ws := dial(t, server)
+	conn := waitConn(t, h.connected, "connection")
+
+	if conns := handler.Conns(); len(conns) != 1 || conns[0] != conn {
+		t.Error("Connection not registered", conns)
+	}
+
+	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	ws.Close()
+
+	if waitConn(t, h.disconnected, "disconnection") != conn {
+		t.Error("Wrong connection disconnected")
+	}
+
+	if conns := handler.Conns(); len(conns) != 0 {
+		t.Error("Connection still registered", conns)
+	}
+
+}
+
+func TestWebsocketKeepalive(t *testing.T) {
+
+	mux := pure.NewPureMux()
+	h := NewLifecycleHandler()
+	mux.RegisterHandler("data", h)
+
+	options := pure.WebsocketOptions{PingInterval: 20 * time.Millisecond, PongTimeout: 100 * time.Millisecond, WriteTimeout: time.Second}
+	server := httptest.NewServer(pure.NewWebsocketHandler(mux, options))
+	defer server.Close()
+
+	// Pings are answered while reading
+	alive := dial(t, server)
+	defer alive.Close()
+	aliveConn := waitConn(t, h.connected, "connection")
+
+	go func() {
+		for {
+			if _, _, err := alive.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Pings are never answered
+	dead := dial(t, server)
+	defer dead.Close()
+	deadConn := waitConn(t, h.connected, "connection")
+
+	if waitConn(t, h.disconnected, "timeout") != deadConn {
+		t.Error("Wrong connection timed out")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	select {
+	case conn := <-h.disconnected:
+		t.Error("Live connection closed", conn == aliveConn)
+	default:
+	}
+
+}
+
+func TestWebsocketShutdown(t *testing.T) {
+
+	mux := pure.NewPureMux()
+	h := NewLifecycleHandler()
+	mux.RegisterHandler("data", h)
+
+	handler := pure.NewWebsocketHandler(mux, pure.DefaultWebsocketOptions())
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	closeCodes := make(chan int, 2)
+
+	for i := 0; i < 2; i++ {
+		ws := dial(t, server)
+		waitConn(t, h.connected, "connection")
+
+		go func() {
+			defer ws.Close()
+			for {
+				_, _, err := ws.ReadMessage()
+				if err != nil {
+					if closeErr, ok := err.(*websocket.CloseError); ok {
+						closeCodes <- closeErr.Code
+					} else {
+						closeCodes <- -1
+					}
+					return
+				}
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := handler.Shutdown(ctx); err != nil {
+		t.Error("Shutdown not graceful", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := <-closeCodes; code != websocket.CloseGoingAway {
+			t.Error("Close frame not received", code)
+		}
+	}
+
+	if len(handler.Conns()) != 0 {
+		t.Error("Connections left after shutdown")
+	}
+
+	// New connections are refused
+	ws := dial(t, server)
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Error("Connection accepted after shutdown", err)
+	}
+
+}
+
+func TestConcurrentPushes(t *testing.T) {
+
+	mux := pure.NewPureMux()
+	h := NewLifecycleHandler()
+	mux.RegisterHandler("data", h)
+
+	options := pure.DefaultWebsocketOptions()
+	options.QueueSize = 4
+	server := httptest.NewServer(pure.NewWebsocketHandler(mux, options))
+	defer server.Close()
+
+	ws := dial(t, server)
+	defer ws.Close()
+	conn := waitConn(t, h.connected, "connection")
+
+	pushers, pushes := 50, 20
+
+	var wg sync.WaitGroup
+	for i := 0; i < pushers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < pushes; j++ {
+				conn.Send(pure.PureMsg{Action: pure.PushAction, DataType: "data", ResponseMap: map[string]interface{}{"pusher": i, "n": j}})
+			}
+		}(i)
+	}
+
+	// Every message arrives whole, in order for each pusher
+	last := make(map[float64]float64)
+	for i := 0; i < pushers*pushes; i++ {
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		msg := pure.PureMsg{}
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatal("Error reading push", i, err)
+		}
+
+		pusher, n := msg.ResponseMap["pusher"].(float64), msg.ResponseMap["n"].(float64)
+		if prev, ok := last[pusher]; ok && n != prev+1 {
+			t.Error("Push out of order", pusher, prev, n)
+		}
+		last[pusher] = n
+	}
+
+	wg.Wait()
+
+}
+
+// Messages large enough to fill the socket buffers quickly
+func bigMsg() pure.PureMsg {
+	return pure.PureMsg{Action: pure.PushAction, DataType: "data", ResponseMap: map[string]interface{}{"payload": strings.Repeat("x", 64<<10)}}
+}
+
+func TestBackpressureDrop(t *testing.T) {
+
+	mux := pure.NewPureMux()
+	h := NewLifecycleHandler()
+	mux.RegisterHandler("data", h)
+
+	options := pure.DefaultWebsocketOptions()
+	options.QueueSize = 1
+	options.Backpressure = pure.Drop
+	server := httptest.NewServer(pure.NewWebsocketHandler(mux, options))
+	defer server.Close()
+
+	// Never reads
+	ws := dial(t, server)
+	defer ws.Close()
+	conn := waitConn(t, h.connected, "connection")
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			conn.Send(bigMsg())
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Send blocked by a slow client")
+	}
+
+	select {
+	case <-h.disconnected:
+		t.Error("Slow client disconnected")
+	default:
+	}
+
+}
+
+func TestBackpressureDisconnect(t *testing.T) {
+
+	mux := pure.NewPureMux()
+	h := NewLifecycleHandler()
+	mux.RegisterHandler("data", h)
+
+	options := pure.DefaultWebsocketOptions()
+	options.QueueSize = 1
+	options.Backpressure = pure.Disconnect
+	server := httptest.NewServer(pure.NewWebsocketHandler(mux, options))
+	defer server.Close()
+
+	// Never reads
+	ws := dial(t, server)
+	defer ws.Close()
+	conn := waitConn(t, h.connected, "connection")
+
+	go func() {
+		for i := 0; i < 1000; i++ {
+			conn.Send(bigMsg())
+		}
+	}()
+
+	if waitConn(t, h.disconnected, "disconnection") != conn {
+		t.Error("Wrong connection disconnected")
+	}
+
+}
+
+// Handler answering retrieve requests with their RequestMap
+type EchoHandler struct {
+	MyHandler
+}
+
+func (h EchoHandler) Retrieve(m pure.PureReq, rw pure.ResponseWriter) {
+	rww := rw.(*pure.PureResponseWriter)
+	for key, value := range m.Msg.RequestMap {
+		rww.AddValue(key, value)
+	}
+}
+
+func testClient(t *testing.T, name string, client *pure.Client, other *pure.Client) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Responses are matched to their request
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := client.Call(ctx, pure.PureMsg{DataType: "echo", Action: "retrieve", RequestMap: map[string]interface{}{"n": float64(i)}})
+			if err != nil {
+				t.Error(name, "Call failed", err)
+				return
+			}
+			if resp.Action != "RETRIEVED" || resp.ResponseMap["n"] != float64(i) || resp.RequestId == "" {
+				t.Error(name, "Wrong response", i, resp)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Errors are responses
+	resp, err := client.Call(ctx, pure.PureMsg{DataType: "nope", Action: "retrieve", RequestId: "mine"})
+	if err != nil || resp.ErrorCode() != pure.CodeUnknownDataType || resp.RequestId != "mine" {
+		t.Error(name, "Wrong error response", resp, err)
+	}
+
+	// Pushes are delivered apart
+	resp, err = other.Call(ctx, pure.PureMsg{DataType: "data", Action: "subscribe", RequestMap: map[string]interface{}{}})
+	if err != nil || resp.Action != "SUBSCRIBED" {
+		t.Fatal(name, "Subscription failed", resp, err)
+	}
+
+	resp, err = client.Call(ctx, createMsg("data", "tata", "yoyo"))
+	if err != nil || resp.Action != "CREATED" {
+		t.Error(name, "Create failed", resp, err)
+	}
+
+	select {
+	case push := <-other.Pushes():
+		if push.Action != pure.PushAction || push.RequestId != "" || push.ResponseMap["value"] != "yoyo" {
+			t.Error(name, "Wrong push", push)
+		}
+	case <-ctx.Done():
+		t.Error(name, "Push not received")
+	}
+
+	// The other client does not get the RequestId of the owner
+	resp, err = other.Call(ctx, pure.PureMsg{DataType: "data", Action: "update", RequestId: "update", RequestMap: map[string]interface{}{"id": "tata", "value": "titi"}})
+	if err != nil || resp.Action != "UPDATED" {
+		t.Error(name, "Update failed", resp, err)
+	}
+
+	select {
+	case push := <-client.Pushes():
+		if push.Action != "UPDATED" || push.RequestId != "" {
+			t.Error(name, "RequestId sent to another connection", push)
+		}
+	case <-ctx.Done():
+		t.Error(name, "Update not received by the owner")
+	}
+
+	cancelled, cancelCall := context.WithCancel(ctx)
+	cancelCall()
+	if _, err := client.Call(cancelled, createMsg("data", "toto", "yoyo")); err != context.Canceled {
+		t.Error(name, "Call not cancelled", err)
+	}
+
+	client.Close()
+
+	if _, err := client.Call(ctx, createMsg("data", "titi", "yoyo")); err != pure.ErrClientClosed {
+		t.Error(name, "Call on a closed client", err)
+	}
+
+	if _, ok := <-client.Pushes(); ok {
+		t.Error(name, "Pushes not closed")
+	}
+
+}
+
+func newClientMux() *pure.PureMux {
+	mux := pure.NewPureMux()
+	mux.RegisterHandler("data", NewPushHandler(mux))
+	mux.RegisterHandler("echo", EchoHandler{NewPureHandler()})
+	return mux
+}
+
+func TestLocalClient(t *testing.T) {
+
+	mux := newClientMux()
+
+	other := pure.NewLocalClient(mux)
+	defer other.Close()
+
+	testClient(t, "Local", pure.NewLocalClient(mux), other)
+
+}
+
+func TestWebsocketClient(t *testing.T) {
+
+	server := httptest.NewServer(pure.WebsocketHandler(newClientMux()))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	client, err := pure.Dial(context.Background(), url, nil)
+	if err != nil {
+		t.Fatal("Dial failed", err)
+	}
+
+	other, err := pure.Dial(context.Background(), url, nil)
+	if err != nil {
+		t.Fatal("Dial failed", err)
+	}
+	defer other.Close()
+
+	testClient(t, "Websocket", client, other)
+
+}
+
+// Handler answering retrieve requests with the name of the user
+type IdentityHandler struct {
+	MyHandler
+}
+
+func (h IdentityHandler) Retrieve(m pure.PureReq, rw pure.ResponseWriter) {
+	rww := rw.(*pure.PureResponseWriter)
+	if m.Identity == nil {
+		rww.FailWith(pure.CodeUnauthenticated, "Anonymous")
+		return
+	}
+	rww.AddValue("user", m.Identity.Name)
+	rww.AddValue("admin", m.Identity.HasRole("admin"))
+}
+
+func TestAuthentication(t *testing.T) {
+
+	mux := pure.NewPureMux()
+	mux.RegisterHandler("me", IdentityHandler{NewPureHandler()})
+
+	options := pure.DefaultWebsocketOptions()
+	options.Auth = []pure.Authenticator{
+		pure.SingleUser("tata", "yoyo", "admin"),
+		pure.CookieAuthenticator{Name: "session", Lookup: func(value string) *pure.Identity {
+			if value == "s3ss10n" {
+				return &pure.Identity{Name: "toto"}
+			}
+			return nil
+		}},
+	}
+	options.Token = func(token string) *pure.Identity {
+		if token == "t0k3n" {
+			return &pure.Identity{Name: "titi"}
+		}
+		return nil
+	}
+
+	server := httptest.NewServer(pure.NewWebsocketHandler(mux, options))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	whoami := func(client *pure.Client) pure.PureMsg {
+		resp, err := client.Call(ctx, pure.PureMsg{DataType: "me", Action: "retrieve"})
+		if err != nil {
+			t.Error("Call failed", err)
+		}
+		return resp
+	}
+
+	basic := http.Header{}
+	basic.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("tata:yoyo")))
+
+	cookie := http.Header{}
+	cookie.Set("Cookie", "session=s3ss10n")
+
+	for _, test := range []struct {
+		name   string
+		header http.Header
+		token  string
+		user   string
+	}{
+		{"Basic", basic, "", "tata"},
+		{"Cookie", cookie, "", "toto"},
+		{"Token", nil, "t0k3n", "titi"},
+	} {
+		client, err := pure.Dial(ctx, url, test.header)
+		if err != nil {
+			t.Fatal(test.name, "Dial failed", err)
+		}
+
+		if test.token != "" {
+			if err := client.Authenticate(ctx, test.token); err != nil {
+				t.Error(test.name, "Authentication failed", err)
+			}
+		}
+
+		if resp := whoami(client); resp.ResponseMap["user"] != test.user || resp.ResponseMap["admin"] != (test.user == "tata") {
+			t.Error(test.name, "Wrong identity", resp)
+		}
+
+		client.Close()
+	}
+
+	// Rejected
+	wrong := http.Header{}
+	wrong.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("tata:nope")))
+
+	for _, test := range []struct {
+		name   string
+		header http.Header
+		first  pure.PureMsg
+	}{
+		{"Wrong password", wrong, pure.PureMsg{DataType: "me", Action: "retrieve"}},
+		{"Wrong token", nil, pure.PureMsg{Action: pure.AuthenticateAction, RequestMap: map[string]interface{}{"token": "nope"}}},
+		{"No token", nil, pure.PureMsg{DataType: "me", Action: "retrieve"}},
+	} {
+		ws, _, err := websocket.DefaultDialer.Dial(url, test.header)
+		if err != nil {
+			t.Fatal(test.name, "Dial failed", err)
+		}
+
+		ws.WriteJSON(test.first)
+
+		msg := pure.PureMsg{}
+		if err := ws.ReadJSON(&msg); err != nil || msg.Action != pure.ProtocolErrorAction || msg.ErrorCode() != pure.CodeUnauthenticated {
+			t.Error(test.name, "Connection not rejected", msg, err)
+		}
+
+		if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			t.Error(test.name, "Connection not closed", err)
+		}
+
+		ws.Close()
+	}
+
+	// Identity of local clients
+	if resp := whoami(pure.NewAuthLocalClient(mux, &pure.Identity{Name: "tutu"})); resp.ResponseMap["user"] != "tutu" {
+		t.Error("Wrong local identity", resp)
+	}
+
+	if resp := whoami(pure.NewLocalClient(mux)); resp.ErrorCode() != pure.CodeUnauthenticated {
+		t.Error("Local client not anonymous", resp)
+	}
+
+}
+
+func TestMiddlewares(t *testing.T) {
+
+	mux := pure.NewPureMux()
+	mux.RegisterHandler("data", NewPureHandler())
+
+	order := []string{}
+	trace := func(name string) pure.Middleware {
+		return func(next pure.HandlerFunc) pure.HandlerFunc {
+			return func(m pure.PureReq, rw *pure.PureResponseWriter) {
+				order = append(order, name)
+				next(m, rw)
+				order = append(order, name+" "+rw.GetMsg().Action)
+			}
+		}
+	}
+
+	metrics := pure.NewMetrics()
+
+	mux.Use(trace("outer"), metrics.Middleware(), pure.Recover(), pure.Logging())
+	mux.Use(pure.Authorize(pure.RolePolicy{
+		"reader": {"*": {"retrieve"}},
+		"writer": {"data": {"*"}},
+	}))
+
+	ctx := context.Background()
+
+	reader := pure.NewAuthLocalClient(mux, &pure.Identity{Name: "tata", Roles: []string{"reader"}})
+	defer reader.Close()
+	writer := pure.NewAuthLocalClient(mux, &pure.Identity{Name: "toto", Roles: []string{"reader", "writer"}})
+	defer writer.Close()
+	anonymous := pure.NewLocalClient(mux)
+	defer anonymous.Close()
+
+	for _, test := range []struct {
+		name   string
+		client *pure.Client
+		msg    pure.PureMsg
+		action string
+		code   string
+	}{
+		{"Anonymous retrieve", anonymous, pure.PureMsg{DataType: "data", Action: "retrieve", RequestMap: map[string]interface{}{"id": "a"}}, "RETRIEVE_FAIL", pure.CodeForbidden},
+		{"Reader create", reader, createMsg("data", "a", "1"), "CREATE_FAIL", pure.CodeForbidden},
+		{"Writer create", writer, createMsg("data", "a", "1"), "CREATED", ""},
+		{"Reader retrieve", reader, pure.PureMsg{DataType: "data", Action: "retrieve", RequestMap: map[string]interface{}{"id": "a"}}, "RETRIEVED", ""},
+		{"Reader delete", reader, pure.PureMsg{DataType: "data", Action: "delete", RequestMap: map[string]interface{}{"id": "a"}}, "DELETE_FAIL", pure.CodeForbidden},
+		{"Anonymous begin", anonymous, pure.PureMsg{Action: pure.BeginAction}, "BEGIN_FAIL", pure.CodeForbidden},
+		{"Anonymous batch", anonymous, pure.PureMsg{Action: "batch"}, "BATCH_FAIL", pure.CodeForbidden},
+		{"Reader begin", reader, pure.PureMsg{Action: pure.BeginAction}, "BEGUN", ""},
+		// The handler panics on the type assertion of the id
+		{"Panic", writer, pure.PureMsg{DataType: "data", Action: "retrieve", RequestMap: map[string]interface{}{}}, pure.ProtocolErrorAction, pure.CodeInternal},
+	} {
+		resp, err := test.client.Call(ctx, test.msg)
+		if err != nil || resp.Action != test.action || resp.ErrorCode() != test.code {
+			t.Error(test.name, "Wrong response", resp, err)
+		}
+	}
+
+	// The panic was turned into a failure before reaching the outer middlewares
+	if len(order) != 18 || order[0] != "outer" || order[17] != "outer "+pure.ProtocolErrorAction {
+		t.Error("Wrong middleware order", order)
+	}
+
+	stats := metrics.Snapshot()
+	if stats["data/retrieve"].Count != 3 || stats["data/retrieve"].Failures != 2 || stats["data/create"].Count != 2 || stats["data/delete"].Failures != 1 {
+		t.Error("Wrong metrics", stats)
+	}
+
+	if !strings.Contains(metrics.String(), "\"data/create\"") {
+		t.Error("Wrong metrics JSON", metrics.String())
+	}
+
+}
+
+type Item struct {
+	Id    string
+	Count int
+	Tags  []string
+}
+
+func TestRateLimits(t *testing.T) {
+
+	mux := pure.NewPureMux()
+	mux.RegisterHandler("echo", EchoHandler{})
+	mux.RegisterHandler("data", NewPureHandler())
+
+	limiter := pure.NewRateLimiter(pure.RateLimits{
+		PerConnection: map[string]pure.Rate{
+			"echo/retrieve": {Requests: 1, Per: time.Second, Burst: 2},
+			"*/*":           {Requests: 100, Per: time.Second, Burst: 100},
+		},
+		PerUser: map[string]pure.Rate{
+			"data/*": {Requests: 1, Per: time.Minute, Burst: 3},
+		},
+		InFlight: 2,
+	})
+
+	// Blocks the echo requests asking for it, to keep them in flight
+	release := make(chan bool)
+	started := make(chan bool, 10)
+	block := func(next pure.HandlerFunc) pure.HandlerFunc {
+		return func(m pure.PureReq, rw *pure.PureResponseWriter) {
+			if m.Msg.RequestMap["block"] == true {
+				started <- true
+				<-release
+			}
+			next(m, rw)
+		}
+	}
+
+	mux.Use(limiter.Middleware(), block)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	echo := pure.PureMsg{DataType: "echo", Action: "retrieve", RequestMap: map[string]interface{}{"n": 1.0}}
+
+	// Per connection, by DataType/action
+	client := pure.NewLocalClient(mux)
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		if resp, err := client.Call(ctx, echo); err != nil || resp.Action != "RETRIEVED" {
+			t.Error("Request under the limit refused", i, resp, err)
+		}
+	}
+
+	resp, err := client.Call(ctx, echo)
+	retry, _ := resp.ResponseMap["retry_after"].(float64)
+	if err != nil || resp.Action != "RETRIEVE_FAIL" || resp.ErrorCode() != pure.CodeRateLimited || retry <= 0 || retry > 1 {
+		t.Error("Request over the limit accepted", resp, err)
+	}
+
+	// The other rules and connections have their own buckets
+	if resp, err := client.Call(ctx, createMsg("data", "a", "1")); err != nil || resp.Action != "CREATED" {
+		t.Error("Other rule limited", resp, err)
+	}
+
+	other := pure.NewLocalClient(mux)
+	defer other.Close()
+
+	if resp, err := other.Call(ctx, echo); err != nil || resp.Action != "RETRIEVED" {
+		t.Error("Other connection limited", resp, err)
+	}
+
+	// Tokens come back with time
+	time.Sleep(time.Duration(retry * float64(time.Second)))
+	if resp, err := client.Call(ctx, echo); err != nil || resp.Action != "RETRIEVED" {
+		t.Error("Request refused after waiting", resp, err)
+	}
+
+	// Per user, shared by the connections
+	identity := &pure.Identity{Name: "tata"}
+	first := pure.NewAuthLocalClient(mux, identity)
+	defer first.Close()
+	second := pure.NewAuthLocalClient(mux, identity)
+	defer second.Close()
+
+	for i, c := range []*pure.Client{first, second, first} {
+		if resp, err := c.Call(ctx, createMsg("data", fmt.Sprint("u", i), "1")); err != nil || resp.Action != "CREATED" {
+			t.Error("User request under the limit refused", i, resp, err)
+		}
+	}
+
+	resp, err = second.Call(ctx, createMsg("data", "u4", "1"))
+	if err != nil || resp.ErrorCode() != pure.CodeRateLimited || resp.ResponseMap["retry_after"] == nil {
+		t.Error("User request over the limit accepted", resp, err)
+	}
+
+	// Concurrent requests of a connection
+	busy := pure.NewLocalClient(mux)
+	defer busy.Close()
+
+	blocked := pure.PureMsg{DataType: "data", Action: "retrieve", RequestMap: map[string]interface{}{"id": "a", "block": true}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp, err := busy.Call(ctx, blocked); err != nil || resp.Action != "RETRIEVED" {
+				t.Error("Request in flight failed", resp, err)
+			}
+		}()
+	}
+	<-started
+	<-started
+
+	resp, err = busy.Call(ctx, pure.PureMsg{DataType: "data", Action: "retrieve", RequestMap: map[string]interface{}{"id": "a"}})
+	if err != nil || resp.ErrorCode() != pure.CodeRateLimited || resp.ResponseMap["retry_after"] != nil {
+		t.Error("Request over the in flight limit accepted", resp, err)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if resp, err := busy.Call(ctx, pure.PureMsg{DataType: "data", Action: "retrieve", RequestMap: map[string]interface{}{"id": "a"}}); err != nil || resp.Action != "RETRIEVED" {
+		t.Error("Request refused after the others finished", resp, err)
+	}
+}
+
+func TestRateQuota(t *testing.T) {
+
+	mux := pure.NewPureMux()
+	mux.RegisterHandler("echo", EchoHandler{})
+	limiter := pure.NewRateLimiter(pure.RateLimits{
+		PerConnection: map[string]pure.Rate{"*/*": {Burst: 2}},
+	})
+	mux.Use(limiter.Middleware())
+	mux.Watch(limiter)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := pure.NewLocalClient(mux)
+	defer client.Close()
+
+	echo := pure.PureMsg{DataType: "echo", Action: "retrieve", RequestMap: map[string]interface{}{"n": 1.0}}
+
+	accepted := 0
+	for i := 0; i < 10; i++ {
+		resp, err := client.Call(ctx, echo)
+		if err != nil {
+			t.Fatal("Call failed", err)
+		}
+
+		switch {
+		case resp.Action == "RETRIEVED":
+			accepted++
+		case resp.ErrorCode() != pure.CodeRateLimited || resp.ResponseMap["retry_after"] != nil:
+			t.Error("Wrong quota response", resp)
+		}
+	}
+
+	if accepted != 2 {
+		t.Error("Quota not enforced", accepted)
+	}
+
+	// The buckets of a connection go away with it
+	conn := &recorder{mux: mux}
+	for i := 0; i < 3; i++ {
+		conn.Handle(echo)
+	}
+	mux.Disconnect(conn)
+	conn.Handle(echo)
+
+	if len(conn.sent) != 4 || conn.sent[2].ErrorCode() != pure.CodeRateLimited || conn.sent[3].Action != "RETRIEVED" {
+		t.Error("Buckets kept after the disconnection", conn.sent)
+	}
+
+	// Rates refusing every request
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Rate without Burst accepted")
+			}
+		}()
+		pure.NewRateLimiter(pure.RateLimits{PerUser: map[string]pure.Rate{"*/*": {Requests: 1, Per: time.Second}}})
+	}()
+}
+
+// Retrieve waits for release when asked to, or for the request to be aborted
+type SlowHandler struct {
+	MyHandler
+	release chan bool
+	stopped chan string
+}
+
+func (h SlowHandler) Retrieve(m pure.PureReq, rw pure.ResponseWriter) {
+	rww := rw.(*pure.PureResponseWriter)
+	if m.Msg.RequestMap["wait"] == true {
+		select {
+		case <-h.release:
+		case <-m.Context.Done():
+			h.stopped <- m.Msg.RequestId
+			rww.FailWith(pure.CodeAborted, "Stopped")
+			return
+		}
+	}
+	rww.AddValue("id", m.Msg.RequestId)
+}
+
+// Responses of ws as "RequestId ACTION"
+func readResponses(t *testing.T, ws *websocket.Conn, n int) []string {
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	resps := []string{}
+	for i := 0; i < n; i++ {
+		msg := pure.PureMsg{}
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatal("Error reading response", err)
+		}
+		resps = append(resps, msg.RequestId+" "+msg.Action+" "+msg.ErrorCode())
+	}
+
+	return resps
+}
+
+func TestWorkers(t *testing.T) {
+
+	h := SlowHandler{NewPureHandler(), make(chan bool), make(chan string, 10)}
+
+	mux := pure.NewPureMux()
+	mux.RegisterHandler("slow", h)
+	mux.RegisterHandler("other", h)
+
+	server := func(ordering pure.Ordering) *httptest.Server {
+		options := pure.DefaultWebsocketOptions()
+		options.Ordering = ordering
+		return httptest.NewServer(pure.NewWebsocketHandler(mux, options))
+	}
+
+	req := func(dataType string, id string, wait bool) pure.PureMsg {
+		return pure.PureMsg{DataType: dataType, Action: "retrieve", RequestId: id, RequestMap: map[string]interface{}{"wait": wait}}
+	}
+
+	abort := func(id string) pure.PureMsg {
+		return pure.PureMsg{Action: pure.AbortAction, RequestId: id}
+	}
+
+	for _, test := range []struct {
+		name     string
+		ordering pure.Ordering
+		msgs     []pure.PureMsg
+		before   []string // Responses before the release
+		after    []string
+	}{
+		{"Sequential", pure.Sequential,
+			[]pure.PureMsg{req("slow", "a", true), req("other", "b", false)},
+			[]string{},
+			[]string{"a RETRIEVED ", "b RETRIEVED "}},
+		// Aborted while running then while waiting, in the order they are received
+		{"Sequential abort", pure.Sequential,
+			[]pure.PureMsg{req("slow", "a", true), req("slow", "b", false), abort("b"), abort("a"), req("slow", "c", false)},
+			[]string{"a RETRIEVE_FAIL ABORTED", "b RETRIEVE_FAIL ABORTED", "c RETRIEVED "},
+			[]string{}},
+		{"Parallel", pure.Parallel,
+			[]pure.PureMsg{req("slow", "a", true), req("slow", "b", false)},
+			[]string{"b RETRIEVED "},
+			[]string{"a RETRIEVED "}},
+		{"PerDataType", pure.PerDataType,
+			[]pure.PureMsg{req("slow", "a", true), req("slow", "b", false), req("other", "c", false)},
+			[]string{"c RETRIEVED "},
+			[]string{"a RETRIEVED ", "b RETRIEVED "}},
+	} {
+		s := server(test.ordering)
+		ws := dial(t, s)
+
+		for _, msg := range test.msgs {
+			if err := ws.WriteJSON(msg); err != nil {
+				t.Fatal(test.name, "Error sending", err)
+			}
+		}
+
+		if resps := readResponses(t, ws, len(test.before)); !reflect.DeepEqual(resps, test.before) {
+			t.Error(test.name, "Wrong responses before the release", resps)
+		}
+
+		if len(test.after) > 0 {
+			h.release <- true
+		}
+
+		if resps := readResponses(t, ws, len(test.after)); !reflect.DeepEqual(resps, test.after) {
+			t.Error(test.name, "Wrong responses after the release", resps)
+		}
+
+		ws.Close()
+		s.Close()
+	}
+
+	// Drain the aborts of the handler
+	for len(h.stopped) > 0 {
+		<-h.stopped
+	}
+
+	// Calls given up by the client are aborted on the server
+	s := server(pure.Parallel)
+	defer s.Close()
+
+	client, err := pure.Dial(context.Background(), "ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		t.Fatal("Dial failed", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if _, err := client.Call(ctx, req("slow", "given up", true)); err != context.DeadlineExceeded {
+		t.Error("Call not given up", err)
+	}
+
+	select {
+	case id := <-h.stopped:
+		if id != "given up" {
+			t.Error("Wrong request aborted", id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Request not aborted")
+	}
+}
+
+func TestSchema(t *testing.T) {
+
+	mux := pure.NewPureMux()
+	mux.RegisterHandler("data", NewPureHandler())
+
+	mux.RegisterSchema("data", "retrieve", pure.Schema{Fields: map[string]pure.Field{
+		"id": {Type: pure.String, Required: true},
+	}})
+	mux.RegisterSchema("data", "create", pure.Schema{Strict: true, Fields: map[string]pure.Field{
+		"id":    {Type: pure.String, Required: true, Min: pure.Limit(2), Pattern: "^[a-z]+$"},
+		"value": {Type: pure.String, Enum: []interface{}{"yoyo", "yaya"}},
+		"count": {Type: pure.Integer, Min: pure.Limit(0), Max: pure.Limit(10)},
+		"tags":  {Type: pure.List, Max: pure.Limit(2)},
+		"admin": {Type: pure.Bool},
+	}})
+
+	client := pure.NewLocalClient(mux)
+	defer client.Close()
+
+	ctx := context.Background()
+
+	for _, test := range []struct {
+		name   string
+		msg    pure.PureMsg
+		action string
+		fields []string
+	}{
+		// Would panic in the handler
+		{"Missing id", pure.PureMsg{DataType: "data", Action: "retrieve", RequestMap: map[string]interface{}{}}, "RETRIEVE_FAIL", []string{"id"}},
+		{"Wrong type", pure.PureMsg{DataType: "data", Action: "retrieve", RequestMap: map[string]interface{}{"id": 42}}, "RETRIEVE_FAIL", []string{"id"}},
+		{"Valid", pure.PureMsg{DataType: "data", Action: "create", RequestMap: map[string]interface{}{"id": "tata", "value": "yoyo", "count": 3.0, "tags": []interface{}{"a"}, "admin": true}}, "CREATED", nil},
+		{"Invalid", pure.PureMsg{DataType: "data", Action: "create", RequestMap: map[string]interface{}{"id": "t", "value": "toto", "count": 3.5, "tags": []interface{}{"a", "b", "c"}, "admin": "yes", "other": 1}}, "CREATE_FAIL", []string{"admin", "count", "id", "other", "tags", "value"}},
+		{"Range", pure.PureMsg{DataType: "data", Action: "create", RequestMap: map[string]interface{}{"id": "toto", "count": 11}}, "CREATE_FAIL", []string{"count"}},
+		{"Pattern", pure.PureMsg{DataType: "data", Action: "create", RequestMap: map[string]interface{}{"id": "To To"}}, "CREATE_FAIL", []string{"id"}},
+		{"No schema", pure.PureMsg{DataType: "data", Action: "update", RequestMap: map[string]interface{}{"id": "tata", "value": 42}}, "UPDATED", nil},
+	} {
+		resp, err := client.Call(ctx, test.msg)
+		if err != nil || resp.Action != test.action {
+			t.Error(test.name, "Wrong response", resp, err)
+			continue
+		}
+
+		fields := resp.FieldErrors()
+		if len(fields) != len(test.fields) || len(resp.Errors()) != len(test.fields) {
+			t.Error(test.name, "Wrong field errors", resp.LogList)
+		}
+
+		for _, field := range test.fields {
+			if fields[field].Code != pure.CodeInvalid {
+				t.Error(test.name, "Missing field error", field, resp.LogList)
+			}
+		}
+	}
+
+	// Patterns are checked once, at registration
+	if err := mux.RegisterSchema("data", "update", pure.Schema{Fields: map[string]pure.Field{"id": {Type: pure.String, Pattern: "[a-"}}}); err == nil {
+		t.Error("Invalid pattern registered")
+	}
+
+	if resp, err := client.Call(ctx, pure.PureMsg{DataType: "data", Action: "update", RequestMap: map[string]interface{}{"id": "tata", "value": "yoyo"}}); err != nil || resp.Action != "UPDATED" {
+		t.Error("Schema with an invalid pattern used", resp, err)
+	}
+
+	item := Item{}
+	err := pure.DecodeRequest(pure.PureMsg{RequestMap: map[string]interface{}{"id": "tata", "count": 3.0, "tags": []interface{}{"a", "b"}}}, &item)
+	if err != nil || item.Id != "tata" || item.Count != 3 || len(item.Tags) != 2 {
+		t.Error("Request badly decoded", item, err)
+	}
+
+	if err := pure.DecodeRequest(pure.PureMsg{RequestMap: map[string]interface{}{"count": "3"}}, &item); err == nil {
+		t.Error("Wrong type decoded")
+	}
+
+}
+
+func sampleMsgs() []pure.PureMsg {
+	return []pure.PureMsg{
+		{},
+		createMsg("data", "tata", "yoyo"),
+		{
+			Action:         "RETRIEVED",
+			DataType:       "data",
+			RequestId:      "42",
+			Event:          "update",
+			LogList:        []pure.LogMessage{{Level: pure.Error, Id: 3, Message: "Bad", Code: pure.CodeInvalid, Field: "id"}},
+			RequestMap:     map[string]interface{}{"id": "tata", "count": 3, "ratio": 0.5, "negative": -12, "big": uint64(1) << 40, "ok": true, "none": nil},
+			ResponseMap:    map[string]interface{}{"items": []interface{}{map[string]interface{}{"title": "été", "tags": []interface{}{"a", 1, false}}}, "empty": map[string]interface{}{}, "raw": []byte("\x00\xffraw"), "chunks": []interface{}{[]byte("a"), []byte{}}},
+			TransactionMap: map[string]string{"tx": "1"},
+		},
+		{
+			Action: "batch",
+			Batch: []pure.PureMsg{
+				createMsg("data", "a", "1"),
+				{Action: "update", DataType: "data", RequestMap: map[string]interface{}{"id": "a", "nested": map[string]interface{}{"n": 1}}},
+			},
+		},
+	}
+}
+
+func TestCodecs(t *testing.T) {
+
+	for _, sample := range sampleMsgs() {
+
+		data, err := pure.JSON.Marshal(sample)
+		if err != nil {
+			t.Fatal("JSON encoding failed", err)
+		}
+		expected := pure.PureMsg{}
+		pure.JSON.Unmarshal(data, &expected)
+
+		for _, codec := range pure.DefaultCodecs {
+			data, err := codec.Marshal(sample)
+			if err != nil {
+				t.Error(codec.Name(), "Encoding failed", err)
+				continue
+			}
+
+			msg := pure.PureMsg{}
+			if err := codec.Unmarshal(data, &msg); err != nil {
+				t.Error(codec.Name(), "Decoding failed", err)
+				continue
+			}
+
+			if !reflect.DeepEqual(msg, expected) {
+				t.Errorf("%v: Message changed\n%#v\n%#v", codec.Name(), msg, expected)
+			}
+		}
+	}
+
+}
+
+func TestWebsocketCodecs(t *testing.T) {
+
+	mux := newClientMux()
+	server := httptest.NewServer(pure.WebsocketHandler(mux))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	ctx := context.Background()
+
+	for _, codec := range pure.DefaultCodecs {
+
+		client, err := pure.DialCodec(ctx, url, nil, codec)
+		if err != nil {
+			t.Fatal(codec.Name(), "Dial failed", err)
+		}
+
+		for _, sample := range sampleMsgs()[2:3] {
+			sample.DataType, sample.Action, sample.RequestId = "echo", "retrieve", ""
+
+			resp, err := client.Call(ctx, sample)
+			if err != nil {
+				t.Error(codec.Name(), "Call failed", err)
+				continue
+			}
+
+			expected := pure.PureMsg{}
+			data, _ := json.Marshal(sample.RequestMap)
+			json.Unmarshal(data, &expected.ResponseMap)
+
+			if !reflect.DeepEqual(resp.ResponseMap, expected.ResponseMap) {
+				t.Error(codec.Name(), "Wrong response", resp.ResponseMap, expected.ResponseMap)
+			}
+		}
+
+		client.Close()
+
+		// Frames follow the codec
+		dialer := websocket.Dialer{Subprotocols: []string{codec.Name()}}
+		ws, _, err := dialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(codec.Name(), "Dial failed", err)
+		}
+
+		if ws.Subprotocol() != codec.Name() {
+			t.Error(codec.Name(), "Subprotocol not negotiated", ws.Subprotocol())
+		}
+
+		data, _ := codec.Marshal(createMsg("data", codec.Name(), "yoyo"))
+		ws.WriteMessage(websocket.BinaryMessage, data)
+
+		messageType, data, err := ws.ReadMessage()
+		msg := pure.PureMsg{}
+		if err == nil {
+			err = codec.Unmarshal(data, &msg)
+		}
+		if err != nil || msg.Action != "CREATED" || (messageType == websocket.BinaryMessage) != codec.Binary() {
+			t.Error(codec.Name(), "Wrong frame", messageType, msg, err)
+		}
+
+		ws.Close()
+	}
+
+	// Unknown encodings fall back to JSON
+	client, err := pure.DialCodec(ctx, url, nil, fakeCodec{pure.JSON})
+	if err != nil {
+		t.Fatal("Dial failed", err)
+	}
+	defer client.Close()
+
+	if resp, err := client.Call(ctx, createMsg("data", "fake", "yoyo")); err != nil || resp.Action != "CREATED" {
+		t.Error("No fallback to JSON", resp, err)
+	}
+
+}
+
+type fakeCodec struct {
+	pure.Codec
+}
+
+func (fakeCodec) Name() string {
+	return "pure.fake"
+}
+
+// Handler streaming RequestMap["count"] items in chunks of two
+type StreamHandler struct {
+	MyHandler
+}
+
+func (h StreamHandler) Retrieve(m pure.PureReq, rw pure.ResponseWriter) {
+
+	rww := rw.(*pure.PureResponseWriter)
+	count := int(m.Msg.RequestMap["count"].(float64))
+
+	items := []interface{}{}
+	for i := 0; i < count; i++ {
+		items = append(items, strings.Repeat("article ", 1000))
+		if len(items) == 2 {
+			rww.Chunk(map[string]interface{}{"items": items})
+			items = []interface{}{}
+		}
+	}
+
+	rww.AddValue("items", items)
+}
+
+func testStream(t *testing.T, name string, client *pure.Client) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chunks := []pure.PureMsg{}
+	resp, err := client.Stream(ctx, pure.PureMsg{DataType: "stream", Action: "retrieve", RequestMap: map[string]interface{}{"count": 5.0}}, func(chunk pure.PureMsg) {
+		chunks = append(chunks, chunk)
+	})
+
+	if err != nil || resp.Action != "RETRIEVED" || resp.More || resp.Chunk != 3 || len(resp.ResponseMap["items"].([]interface{})) != 1 {
+		t.Error(name, "Wrong completion", resp.Action, resp.Chunk, resp.More, err)
+	}
+
+	if len(chunks) != 2 {
+		t.Fatal(name, "Wrong chunk count", len(chunks))
+	}
+
+	for idx, chunk := range chunks {
+		if chunk.Chunk != idx+1 || !chunk.More || chunk.RequestId != resp.RequestId || len(chunk.ResponseMap["items"].([]interface{})) != 2 {
+			t.Error(name, "Wrong chunk", idx, chunk.Chunk, chunk.More, chunk.RequestId)
+		}
+	}
+
+	// Call only returns the end of the stream
+	resp, err = client.Call(ctx, pure.PureMsg{DataType: "stream", Action: "retrieve", RequestMap: map[string]interface{}{"count": 4.0}})
+	if err != nil || resp.Chunk != 3 || len(resp.ResponseMap["items"].([]interface{})) != 0 {
+		t.Error(name, "Wrong Call on a stream", resp.Chunk, err)
+	}
+
+	// Not streamed
+	resp, err = client.Call(ctx, pure.PureMsg{DataType: "stream", Action: "retrieve", RequestMap: map[string]interface{}{"count": 1.0}})
+	if err != nil || resp.Chunk != 0 || resp.More {
+		t.Error(name, "Response marked as streamed", resp.Chunk, err)
+	}
+
+}
+
+func TestStream(t *testing.T) {
+
+	mux := pure.NewPureMux()
+	mux.RegisterHandler("stream", StreamHandler{NewPureHandler()})
+
+	local := pure.NewLocalClient(mux)
+	defer local.Close()
+	testStream(t, "Local", local)
+
+	server := httptest.NewServer(pure.WebsocketHandler(mux))
+	defer server.Close()
+
+	for _, codec := range pure.DefaultCodecs {
+		client, err := pure.DialCodec(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http"), nil, codec)
+		if err != nil {
+			t.Fatal("Dial failed", err)
+		}
+		testStream(t, codec.Name(), client)
+		client.Close()
+	}
+
+}
+
+func TestCompressionAndLimits(t *testing.T) {
+
+	mux := newClientMux()
+
+	options := pure.DefaultWebsocketOptions()
+	options.ReadLimit = 64 << 10
+	server := httptest.NewServer(pure.NewWebsocketHandler(mux, options))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	ws, resp, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal("Dial failed", err)
+	}
+	defer ws.Close()
+
+	if !strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate") {
+		t.Error("Compression not negotiated", resp.Header)
+	}
+
+	// Compressed both ways
+	large := strings.Repeat("article ", 4000)
+	ws.WriteJSON(pure.PureMsg{DataType: "echo", Action: "retrieve", RequestMap: map[string]interface{}{"text": large}})
+
+	msg := pure.PureMsg{}
+	if err := ws.ReadJSON(&msg); err != nil || msg.ResponseMap["text"] != large {
+		t.Error("Large message not echoed", err)
+	}
+
+	// Over the read limit, even compressed
+	noise := make([]byte, 128<<10)
+	rand.Read(noise)
+	ws.WriteJSON(pure.PureMsg{DataType: "echo", Action: "retrieve", RequestMap: map[string]interface{}{"text": base64.StdEncoding.EncodeToString(noise)}})
+
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Error("Read limit not enforced", err)
+	}
+
+}
+
+func TestHTTPClient(t *testing.T) {
+
+	mux := newClientMux()
+	mux.RegisterHandler("stream", StreamHandler{NewPureHandler()})
+
+	server := httptest.NewServer(pure.NewSessionHandler(mux, pure.DefaultSessionOptions()))
+	defer server.Close()
+
+	ctx := context.Background()
+
+	client, err := pure.DialHTTP(ctx, server.URL, nil)
+	if err != nil {
+		t.Fatal("Dial failed", err)
+	}
+
+	other, err := pure.DialHTTP(ctx, server.URL, nil)
+	if err != nil {
+		t.Fatal("Dial failed", err)
+	}
+	defer other.Close()
+
+	testStream(t, "HTTP", other)
+	testClient(t, "HTTP", client, other)
+
+}
+
+// Read the next Server-Sent Event
+func readEvent(t *testing.T, events *bufio.Reader) (string, pure.PureMsg) {
+
+	id, msg := "", pure.PureMsg{}
+
+	for {
+		line, err := events.ReadString('\n')
+		if err != nil {
+			t.Fatal("Error reading event", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case line == "" && id != "":
+			return id, msg
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &msg); err != nil {
+				t.Fatal("Wrong event data", line, err)
+			}
+		}
+	}
+}
+
+func TestSessionTransports(t *testing.T) {
+
+	mux := pure.NewPureMux()
+	h := NewLifecycleHandler()
+	mux.RegisterHandler("data", LifecycleHandler{NewPushHandler(mux), h.connected, h.disconnected})
+
+	options := pure.DefaultSessionOptions()
+	options.PollTimeout = 100 * time.Millisecond
+	options.Timeout = 300 * time.Millisecond
+	server := httptest.NewServer(pure.NewSessionHandler(mux, options))
+	defer server.Close()
+
+	post := func(session string, msg interface{}) (*http.Response, []pure.PureMsg) {
+		body := []byte{}
+		if msg != nil {
+			body, _ = json.Marshal(msg)
+		}
+
+		req, _ := http.NewRequest("POST", server.URL, bytes.NewReader(body))
+		req.Header.Set(pure.SessionHeader, session)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("POST failed", err)
+		}
+		defer resp.Body.Close()
+
+		msgs := []pure.PureMsg{}
+		if msg != nil {
+			json.NewDecoder(resp.Body).Decode(&msgs)
+		}
+		return resp, msgs
+	}
+
+	poll := func(session string, since int) (uint64, []pure.PureMsg) {
+		resp, err := http.Get(fmt.Sprintf("%v?session=%v&since=%d", server.URL, session, since))
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatal("Poll failed", resp, err)
+		}
+		defer resp.Body.Close()
+
+		result := struct {
+			Seq      uint64
+			Messages []pure.PureMsg
+		}{}
+		json.NewDecoder(resp.Body).Decode(&result)
+		return result.Seq, result.Messages
+	}
+
+	resp, _ := post("", nil)
+	session := resp.Header.Get(pure.SessionHeader)
+	if resp.StatusCode != http.StatusCreated || session == "" {
+		t.Fatal("Session not created", resp.StatusCode)
+	}
+	sessionConn := waitConn(t, h.connected, "session")
+
+	_, msgs := post(session, pure.PureMsg{DataType: "data", Action: "subscribe", RequestMap: map[string]interface{}{}})
+	if len(msgs) != 1 || msgs[0].Action != "SUBSCRIBED" || msgs[0].RequestId == "" {
+		t.Fatal("Subscription failed", msgs)
+	}
+
+	// The session is created along with the first request
+	resp, msgs = post("", createMsg("data", "a", "1"))
+	writer := resp.Header.Get(pure.SessionHeader)
+	if writer == "" || writer == session || len(msgs) != 1 || msgs[0].Action != "CREATED" {
+		t.Error("Request without session failed", writer, msgs)
+	}
+	waitConn(t, h.connected, "session")
+
+	seq, msgs := poll(session, 0)
+	if seq != 1 || len(msgs) != 1 || msgs[0].Action != pure.PushAction {
+		t.Error("Push not polled", seq, msgs)
+	}
+
+	post(writer, createMsg("data", "b", "2"))
+
+	// Switch to the event stream, the first push was received
+	req, _ := http.NewRequest("GET", server.URL+"?session="+session, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Last-Event-ID", "1")
+	stream, err := http.DefaultClient.Do(req)
+	if err != nil || stream.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatal("Event stream failed", err)
+	}
+
+	events := bufio.NewReader(stream.Body)
+
+	if id, msg := readEvent(t, events); id != "2" || msg.ResponseMap["id"] != "b" {
+		t.Error("Wrong event", id, msg)
+	}
+
+	post(writer, createMsg("data", "c", "3"))
+
+	if id, msg := readEvent(t, events); id != "3" || msg.ResponseMap["id"] != "c" {
+		t.Error("Wrong live event", id, msg)
+	}
+
+	// The session outlives its timeout while streaming
+	time.Sleep(400 * time.Millisecond)
+	stream.Body.Close()
+
+	// Back to polling
+	if seq, msgs := poll(session, 3); seq != 3 || len(msgs) != 0 {
+		t.Error("Messages polled twice", seq, msgs)
+	}
+
+	// Expiration
+	expired := []pure.PureConnection{waitConn(t, h.disconnected, "expiration"), waitConn(t, h.disconnected, "expiration")}
+	if expired[0] != sessionConn && expired[1] != sessionConn {
+		t.Error("Session not expired")
+	}
+
+	for _, id := range []string{session, writer} {
+		resp, _ := post(id, createMsg("data", "d", "4"))
+		if resp.StatusCode != http.StatusNotFound {
+			t.Error("Expired session used", resp.StatusCode)
+		}
+	}
+
+}
+
+func TestSessionAuth(t *testing.T) {
+
+	mux := newClientMux()
+	mux.RegisterHandler("me", IdentityHandler{NewPureHandler()})
+
+	options := pure.DefaultSessionOptions()
+	options.Auth = []pure.Authenticator{pure.BasicAuthenticator(func(u string, p string) *pure.Identity {
+		if p == "yoyo" {
+			return &pure.Identity{Name: u}
+		}
+		return nil
+	})}
+	handler := pure.NewSessionHandler(mux, options)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx := context.Background()
+
+	if _, err := pure.DialHTTP(ctx, server.URL, nil); err == nil {
+		t.Error("Unauthenticated session created")
+	}
+
+	resp, err := http.Post(server.URL, "application/json", strings.NewReader("{}"))
+	msgs := []pure.PureMsg{}
+	if err == nil {
+		json.NewDecoder(resp.Body).Decode(&msgs)
+		resp.Body.Close()
+	}
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || len(msgs) != 1 || msgs[0].ErrorCode() != pure.CodeUnauthenticated {
+		t.Error("Wrong rejection", msgs, err)
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("tata:yoyo")))
+
+	client, err := pure.DialHTTP(ctx, server.URL, header)
+	if err != nil {
+		t.Fatal("Dial failed", err)
+	}
+	defer client.Close()
+
+	if resp, err := client.Call(ctx, pure.PureMsg{DataType: "me", Action: "retrieve"}); err != nil || resp.ResponseMap["user"] != "tata" {
+		t.Error("Wrong identity", resp, err)
+	}
+
+	// Sessions belong to their user
+	sessions := handler.Sessions()
+	if len(sessions) != 1 {
+		t.Fatal("Wrong session count", len(sessions))
+	}
+
+	req, _ := http.NewRequest("POST", server.URL, strings.NewReader("{}"))
+	req.Header.Set(pure.SessionHeader, sessions[0].Id)
+	req.SetBasicAuth("toto", "yoyo")
+
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Error("Session used by another user", resp, err)
+	}
+
+}
+
+// Cut the websockets of the server without closing handshake, like a
+// network failure
+func dropConns(handler *pure.HttpHandler) {
+	for _, conn := range handler.Conns() {
+		conn.(*pure.WebsocketConn).Conn.Close()
+	}
+}
+
+func waitPush(t *testing.T, client *pure.Client, action string) pure.PureMsg {
+	for {
+		select {
+		case push, ok := <-client.Pushes():
+			if !ok {
+				t.Fatal("Client closed while waiting for", action)
+			}
+			if push.Action == action {
+				return push
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for", action)
+		}
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+
+	mux := pure.NewPureMux()
+	h := NewLifecycleHandler()
+	mux.RegisterHandler("data", LifecycleHandler{NewPushHandler(mux), h.connected, h.disconnected})
+
+	sessionOptions := pure.DefaultSessionOptions()
+	sessionOptions.Timeout = 300 * time.Millisecond
+
+	options := pure.DefaultWebsocketOptions()
+	options.Sessions = pure.NewSessionHandler(mux, sessionOptions)
+
+	handler := pure.NewWebsocketHandler(mux, options)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := pure.DialSession(ctx, url, nil, pure.JSON)
+	if err != nil {
+		t.Fatal("Dial failed", err)
+	}
+	defer client.Close()
+
+	hello := waitPush(t, client, pure.SessionAction)
+	session, _ := hello.ResponseMap["session"].(string)
+	if session == "" || hello.ResponseMap["resumed"] != false {
+		t.Error("Wrong handshake", hello)
+	}
+	waitConn(t, h.connected, "session")
+
+	resp, err := client.Call(ctx, pure.PureMsg{DataType: "data", Action: "subscribe", RequestMap: map[string]interface{}{}})
+	if err != nil || resp.Action != "SUBSCRIBED" || resp.Seq == 0 {
+		t.Fatal("Subscription failed", resp, err)
+	}
+
+	writer := pure.NewLocalClient(mux)
+	defer writer.Close()
+
+	// Pushes sent around the drop are received once, in order
+	dropConns(handler)
+	for i := 0; i < 10; i++ {
+		writer.Call(ctx, createMsg("data", fmt.Sprint(i), "yoyo"))
+	}
+
+	if hello := waitPush(t, client, pure.SessionAction); hello.ResponseMap["session"] != session || hello.ResponseMap["resumed"] != true {
+		t.Error("Session not resumed", hello)
+	}
+
+	seq := resp.Seq
+	for i := 0; i < 10; i++ {
+		push := waitPush(t, client, pure.PushAction)
+		if push.ResponseMap["id"] != fmt.Sprint(i) || push.Seq <= seq {
+			t.Error("Wrong replay", i, push.ResponseMap, push.Seq)
+		}
+		seq = push.Seq
+	}
+
+	select {
+	case conn := <-h.disconnected:
+		t.Error("Session closed by the drop", conn)
+	default:
+	}
+
+	// Replay from the last Seq received
+	dialer := websocket.Dialer{}
+	header := http.Header{}
+	header.Set(pure.SessionHeader, session)
+	header.Set(pure.SeqHeader, fmt.Sprint(seq-2))
+
+	ws, _, err := dialer.Dial(url, header)
+	if err != nil {
+		t.Fatal("Dial failed", err)
+	}
+
+	msgs := []pure.PureMsg{}
+	for len(msgs) < 3 {
+		msg := pure.PureMsg{}
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatal("Replay failed", err)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	if msgs[0].Action != pure.SessionAction || msgs[0].ResponseMap["resumed"] != true || msgs[1].Seq != seq-1 || msgs[2].Seq != seq {
+		t.Error("Wrong replay", msgs)
+	}
+
+	// Unknown sessions are replaced
+	header.Set(pure.SessionHeader, "nope")
+	other, _, err := dialer.Dial(url, header)
+	if err != nil {
+		t.Fatal("Dial failed", err)
+	}
+
+	msg := pure.PureMsg{}
+	if other.ReadJSON(&msg); msg.ResponseMap["resumed"] != false || msg.ResponseMap["session"] == "nope" {
+		t.Error("Unknown session resumed", msg)
+	}
+	waitConn(t, h.connected, "session")
+
+	// Sessions left on purpose are closed right away, their other
+	// connections too
+	start := time.Now()
+	client.Close()
+	waitConn(t, h.disconnected, "closed session")
+
+	if time.Since(start) > sessionOptions.Timeout {
+		t.Error("Session closed after its grace period")
+	}
+
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Error("Connection of a closed session open", err)
+	}
+	ws.Close()
+
+	// The others expire after a grace period
+	start = time.Now()
+	other.Close()
+	waitConn(t, h.disconnected, "expired session")
+
+	if time.Since(start) < sessionOptions.Timeout {
+		t.Error("Session closed before its grace period")
+	}
+
+	if len(options.Sessions.Sessions()) != 0 {
+		t.Error("Sessions left", options.Sessions.Sessions())
+	}
+
+}
+
+// Runs longer than the buffer of the sessions
+func TestSessionBuffer(t *testing.T) {
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	mux := pure.NewPureMux()
+	mux.RegisterHandler("data", NewPushHandler(mux))
+
+	sessionOptions := pure.DefaultSessionOptions()
+	sessionOptions.BufferSize = 4
+
+	sessions := pure.NewSessionHandler(mux, sessionOptions)
+	options := pure.DefaultWebsocketOptions()
+	options.Sessions = sessions
+
+	wsServer := httptest.NewServer(pure.NewWebsocketHandler(mux, options))
+	defer wsServer.Close()
+	httpServer := httptest.NewServer(sessions)
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	writer := pure.NewLocalClient(mux)
+	defer writer.Close()
+
+	subscribe := pure.PureMsg{DataType: "data", Action: "subscribe", RequestMap: map[string]interface{}{}}
+
+	// Websocket
+	client, err := pure.DialSession(ctx, "ws"+strings.TrimPrefix(wsServer.URL, "http"), nil, pure.JSON)
+	if err != nil {
+		t.Fatal("Dial failed", err)
+	}
+	defer client.Close()
+	waitPush(t, client, pure.SessionAction)
+
+	if resp, err := client.Call(ctx, subscribe); err != nil || resp.Action != "SUBSCRIBED" {
+		t.Fatal("Subscription failed", resp, err)
+	}
+
+	for i := 0; i < 20; i++ {
+		writer.Call(ctx, createMsg("data", fmt.Sprint("ws", i), "yoyo"))
+		if push := waitPush(t, client, pure.PushAction); push.ResponseMap["id"] != fmt.Sprint("ws", i) {
+			t.Error("Wrong push", i, push.ResponseMap)
+		}
+	}
+
+	// Event stream
+	body, _ := json.Marshal(subscribe)
+	resp, err := http.Post(httpServer.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal("POST failed", err)
+	}
+	resp.Body.Close()
+	session := resp.Header.Get(pure.SessionHeader)
+
+	req, _ := http.NewRequest("GET", httpServer.URL+"?session="+session, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	stream, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Event stream failed", err)
+	}
+
+	events := bufio.NewReader(stream.Body)
+
+	var id string
+	for i := 0; i < 20; i++ {
+		writer.Call(ctx, createMsg("data", fmt.Sprint("sse", i), "yoyo"))
+		waitPush(t, client, pure.PushAction)
+
+		var msg pure.PureMsg
+		if id, msg = readEvent(t, events); msg.ResponseMap["id"] != fmt.Sprint("sse", i) {
+			t.Error("Wrong event", i, msg.ResponseMap)
+		}
+	}
+	stream.Body.Close()
+
+	if strings.Contains(logs.String(), "buffer full") {
+		t.Error("Messages sent dropped as lost", logs.String())
+	}
+
+	// Recent messages can still be read again
+	poll, err := http.Get(fmt.Sprintf("%v?session=%v&since=%v", httpServer.URL, session, 19))
+	if err != nil {
+		t.Fatal("Poll failed", err)
+	}
+	result := struct {
+		Seq      uint64
+		Messages []pure.PureMsg
+	}{}
+	json.NewDecoder(poll.Body).Decode(&result)
+	poll.Body.Close()
+
+	if fmt.Sprint(result.Seq) != id || len(result.Messages) != 1 || result.Messages[0].ResponseMap["id"] != "sse19" {
+		t.Error("Last message not kept", result)
+	}
+}
+
+// The DbManager of saver can back a CRUDHandler
+var _ pure.TransactionalStore = (*saverstore.Store)(nil)
+
+type FeedOwner struct {
+	Id   int
+	Name string
+}
+
+type Feed struct {
+	Id    int
+	Title string
+	Url   string
+	Count int
+	Owner *FeedOwner `type:"ManyToOne" object:"FeedOwner"`
+}
+
+// Store of Feeds behaving like saverstore
+type memStore struct {
+	objects map[int]*Feed
+	counter int
+}
+
+func (s *memStore) Save(obj interface{}) error {
+	s.counter++
+	feed := obj.(*Feed)
+	feed.Id = s.counter
+	s.objects[feed.Id] = feed
+	return nil
+}
+
+func (s *memStore) Retrieve(ID int, dst interface{}) error {
+	feed, ok := s.objects[ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	*dst.(**Feed) = feed
+	return nil
+}
+
+func (s *memStore) Update(obj interface{}) error {
+	if _, ok := s.objects[obj.(*Feed).Id]; !ok {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *memStore) Delete(obj interface{}) error {
+	delete(s.objects, obj.(*Feed).Id)
+	return nil
+}
+
+func (s *memStore) Flush(obj interface{}) (int64, error) {
+	flushed := len(s.objects)
+	s.objects = make(map[int]*Feed)
+	return int64(flushed), nil
+}
+
+// Works on copies of the objects, put back in the store by Commit
+func (s *memStore) Begin() (pure.StoreTx, error) {
+
+	tx := &memStoreTx{memStore: memStore{objects: make(map[int]*Feed), counter: s.counter}, parent: s}
+	for id, feed := range s.objects {
+		copied := *feed
+		tx.objects[id] = &copied
+	}
+
+	return tx, nil
+}
+
+type memStoreTx struct {
+	memStore
+	parent *memStore
+}
+
+func (t *memStoreTx) Commit() error {
+	t.parent.objects = t.objects
+	t.parent.counter = t.counter
+	return nil
+}
+
+func (t *memStoreTx) Rollback() error {
+	return nil
+}
+
+func TestCRUDHandler(t *testing.T) {
+
+	store := &memStore{objects: make(map[int]*Feed)}
+
+	mux := pure.NewPureMux()
+	mux.RegisterHandler("feed", pure.NewCRUDHandler(mux, store, &Feed{}, "Title", "Url"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := pure.NewLocalClient(mux)
+	defer client.Close()
+	watcher := pure.NewLocalClient(mux)
+	defer watcher.Close()
+
+	if resp, err := watcher.Call(ctx, pure.PureMsg{DataType: "feed", Action: "subscribe"}); err != nil || resp.Action != "SUBSCRIBED" {
+		t.Fatal("Subscription failed", resp, err)
+	}
+
+	msg := func(action string, values map[string]interface{}) pure.PureMsg {
+		return pure.PureMsg{DataType: "feed", Action: action, RequestMap: values}
+	}
+
+	resp, err := client.Call(ctx, msg("create", map[string]interface{}{"Title": "Go", "Url": "http://golang.org"}))
+	if err != nil || resp.Action != "CREATED" || resp.ResponseMap["Id"] != 1 || resp.ResponseMap["Title"] != "Go" || store.objects[1].Url != "http://golang.org" {
+		t.Error("Create failed", resp, err)
+	}
+
+	if push := waitPush(t, watcher, pure.PushAction); push.Event != "create" || push.ResponseMap["Title"] != "Go" {
+		t.Error("Wrong create push", push)
+	}
+
+	// Fields not writable or of the wrong type
+	resp, err = client.Call(ctx, msg("create", map[string]interface{}{"Id": 5.0, "Count": 3.0, "Title": 3.0}))
+	errs := resp.FieldErrors()
+	if err != nil || resp.Action != "CREATE_FAIL" || len(errs) != 3 || errs["Id"].Code != pure.CodeForbidden || errs["Count"].Code != pure.CodeForbidden || errs["Title"].Code != pure.CodeInvalid {
+		t.Error("Wrong fields accepted", resp, err)
+	}
+
+	// Relations are given by id
+	store.Save(&Feed{Title: "Owned", Owner: &FeedOwner{Id: 9, Name: "tata"}})
+
+	for _, test := range []struct {
+		name   string
+		msg    pure.PureMsg
+		action string
+		code   string
+		title  interface{}
+	}{
+		{"Retrieve", msg("retrieve", map[string]interface{}{"id": 1.0}), "RETRIEVED", "", "Go"},
+		{"Unknown", msg("retrieve", map[string]interface{}{"id": 7.0}), "RETRIEVE_FAIL", pure.CodeNotFound, nil},
+		{"Bad id", msg("retrieve", map[string]interface{}{"id": "one"}), "RETRIEVE_FAIL", pure.CodeInvalid, nil},
+		{"Update", msg("update", map[string]interface{}{"id": 1.0, "Title": "Golang"}), "UPDATED", "", "Golang"},
+		{"Bad update", msg("update", map[string]interface{}{"id": 1.0, "Title": "Gopher", "Url": 5.0}), "UPDATE_FAIL", pure.CodeInvalid, nil},
+		{"Unchanged", msg("retrieve", map[string]interface{}{"id": 1.0}), "RETRIEVED", "", "Golang"},
+	} {
+		resp, err := client.Call(ctx, test.msg)
+		if err != nil || resp.Action != test.action || resp.ErrorCode() != test.code || resp.ResponseMap["Title"] != test.title {
+			t.Error(test.name, "Wrong response", resp, err)
+		}
+	}
+
+	if push := waitPush(t, watcher, pure.PushAction); push.Event != "update" || push.ResponseMap["Title"] != "Golang" {
+		t.Error("Wrong update push", push)
+	}
+
+	resp, err = client.Call(ctx, msg("retrieve", map[string]interface{}{"id": 2.0}))
+	if err != nil || resp.ResponseMap["Owner"] != 9 || resp.ResponseMap["Count"] != 0 {
+		t.Error("Wrong relation", resp, err)
+	}
+
+	resp, err = client.Call(ctx, msg("delete", map[string]interface{}{"id": 1.0}))
+	if err != nil || resp.Action != "DELETED" || store.objects[1] != nil {
+		t.Error("Delete failed", resp, err)
+	}
+
+	if push := waitPush(t, watcher, pure.PushAction); push.Event != "delete" || push.ResponseMap["id"] != 1 {
+		t.Error("Wrong delete push", push)
+	}
+
+	resp, err = client.Call(ctx, msg("flush", nil))
+	if err != nil || resp.Action != "FLUSHED" || resp.ResponseMap["flushed"] != int64(1) || len(store.objects) != 0 {
+		t.Error("Flush failed", resp, err)
+	}
+}
+
+func TestCRUDTransactions(t *testing.T) {
+
+	store := &memStore{objects: make(map[int]*Feed)}
+	store.Save(&Feed{Title: "Go"})
+
+	mux := pure.NewPureMux()
+	mux.RegisterHandler("feed", pure.NewCRUDHandler(mux, store, &Feed{}, "Title", "Url"))
+	mux.RegisterHandler("plain", pure.NewCRUDHandler(mux, &plainStore{store}, &Feed{}, "Title"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := pure.NewLocalClient(mux)
+	defer client.Close()
+	watcher := pure.NewLocalClient(mux)
+	defer watcher.Close()
+
+	if resp, err := watcher.Call(ctx, pure.PureMsg{DataType: "feed", Action: "subscribe"}); err != nil || resp.Action != "SUBSCRIBED" {
+		t.Fatal("Subscription failed", resp, err)
+	}
+
+	msg := func(dataType string, action string, values map[string]interface{}) pure.PureMsg {
+		return pure.PureMsg{DataType: dataType, Action: action, RequestMap: values}
+	}
+
+	// Transactions of the clients
+	resp, err := client.Call(ctx, pure.PureMsg{Action: pure.BeginAction})
+	id := resp.TransactionMap[pure.TransactionKey]
+	if err != nil || resp.Action != "BEGUN" {
+		t.Fatal("Begin failed", resp, err)
+	}
+
+	if resp, err := client.Call(ctx, inTx(msg("feed", "create", map[string]interface{}{"Title": "Rust"}), id)); err != nil || resp.Action != "CREATED" || resp.ResponseMap["Id"] != 2 {
+		t.Error("Create in transaction failed", resp, err)
+	}
+
+	if resp, err := client.Call(ctx, inTx(msg("feed", "update", map[string]interface{}{"id": 1.0, "Title": "Golang"}), id)); err != nil || resp.Action != "UPDATED" {
+		t.Error("Update in transaction failed", resp, err)
+	}
+
+	if resp, err := client.Call(ctx, inTx(msg("feed", "retrieve", map[string]interface{}{"id": 2.0}), id)); err != nil || resp.Action != "RETRIEVED" {
+		t.Error("Transaction does not see its changes", resp, err)
+	}
+
+	if len(store.objects) != 1 || store.objects[1].Title != "Go" {
+		t.Error("Changes applied before the commit", store.objects)
+	}
+
+	if resp, err := client.Call(ctx, inTx(pure.PureMsg{Action: pure.CommitAction}, id)); err != nil || resp.Action != "COMMITTED" {
+		t.Error("Commit failed", resp, err)
+	}
+
+	if len(store.objects) != 2 || store.objects[1].Title != "Golang" || store.objects[2].Title != "Rust" {
+		t.Error("Changes not committed", store.objects)
+	}
+
+	// Changes are pushed once committed
+	for _, event := range []string{"create", "update"} {
+		if push := waitPush(t, watcher, pure.PushAction); push.Event != event {
+			t.Error("Wrong push after the commit", event, push)
+		}
+	}
+
+	// Rolled back changes are not pushed
+	resp, _ = client.Call(ctx, pure.PureMsg{Action: pure.BeginAction})
+	id = resp.TransactionMap[pure.TransactionKey]
+
+	if resp, err := client.Call(ctx, inTx(msg("feed", "update", map[string]interface{}{"id": 1.0, "Title": "Rolled back"}), id)); err != nil || resp.Action != "UPDATED" {
+		t.Error("Update in transaction failed", resp, err)
+	}
+
+	if resp, err := client.Call(ctx, inTx(pure.PureMsg{Action: pure.RollbackAction}, id)); err != nil || resp.Action != "ROLLED_BACK" {
+		t.Error("Rollback failed", resp, err)
+	}
+
+	client.Call(ctx, msg("feed", "update", map[string]interface{}{"id": 1.0, "Title": "Golang"}))
+	if push := waitPush(t, watcher, pure.PushAction); push.ResponseMap["Title"] != "Golang" {
+		t.Error("Rolled back change pushed", push)
+	}
+
+	// Atomic batches
+	batch := pure.PureMsg{Action: "batch", RequestMap: map[string]interface{}{"atomic": true}, Batch: []pure.PureMsg{
+		msg("feed", "delete", map[string]interface{}{"id": 2.0}),
+		msg("feed", "update", map[string]interface{}{"id": 7.0, "Title": "Nope"}),
+	}}
+
+	if resp, err := client.Call(ctx, batch); err != nil || resp.Action != "BATCH_FAIL" || store.objects[2] == nil {
+		t.Error("Failed atomic batch applied", resp, err)
+	}
+
+	client.Call(ctx, msg("feed", "update", map[string]interface{}{"id": 1.0, "Title": "Golang"}))
+	if push := waitPush(t, watcher, pure.PushAction); push.Event != "update" {
+		t.Error("Change of a failed atomic batch pushed", push)
+	}
+
+	batch.Batch[1] = msg("feed", "update", map[string]interface{}{"id": 1.0, "Title": "Go"})
+	if resp, err := client.Call(ctx, batch); err != nil || resp.Action != "BATCHED" || store.objects[2] != nil || store.objects[1].Title != "Go" {
+		t.Error("Atomic batch not applied", resp, err)
+	}
+
+	// Stores without transactions
+	batch.Batch = []pure.PureMsg{msg("plain", "retrieve", map[string]interface{}{"id": 1.0})}
+	if resp, err := client.Call(ctx, batch); err != nil || len(resp.Batch) != 1 || resp.Batch[0].ErrorCode() != pure.CodeNoTransaction {
+		t.Error("Transaction on a store without them", resp, err)
+	}
+}
+
+// Store hiding the transactions of another one
+type plainStore struct {
+	pure.Store
+}
+
+// Store whose updates wait for the rows of the transactions, like MySQL
+type lockingStore struct {
+	*memStore
+	waiting chan struct{} // Closed when an update waits
+	locked  chan struct{} // Closed when the transaction is applied
+}
+
+func (s *lockingStore) Update(obj interface{}) error {
+	close(s.waiting)
+	<-s.locked
+	return s.memStore.Update(obj)
+}
+
+func (s *lockingStore) Begin() (pure.StoreTx, error) {
+	tx, err := s.memStore.Begin()
+	return &lockingTx{tx.(*memStoreTx), s.locked}, err
+}
+
+type lockingTx struct {
+	*memStoreTx
+	locked chan struct{}
+}
+
+func (t *lockingTx) Apply() error {
+	close(t.locked)
+	return nil
+}
+
+func (t *lockingTx) Merge() {
+	t.memStoreTx.Commit()
+}
+
+func TestCRUDCommitLock(t *testing.T) {
+
+	store := &lockingStore{&memStore{objects: make(map[int]*Feed)}, make(chan struct{}), make(chan struct{})}
+	store.Save(&Feed{Title: "Go"})
+
+	mux := pure.NewPureMux()
+	mux.RegisterHandler("feed", pure.NewCRUDHandler(mux, store, &Feed{}, "Title"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	client := pure.NewLocalClient(mux)
+	defer client.Close()
+	other := pure.NewLocalClient(mux)
+	defer other.Close()
+
+	resp, _ := client.Call(ctx, pure.PureMsg{Action: pure.BeginAction})
+	id := resp.TransactionMap[pure.TransactionKey]
+
+	if resp, err := client.Call(ctx, inTx(pure.PureMsg{DataType: "feed", Action: "create", RequestMap: map[string]interface{}{"Title": "Rust"}}, id)); err != nil || resp.Action != "CREATED" {
+		t.Fatal("Create in transaction failed", resp, err)
+	}
+
+	// An update outside the transaction waits for its commit
+	updated := make(chan pure.PureMsg)
+	go func() {
+		resp, _ := other.Call(ctx, pure.PureMsg{DataType: "feed", Action: "update", RequestMap: map[string]interface{}{"id": 1.0, "Title": "Golang"}})
+		updated <- resp
+	}()
+	<-store.waiting
+
+	if resp, err := client.Call(ctx, inTx(pure.PureMsg{Action: pure.CommitAction}, id)); err != nil || resp.Action != "COMMITTED" {
+		t.Fatal("Commit blocked by the update", resp, err)
+	}
+
+	if resp := <-updated; resp.Action != "UPDATED" {
+		t.Error("Update failed", resp)
+	}
+
+	if len(store.objects) != 2 {
+		t.Error("Transaction not merged", store.objects)
+	}
+}
+
+func feedField(feed *Feed, field string) interface{} {
+	return reflect.ValueOf(feed).Elem().FieldByName(field).Interface()
+}
+
+// -1, 0 or 1 like strings.Compare, numbers are compared as numbers
+func compareValues(a interface{}, b interface{}) int {
+
+	number := func(v interface{}) (float64, bool) {
+		switch n := v.(type) {
+		case int:
+			return float64(n), true
+		case int64:
+			return float64(n), true
+		case float64:
+			return n, true
+		}
+		return 0, false
+	}
+
+	x, okA := number(a)
+	y, okB := number(b)
+	if !okA || !okB {
+		return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+	}
+
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+func (s *memStore) Find(q pure.Page, dst interface{}) error {
+
+	order := append(append([]pure.SortField{}, q.Sort...), pure.SortField{Field: "Id"})
+
+	// Compare a feed to the values of the order fields
+	compare := func(feed *Feed, values func(idx int, field string) interface{}) int {
+		for idx, o := range order {
+			c := compareValues(feedField(feed, o.Field), values(idx, o.Field))
+			if o.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	}
+
+	feeds := []*Feed{}
+
+	for _, feed := range s.objects {
+		match := true
+		for _, cond := range q.Filters {
+			c := compareValues(feedField(feed, cond.Field), cond.Value)
+			switch cond.Op {
+			case "=":
+				match = match && c == 0
+			case "!=":
+				match = match && c != 0
+			case "<":
+				match = match && c < 0
+			case "<=":
+				match = match && c <= 0
+			case ">":
+				match = match && c > 0
+			case ">=":
+				match = match && c >= 0
+			case "in":
+				found := false
+				for _, value := range cond.Value.([]interface{}) {
+					found = found || compareValues(feedField(feed, cond.Field), value) == 0
+				}
+				match = match && found
+			}
+		}
+
+		if len(q.After) > 0 && compare(feed, func(idx int, field string) interface{} { return q.After[idx] }) <= 0 {
+			match = false
+		}
+
+		if match {
+			feeds = append(feeds, feed)
+		}
+	}
+
+	sort.Slice(feeds, func(i int, j int) bool {
+		return compare(feeds[i], func(idx int, field string) interface{} { return feedField(feeds[j], field) }) < 0
+	})
+
+	if q.Limit > 0 && len(feeds) > q.Limit {
+		feeds = feeds[:q.Limit]
+	}
+
+	*dst.(*[]*Feed) = feeds
+
+	return nil
+}
+
+func TestQuery(t *testing.T) {
+
+	store := &memStore{objects: make(map[int]*Feed)}
+
+	mux := pure.NewPureMux()
+	mux.RegisterHandler("feed", pure.NewCRUDHandler(mux, store, &Feed{}, "Title", "Url"))
+
+	for idx, count := range []int{3, 1, 5, 3, 0, 4} {
+		store.Save(&Feed{Title: fmt.Sprint("Feed ", idx+1), Count: count})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := pure.NewLocalClient(mux)
+	defer client.Close()
+
+	list := func(query map[string]interface{}) pure.PureMsg {
+		resp, err := client.Call(ctx, pure.PureMsg{DataType: "feed", Action: "retrieve", RequestMap: map[string]interface{}{pure.QueryKey: query}})
+		if err != nil {
+			t.Fatal("Query failed", err)
+		}
+		return resp
+	}
+
+	ids := func(resp pure.PureMsg) []interface{} {
+		ids := []interface{}{}
+		items, _ := resp.ResponseMap["items"].([]interface{})
+		for _, item := range items {
+			ids = append(ids, item.(map[string]interface{})["Id"])
+		}
+		return ids
+	}
+
+	// Pages of the feeds with a count, biggest first then by id
+	query := map[string]interface{}{
+		"filter": map[string]interface{}{"Count": map[string]interface{}{">=": 1.0}},
+		"sort":   []interface{}{"-Count"},
+		"limit":  2.0,
+		"fields": []interface{}{"Title"},
+	}
+
+	pages := [][]interface{}{}
+	for {
+		resp := list(query)
+		if resp.Action != "RETRIEVED" {
+			t.Fatal("Wrong query response", resp)
+		}
+		pages = append(pages, ids(resp))
+
+		cursor, ok := resp.ResponseMap["cursor"].(string)
+		if !ok || len(pages) > 5 {
+			break
+		}
+		query["cursor"] = cursor
+	}
+
+	if !reflect.DeepEqual(pages, [][]interface{}{{3, 6}, {1, 4}, {2}}) {
+		t.Error("Wrong pages", pages)
+	}
+
+	// Only the fields asked for, and the id
+	resp := list(map[string]interface{}{"filter": map[string]interface{}{"Title": "Feed 2"}, "fields": []interface{}{"Count"}})
+	if items := resp.ResponseMap["items"].([]interface{}); len(items) != 1 || !reflect.DeepEqual(items[0], map[string]interface{}{"Id": 2, "Count": 1}) {
+		t.Error("Wrong projection", resp)
+	}
+
+	resp = list(map[string]interface{}{"filter": map[string]interface{}{"Count": map[string]interface{}{"in": []interface{}{0.0, 5.0}}}})
+	if got := ids(resp); !reflect.DeepEqual(got, []interface{}{3, 5}) || resp.ResponseMap["cursor"] != nil {
+		t.Error("Wrong in filter", got)
+	}
+
+	// Cursor values keep their type
+	q := &pure.Query{Sort: []pure.SortField{{Field: "Title"}, {Field: "Ratio"}}}
+	cursor := q.NextCursor(map[string]interface{}{"Title": "Go", "Ratio": 0.5, "Id": int64(1)<<62 + 1}, "Id")
+
+	parsed, errs := pure.ParseQuery(pure.PureMsg{RequestMap: map[string]interface{}{pure.QueryKey: map[string]interface{}{"sort": []interface{}{"Title", "Ratio"}, "cursor": cursor}}})
+	if len(errs) != 0 || !reflect.DeepEqual(parsed.Cursor, []interface{}{"Go", 0.5, int64(1)<<62 + 1}) {
+		t.Error("Cursor values changed", parsed, errs)
+	}
+
+	for _, test := range []struct {
+		name  string
+		query interface{}
+		field string
+	}{
+		{"Not an object", "all", "query"},
+		{"Operator", map[string]interface{}{"filter": map[string]interface{}{"Count": map[string]interface{}{"~": 1.0}}}, "query.filter.Count"},
+		{"In without list", map[string]interface{}{"filter": map[string]interface{}{"Count": map[string]interface{}{"in": 1.0}}}, "query.filter.Count"},
+		{"Limit", map[string]interface{}{"limit": 1000.0}, "query.limit"},
+		{"Cursor", map[string]interface{}{"cursor": "nope"}, "query.cursor"},
+		{"Sort", map[string]interface{}{"sort": "Count"}, "query.sort"},
+		{"Unknown field", map[string]interface{}{"sort": []interface{}{"Nope"}}, "query"},
+	} {
+		resp, err := client.Call(ctx, pure.PureMsg{DataType: "feed", Action: "retrieve", RequestMap: map[string]interface{}{pure.QueryKey: test.query}})
+		if err != nil || resp.Action != "RETRIEVE_FAIL" || resp.FieldErrors()[test.field].Code != pure.CodeInvalid {
+			t.Error(test.name, "Bad query accepted", resp, err)
+		}
+	}
+}
+
+func TestVersions(t *testing.T) {
+
+	mux := pure.NewPureMux()
+	mux.SetVersions(1, 2)
+	mux.RegisterHandler("data", NewPureHandler())
+	mux.RegisterVersionHandler("data", 2, EchoHandler{NewPureHandler()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	retrieve := pure.PureMsg{DataType: "data", Action: "retrieve", RequestMap: map[string]interface{}{"id": "x"}}
+
+	// Clients without handshake speak the first version
+	old := pure.NewLocalClient(mux)
+	defer old.Close()
+
+	if resp, err := old.Call(ctx, retrieve); err != nil || resp.Action != "RETRIEVE_FAIL" || resp.Version != 0 {
+		t.Error("Wrong version 1 response", resp, err)
+	}
+
+	client := pure.NewLocalClient(mux)
+	defer client.Close()
+
+	version, capabilities, err := client.Hello(ctx, []int{2, 3}, nil)
+	if err != nil || version != 2 || !reflect.DeepEqual(capabilities, []string{pure.CapabilityBatch, pure.CapabilityPush, pure.CapabilityStream, pure.CapabilityTransactions}) {
+		t.Error("Wrong hello", version, capabilities, err)
+	}
+
+	if resp, err := client.Call(ctx, retrieve); err != nil || resp.Action != "RETRIEVED" || resp.ResponseMap["id"] != "x" || resp.Version != 2 {
+		t.Error("Wrong version 2 response", resp, err)
+	}
+
+	// Versions side by side
+	old.Hello(ctx, []int{1}, nil)
+	if resp, err := old.Call(ctx, retrieve); err != nil || resp.Action != "RETRIEVE_FAIL" {
+		t.Error("Version 1 handler not used", resp, err)
+	}
+
+	retrieve.Version = 1
+	if resp, err := client.Call(ctx, retrieve); err != nil || resp.Action != "RETRIEVE_FAIL" || resp.Version != 0 {
+		t.Error("Version of the message not used", resp, err)
+	}
+
+	retrieve.Version = 3
+	if resp, err := client.Call(ctx, retrieve); err != nil || resp.Action != pure.ProtocolErrorAction || resp.ErrorCode() != pure.CodeUnsupportedVersion {
+		t.Error("Unsupported version accepted", resp, err)
+	}
+
+	if _, capabilities, err := client.Hello(ctx, []int{2}, []string{pure.CapabilityPush, "telepathy"}); err != nil || !reflect.DeepEqual(capabilities, []string{pure.CapabilityPush}) {
+		t.Error("Wrong capabilities", capabilities, err)
+	}
+
+	resp, err := client.Call(ctx, pure.PureMsg{Action: pure.HelloAction, RequestMap: map[string]interface{}{"versions": []interface{}{5.0}}})
+	if err != nil || resp.Action != "HELLO_FAIL" || resp.ErrorCode() != pure.CodeUnsupportedVersion || !reflect.DeepEqual(resp.ResponseMap["versions"], []int{1, 2}) {
+		t.Error("Wrong unsupported hello", resp, err)
+	}
+
+	// The hello goes through the authorization like other requests
+	guarded := pure.NewPureMux()
+	guarded.SetVersions(1, 2)
+	guarded.RegisterHandler("data", NewPureHandler())
+	guarded.RegisterVersionHandler("data", 2, EchoHandler{NewPureHandler()})
+	guarded.Use(pure.Authorize(pure.RolePolicy{"reader": {"*": {"retrieve"}}}))
+
+	anonymous := pure.NewLocalClient(guarded)
+	defer anonymous.Close()
+
+	retrieve.Version = 0
+	resp, err = anonymous.Call(ctx, pure.PureMsg{Action: pure.HelloAction, RequestMap: map[string]interface{}{"versions": []interface{}{2.0}}})
+	if err != nil || resp.Action != "HELLO_FAIL" || resp.ErrorCode() != pure.CodeForbidden {
+		t.Error("Anonymous hello accepted", resp, err)
+	}
+
+	if resp, err := anonymous.Call(ctx, retrieve); err != nil || resp.ErrorCode() != pure.CodeForbidden || resp.Version != 0 {
+		t.Error("Version negotiated by a refused hello", resp, err)
+	}
+
+	reader := pure.NewAuthLocalClient(guarded, &pure.Identity{Name: "tata", Roles: []string{"reader"}})
+	defer reader.Close()
+
+	if version, _, err := reader.Hello(ctx, []int{2}, nil); err != nil || version != 2 {
+		t.Error("Authenticated hello refused", version, err)
+	}
+
+	if resp, err := reader.Call(ctx, retrieve); err != nil || resp.Action != "RETRIEVED" || resp.Version != 2 {
+		t.Error("Wrong authenticated version 2 response", resp, err)
+	}
+
+	// The transports add their capabilities
+	server := httptest.NewServer(pure.NewWebsocketHandler(mux, pure.DefaultWebsocketOptions()))
+	defer server.Close()
+
+	ws, err := pure.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal("Dial failed", err)
+	}
+	defer ws.Close()
+
+	if version, capabilities, err := ws.Hello(ctx, []int{1, 2}, []string{pure.CapabilityCompression}); err != nil || version != 2 || !reflect.DeepEqual(capabilities, []string{pure.CapabilityCompression}) {
+		t.Error("Wrong websocket hello", version, capabilities, err)
+	}
+}
+
+var update = flag.Bool("update", false, "Write the golden files of testdata")
+
+// Connection keeping what it is sent
+type recorder struct {
+	mux  *pure.PureMux
+	sent []pure.PureMsg
+}
+
+func (r *recorder) Send(msg pure.PureMsg) {
+	r.sent = append(r.sent, msg)
+}
+
+func (r *recorder) Handle(msg pure.PureMsg) {
+	r.mux.Handle(pure.PureReq{Msg: msg, Conn: r})
+}
+
+// Retrieve answers in two chunks
+type PagesHandler struct {
+	MyHandler
+}
+
+func (h PagesHandler) Retrieve(m pure.PureReq, rw pure.ResponseWriter) {
+	rww := rw.(*pure.PureResponseWriter)
+	rww.Chunk(map[string]interface{}{"page": 1})
+	rww.AddValue("page", 2)
+}
+
+// The messages exchanged are the ones of testdata/<name>.golden, the lines
+// starting with > are sent by the client and the ones with < by the server
+func TestWireFormat(t *testing.T) {
+
+	for _, test := range []struct {
+		name     string
+		requests []string
+	}{
+		{"crud", []string{
+			`{"Action":"create","DataType":"data","RequestMap":{"id":"a","value":"1"},"RequestId":"1"}`,
+			`{"Action":"retrieve","DataType":"data","RequestMap":{"id":"a"},"RequestId":"2"}`,
+			`{"Action":"update","DataType":"data","RequestMap":{"id":"a","value":"2"}}`,
+			`{"Action":"delete","DataType":"data","RequestMap":{"id":"a"}}`,
+			`{"Action":"flush","DataType":"data"}`,
+		}},
+		{"errors", []string{
+			`{"Action":"retrieve","DataType":"nope","RequestMap":{"id":"a"},"RequestId":"1"}`,
+			`{"Action":"destroy","DataType":"data","RequestMap":{"id":"a"}}`,
+			`{"Action":"create","DataType":"data","RequestMap":{"value":"1"}}`,
+			`{"Action":"retrieve","DataType":"data","RequestMap":{"id":"a"},"Version":3}`,
+		}},
+		{"batch", []string{
+			`{"Action":"batch","Batch":[{"Action":"create","DataType":"data","RequestMap":{"id":"a","value":"1"}},{"Action":"retrieve","DataType":"data","RequestMap":{"id":"b"}}],"RequestId":"1"}`,
+		}},
+		{"push", []string{
+			`{"Action":"subscribe","DataType":"data","RequestMap":{"id":"a"}}`,
+			`{"Action":"create","DataType":"data","RequestMap":{"id":"a","value":"1"}}`,
+		}},
+		{"stream", []string{
+			`{"Action":"retrieve","DataType":"pages","RequestMap":{},"RequestId":"1"}`,
+		}},
+		{"hello", []string{
+			`{"Action":"hello","RequestMap":{"versions":[1,2],"capabilities":["push"]}}`,
+			`{"Action":"create","DataType":"data","RequestMap":{"id":"a","value":"1"}}`,
+			`{"Action":"hello","RequestMap":{"versions":[7]}}`,
+		}},
+		{"transaction", []string{
+			`{"Action":"begin","RequestId":"1"}`,
+			`{"Action":"create","DataType":"tx","RequestMap":{"id":"a","value":"1"},"TransactionMap":{"transaction":"1"}}`,
+			`{"Action":"commit","TransactionMap":{"transaction":"1"}}`,
+		}},
+	} {
+		mux := pure.NewPureMux()
+		mux.SetVersions(1, 2)
+		mux.RegisterHandler("data", NewPushHandler(mux))
+		mux.RegisterHandler("pages", PagesHandler{NewPureHandler()})
+		mux.RegisterHandler("tx", &TxHandler{MyHandler: NewPureHandler()})
+
+		conn := &recorder{mux: mux}
+		transcript := ""
+
+		for _, request := range test.requests {
+			msg := pure.PureMsg{}
+			if err := pure.JSON.Unmarshal([]byte(request), &msg); err != nil {
+				t.Fatal(test.name, "Bad request", request, err)
+			}
+			transcript += "> " + request + "\n"
+
+			conn.sent = nil
+			conn.Handle(msg)
+
+			for _, resp := range conn.sent {
+				data, err := pure.JSON.Marshal(resp)
+				if err != nil {
+					t.Fatal(test.name, "Error marshalling", resp, err)
+				}
+				transcript += "< " + string(data) + "\n"
+			}
+		}
+
+		golden := filepath.Join("testdata", test.name+".golden")
+
+		if *update {
+			if err := ioutil.WriteFile(golden, []byte(transcript), 0644); err != nil {
+				t.Fatal(test.name, "Error writing", golden, err)
+			}
+			continue
+		}
+
+		expected, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(test.name, "Error reading", golden, err)
+		}
+
+		if string(expected) != transcript {
+			t.Errorf("%v: wire format changed, run go test -update if on purpose\n--- %v\n%v--- got\n%v", test.name, golden, string(expected), transcript)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package pure
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Action of the messages sent to subscribers, Event holds the action of the
+// change ("create", "update", "delete"...)
+const PushAction = "PUSH"
+
+// A connection watching the changes of a DataType.
+// Only the changes whose data hold the same values as the filter are sent.
+type subscription struct {
+	id       string
+	dataType string
+	filter   map[string]interface{}
+	conn     PureConnection
+}
+
+type subscriptions struct {
+	sync.Mutex
+	counter uint64
+	topics  map[string]map[string]*subscription // DataType -> id -> subscription
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{topics: make(map[string]map[string]*subscription)}
+}
+
+// The RequestMap of a subscribe request is the filter, the id of the
+// subscription is returned in ResponseMap["subscription"]
+func (p *PureMux) subscribe(m PureReq, rw *PureResponseWriter) {
+
+	filter := make(map[string]interface{})
+	for key, value := range m.Msg.RequestMap {
+		filter[key] = value
+	}
+
+	p.subs.Lock()
+	defer p.subs.Unlock()
+
+	p.subs.counter++
+	sub := &subscription{
+		id:       fmt.Sprintf("%v-%d", m.Msg.DataType, p.subs.counter),
+		dataType: m.Msg.DataType,
+		filter:   filter,
+		conn:     m.Conn,
+	}
+
+	if p.subs.topics[sub.dataType] == nil {
+		p.subs.topics[sub.dataType] = make(map[string]*subscription)
+	}
+	p.subs.topics[sub.dataType][sub.id] = sub
+
+	rw.AddValue("subscription", sub.id)
+}
+
+// A connection can only cancel its own subscriptions
+func (p *PureMux) unsubscribe(m PureReq, rw *PureResponseWriter) {
+
+	id, ok := m.Msg.RequestMap["subscription"].(string)
+	if !ok {
+		rw.FieldError("subscription", CodeInvalid, "subscription must be a string")
+		return
+	}
+
+	p.subs.Lock()
+	defer p.subs.Unlock()
+
+	sub, ok := p.subs.topics[m.Msg.DataType][id]
+	if !ok || sub.conn != m.Conn {
+		rw.FailWith(CodeNotFound, "Unknown subscription")
+		return
+	}
+
+	delete(p.subs.topics[m.Msg.DataType], id)
+}
+
+// Send a change to the connections subscribed to dataType, at most once per
+// connection
+func (p *PureMux) Publish(dataType string, event string, data map[string]interface{}) {
+
+	msg := PureMsg{Action: PushAction, DataType: dataType, Event: event, ResponseMap: data}
+
+	p.subs.Lock()
+
+	conns := []PureConnection{}
+	seen := make(map[PureConnection]bool)
+
+	for _, sub := range p.subs.topics[dataType] {
+		if !seen[sub.conn] && matches(sub.filter, data) {
+			seen[sub.conn] = true
+			conns = append(conns, sub.conn)
+		}
+	}
+
+	p.subs.Unlock()
+
+	for _, conn := range conns {
+		conn.Send(msg)
+	}
+}
+
+// Remove the subscriptions of a connection
+func (s *subscriptions) drop(conn PureConnection) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	for _, topic := range s.topics {
+		for id, sub := range topic {
+			if sub.conn == conn {
+				delete(topic, id)
+			}
+		}
+	}
+}
+
+func matches(filter map[string]interface{}, data map[string]interface{}) bool {
+
+	for key, expected := range filter {
+		value, ok := data[key]
+		if !ok || !equal(expected, value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Numbers are compared by value whatever their type, JSON only has float64
+func equal(a interface{}, b interface{}) bool {
+
+	fa, okA := toFloat(a)
+	fb, okB := toFloat(b)
+
+	if okA && okB {
+		return fa == fb
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+
+	value := reflect.ValueOf(v)
+
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), true
+	}
+
+	return 0, false
+}
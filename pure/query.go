@@ -0,0 +1,253 @@
+package pure
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// A retrieve request with RequestMap["query"] lists objects instead of
+// getting one by id:
+//
+//	"query": {
+//		"filter": {"Feed": 3, "Read": false, "Date": {">=": 1400000000}},
+//		"sort":   ["-Date", "Title"],
+//		"limit":  50,
+//		"cursor": "...",
+//		"fields": ["Title", "Date"]
+//	}
+//
+// A filter value is either the value the field must have, or an object of
+// conditions with the operators =, !=, <, <=, >, >= and in (a list).
+// Sort fields starting with "-" are in descending order, the objects are
+// then sorted by id.
+// The objects are in ResponseMap["items"], ResponseMap["cursor"] is set when
+// there are more: the next page is asked with the same query and this cursor.
+// Without fields every field is sent, the id always is.
+const QueryKey = "query"
+
+const (
+	DefaultQueryLimit = 50
+	MaxQueryLimit     = 500
+)
+
+type Filter struct {
+	Field string
+	Op    string
+	Value interface{}
+}
+
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+type Query struct {
+	Filters []Filter
+	Sort    []SortField
+	Limit   int
+	Cursor  []interface{} // Sort values then id of the last object sent
+	Fields  []string
+}
+
+// Objects asked to a Finder: the ones matching every filter, in the order of
+// Sort then of their id, after the object whose values are After
+type Page struct {
+	Filters []Filter
+	Sort    []SortField
+	After   []interface{} // Sort values then id, none for the first page
+	Limit   int           // No limit if 0
+}
+
+var queryOperators = map[string]bool{"=": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true, "in": true}
+
+// Query of a request, nil if it has none. The errors are INVALID field
+// errors on "query.filter", "query.sort"...
+func ParseQuery(msg PureMsg) (*Query, []LogMessage) {
+
+	raw, ok := msg.RequestMap[QueryKey]
+	if !ok {
+		return nil, nil
+	}
+
+	errs := []LogMessage{}
+	fail := func(field string, format string, args ...interface{}) {
+		errs = append(errs, LogMessage{Level: Error, Code: CodeInvalid, Field: QueryKey + "." + field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	payload, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, []LogMessage{{Level: Error, Code: CodeInvalid, Field: QueryKey, Message: "query must be an object"}}
+	}
+
+	q := &Query{Limit: DefaultQueryLimit}
+
+	if filter, ok := payload["filter"].(map[string]interface{}); ok {
+		// Stable order for the clients and the SQL
+		fields := make([]string, 0, len(filter))
+		for field := range filter {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+
+		for _, field := range fields {
+			conditions, ok := filter[field].(map[string]interface{})
+			if !ok {
+				q.Filters = append(q.Filters, Filter{field, "=", filter[field]})
+				continue
+			}
+
+			ops := make([]string, 0, len(conditions))
+			for op := range conditions {
+				ops = append(ops, op)
+			}
+			sort.Strings(ops)
+
+			for _, op := range ops {
+				value := conditions[op]
+				if !queryOperators[op] {
+					fail("filter."+field, "Unknown operator %v", op)
+					continue
+				}
+				if _, list := value.([]interface{}); list != (op == "in") {
+					fail("filter."+field, "Only in takes a list")
+					continue
+				}
+				q.Filters = append(q.Filters, Filter{field, op, value})
+			}
+		}
+	} else if payload["filter"] != nil {
+		fail("filter", "filter must be an object")
+	}
+
+	if fields, ok := payload["sort"].([]interface{}); ok {
+		for _, f := range fields {
+			name, ok := f.(string)
+			if !ok || strings.TrimPrefix(name, "-") == "" {
+				fail("sort", "sort must be a list of fields")
+				continue
+			}
+			q.Sort = append(q.Sort, SortField{Field: strings.TrimPrefix(name, "-"), Desc: strings.HasPrefix(name, "-")})
+		}
+	} else if payload["sort"] != nil {
+		fail("sort", "sort must be a list of fields")
+	}
+
+	if limit, ok := payload["limit"]; ok {
+		n, ok := toFloat(limit)
+		if !ok || n != math.Trunc(n) || n < 1 || n > MaxQueryLimit {
+			fail("limit", "limit must be an integer from 1 to %v", MaxQueryLimit)
+		} else {
+			q.Limit = int(n)
+		}
+	}
+
+	if cursor, ok := payload["cursor"].(string); ok && cursor != "" {
+		values, err := decodeCursor(cursor)
+		if err != nil || len(values) != len(q.Sort)+1 {
+			fail("cursor", "Invalid cursor")
+		}
+		q.Cursor = values
+	} else if payload["cursor"] != nil && payload["cursor"] != "" {
+		fail("cursor", "cursor must be a string")
+	}
+
+	if fields, ok := payload["fields"].([]interface{}); ok {
+		for _, f := range fields {
+			name, ok := f.(string)
+			if !ok {
+				fail("fields", "fields must be a list of fields")
+				continue
+			}
+			q.Fields = append(q.Fields, name)
+		}
+	} else if payload["fields"] != nil {
+		fail("fields", "fields must be a list of fields")
+	}
+
+	return q, errs
+}
+
+// Fields used by the query, to check them against the ones of the objects
+func (q *Query) UsedFields() []string {
+
+	fields := []string{}
+	for _, f := range q.Filters {
+		fields = append(fields, f.Field)
+	}
+	for _, s := range q.Sort {
+		fields = append(fields, s.Field)
+	}
+
+	return append(fields, q.Fields...)
+}
+
+// Page asked to the Finder, one more object than the limit is asked to know
+// if there are more
+func (q *Query) Page() Page {
+	return Page{Filters: q.Filters, Sort: q.Sort, After: q.Cursor, Limit: q.Limit + 1}
+}
+
+// Cursor of the page after the object whose fields are data
+func (q *Query) NextCursor(data map[string]interface{}, id string) string {
+
+	values := make([]interface{}, 0, len(q.Sort)+1)
+	for _, s := range q.Sort {
+		values = append(values, data[s.Field])
+	}
+	values = append(values, data[id])
+
+	raw, _ := json.Marshal(values)
+
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// Only the fields asked for, and the id
+func (q *Query) Project(data map[string]interface{}, id string) map[string]interface{} {
+
+	if len(q.Fields) == 0 {
+		return data
+	}
+
+	projected := map[string]interface{}{id: data[id]}
+	for _, field := range q.Fields {
+		projected[field] = data[field]
+	}
+
+	return projected
+}
+
+func decodeCursor(cursor string) ([]interface{}, error) {
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	// Numbers keep their type, large ids do not fit in a float64
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	values := []interface{}{}
+	if err := decoder.Decode(&values); err != nil {
+		return nil, err
+	}
+
+	for idx, value := range values {
+		number, ok := value.(json.Number)
+		if !ok {
+			continue
+		}
+		if n, err := number.Int64(); err == nil {
+			values[idx] = n
+		} else if values[idx], err = number.Float64(); err != nil {
+			return nil, err
+		}
+	}
+
+	return values, nil
+}
@@ -0,0 +1,258 @@
+package pure
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Token bucket: Burst requests at once, then Requests every Per.
+// Without Requests or Per it is a quota of Burst requests never given back.
+// Burst must be at least 1.
+type Rate struct {
+	Requests float64
+	Per      time.Duration
+	Burst    int
+}
+
+// Limits by "DataType/action", where DataType and action can be "*".
+// The most specific rule applies: "data/create", then "data/*", "*/create"
+// and "*/*".
+type RateLimits struct {
+	PerConnection map[string]Rate
+	PerUser       map[string]Rate // Shared by the connections of a user, anonymous connections only have their own limits
+	InFlight      int             // Requests handled at the same time for a connection, no limit if 0
+}
+
+// Refuses the requests over the limits with a RATE_LIMITED error, the number
+// of seconds to wait is in ResponseMap["retry_after"]. It is left out when
+// waiting is of no use: a quota is used up or too many requests are in
+// progress.
+// The limits of a connection are forgotten when it goes away if the limiter
+// watches the mux:
+//
+//	limiter := pure.NewRateLimiter(limits)
+//	mux.Use(limiter.Middleware())
+//	mux.Watch(limiter)
+type RateLimiter struct {
+	limits   RateLimits
+	mu       sync.Mutex
+	buckets  map[bucketKey]*bucket
+	inFlight map[PureConnection]int
+	swept    time.Time
+}
+
+type bucketKey struct {
+	owner interface{} // PureConnection or user name
+	rule  string
+}
+
+// Wait of a used up quota
+const never = time.Duration(math.MaxInt64)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	rate   Rate
+}
+
+func NewRateLimiter(limits RateLimits) *RateLimiter {
+
+	for _, rates := range []map[string]Rate{limits.PerConnection, limits.PerUser} {
+		for rule, rate := range rates {
+			if rate.Burst < 1 {
+				panic("The rate of " + rule + " needs a Burst of at least 1")
+			}
+		}
+	}
+
+	return &RateLimiter{
+		limits:   limits,
+		buckets:  make(map[bucketKey]*bucket),
+		inFlight: make(map[PureConnection]int),
+		swept:    time.Now(),
+	}
+}
+
+func (l *RateLimiter) Middleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(m PureReq, rw *PureResponseWriter) {
+
+			if wait := l.take(m); wait > 0 {
+				rw.FailWith(CodeRateLimited, fmt.Sprintf("Too many %v requests on %v", m.Msg.Action, m.Msg.DataType))
+				if wait != never {
+					rw.AddValue("retry_after", math.Ceil(wait.Seconds()*1000)/1000)
+				}
+				return
+			}
+
+			if !l.enter(m.Conn) {
+				rw.FailWith(CodeRateLimited, "Too many requests in progress")
+				return
+			}
+			defer l.leave(m.Conn)
+
+			next(m, rw)
+		}
+	}
+}
+
+// Consume a token of every bucket of the request, or return the time to wait
+// for one
+func (l *RateLimiter) take(m PureReq) time.Duration {
+
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	buckets := []*bucket{}
+
+	if rule, rate, ok := matchRate(l.limits.PerConnection, m.Msg.DataType, m.Msg.Action); ok {
+		buckets = append(buckets, l.bucket(bucketKey{m.Conn, rule}, rate, now))
+	}
+
+	if m.Identity != nil {
+		if rule, rate, ok := matchRate(l.limits.PerUser, m.Msg.DataType, m.Msg.Action); ok {
+			buckets = append(buckets, l.bucket(bucketKey{m.Identity.Name, rule}, rate, now))
+		}
+	}
+
+	// Nothing is consumed when a bucket is empty
+	var wait time.Duration
+	for _, b := range buckets {
+		if w := b.wait(now); w > wait {
+			wait = w
+		}
+	}
+
+	if wait > 0 {
+		return wait
+	}
+
+	for _, b := range buckets {
+		b.tokens--
+	}
+
+	return 0
+}
+
+func (l *RateLimiter) bucket(key bucketKey, rate Rate, now time.Time) *bucket {
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(rate.Burst), last: now, rate: rate}
+		l.buckets[key] = b
+	}
+
+	b.refill(now)
+
+	return b
+}
+
+// Forget the full buckets once in a while, they are the same as new ones
+func (l *RateLimiter) sweep(now time.Time) {
+
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+
+	for key, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.rate.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Forget the buckets of a connection that went away
+func (l *RateLimiter) OnDisconnect(conn PureConnection) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key := range l.buckets {
+		if key.owner == conn {
+			delete(l.buckets, key)
+		}
+	}
+
+	delete(l.inFlight, conn)
+}
+
+func (l *RateLimiter) enter(conn PureConnection) bool {
+
+	if l.limits.InFlight <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inFlight[conn] >= l.limits.InFlight {
+		return false
+	}
+
+	l.inFlight[conn]++
+
+	return true
+}
+
+func (l *RateLimiter) leave(conn PureConnection) {
+
+	if l.limits.InFlight <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inFlight[conn]--; l.inFlight[conn] <= 0 {
+		delete(l.inFlight, conn)
+	}
+}
+
+func (b *bucket) refill(now time.Time) {
+
+	if b.rate.Per > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate.Requests / b.rate.Per.Seconds()
+	}
+
+	if max := float64(b.rate.Burst); b.tokens > max {
+		b.tokens = max
+	}
+
+	b.last = now
+}
+
+// Time before a token is available, never for a used up quota
+func (b *bucket) wait(now time.Time) time.Duration {
+
+	if b.tokens >= 1 {
+		return 0
+	}
+
+	if b.rate.Requests <= 0 || b.rate.Per <= 0 {
+		return never
+	}
+
+	missing := 1 - b.tokens
+
+	return time.Duration(missing * float64(b.rate.Per) / b.rate.Requests)
+}
+
+// Most specific rule of rates for the request
+func matchRate(rates map[string]Rate, dataType string, action string) (string, Rate, bool) {
+
+	for _, rule := range []string{dataType + "/" + action, dataType + "/*", "*/" + action, "*/*"} {
+		if rate, ok := rates[rule]; ok {
+			return rule, rate, true
+		}
+	}
+
+	return "", Rate{}, false
+}
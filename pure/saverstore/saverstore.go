@@ -0,0 +1,79 @@
+// Package saverstore keeps the objects of pure CRUD handlers in the MySQL
+// database of a saver.DbManager.
+package saverstore
+
+import (
+	"database/sql"
+	"github.com/th3osmith/greader/pure"
+	"github.com/th3osmith/greader/saver"
+)
+
+// pure.TransactionalStore and pure.Finder backed by a DbManager
+type Store struct {
+	*saver.DbManager
+}
+
+func New(db *saver.DbManager) *Store {
+	return &Store{db}
+}
+
+func (s *Store) Begin() (pure.StoreTx, error) {
+
+	tx, err := s.DbManager.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tx{tx}, nil
+}
+
+func (s *Store) Update(obj interface{}) error {
+	return notFound(s.DbManager.Update(obj))
+}
+
+func (s *Store) Find(p pure.Page, dst interface{}) error {
+	return s.DbManager.Find(query(p), dst)
+}
+
+// Operations of a Store in a transaction
+type Tx struct {
+	*saver.Tx
+}
+
+func (t *Tx) Update(obj interface{}) error {
+	return notFound(t.Tx.Update(obj))
+}
+
+func (t *Tx) Find(p pure.Page, dst interface{}) error {
+	return t.Tx.Find(query(p), dst)
+}
+
+func query(p pure.Page) saver.Query {
+
+	q := saver.Query{After: p.After, Limit: p.Limit}
+
+	for _, f := range p.Filters {
+		q.Where = append(q.Where, saver.Condition{Field: f.Field, Op: f.Op, Value: f.Value})
+	}
+
+	for _, s := range p.Sort {
+		q.Order = append(q.Order, saver.Order{Field: s.Field, Desc: s.Desc})
+	}
+
+	return q
+}
+
+// pure expects sql.ErrNoRows for the objects that do not exist
+func notFound(err error) error {
+	if err == saver.ErrNothingUpdated {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+var (
+	_ pure.TransactionalStore = (*Store)(nil)
+	_ pure.Finder             = (*Store)(nil)
+	_ pure.Finder             = (*Tx)(nil)
+	_ pure.MergingTx          = (*Tx)(nil)
+)
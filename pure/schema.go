@@ -0,0 +1,209 @@
+package pure
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+)
+
+type FieldType int
+
+const (
+	Any FieldType = iota
+	String
+	Number
+	Integer
+	Bool
+	Object
+	List
+)
+
+var fieldTypeNames = map[FieldType]string{
+	Any:     "any",
+	String:  "a string",
+	Number:  "a number",
+	Integer: "an integer",
+	Bool:    "a boolean",
+	Object:  "an object",
+	List:    "a list",
+}
+
+// Constraints on a value of the RequestMap.
+// Min and Max bound numbers, and the length of strings and lists.
+type Field struct {
+	Type     FieldType
+	Required bool
+	Min      *float64
+	Max      *float64
+	Enum     []interface{} // Allowed values
+	Pattern  string        // Regexp strings must match
+	pattern  *regexp.Regexp
+}
+
+// Bound for Field.Min and Field.Max
+func Limit(value float64) *float64 {
+	return &value
+}
+
+// Expected content of the RequestMap of a DataType/action
+type Schema struct {
+	Fields map[string]Field
+	Strict bool // Fields not in the schema are refused
+}
+
+// Requests not matching the schema fail with an INVALID error for each bad
+// field, before reaching the handler. The patterns are compiled once here,
+// the schema is not registered if one is invalid.
+func (p *PureMux) RegisterSchema(dataType string, action string, schema Schema) error {
+
+	fields := make(map[string]Field, len(schema.Fields))
+
+	for name, field := range schema.Fields {
+		if field.Pattern != "" {
+			pattern, err := regexp.Compile(field.Pattern)
+			if err != nil {
+				return fmt.Errorf("Invalid pattern of %v in %v/%v: %v", name, dataType, action, err)
+			}
+			field.pattern = pattern
+		}
+		fields[name] = field
+	}
+
+	schema.Fields = fields
+	p.schemas[dataType+"/"+action] = schema
+
+	return nil
+}
+
+// Errors of the fields of values, empty when valid. The patterns of schemas
+// not registered are compiled at each call, and panic when invalid.
+func (s Schema) Validate(values map[string]interface{}) []LogMessage {
+
+	errs := []LogMessage{}
+
+	fail := func(field string, format string, args ...interface{}) {
+		errs = append(errs, LogMessage{Level: Error, Code: CodeInvalid, Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	// Stable order for the clients
+	names := make([]string, 0, len(s.Fields))
+	for name := range s.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		field := s.Fields[name]
+
+		value, ok := values[name]
+		if !ok || value == nil {
+			if field.Required {
+				fail(name, "%v is required", name)
+			}
+			continue
+		}
+
+		if msg := field.check(name, value); msg != "" {
+			fail(name, "%v", msg)
+		}
+	}
+
+	if s.Strict {
+		unknown := []string{}
+		for name := range values {
+			if _, ok := s.Fields[name]; !ok {
+				unknown = append(unknown, name)
+			}
+		}
+		sort.Strings(unknown)
+
+		for _, name := range unknown {
+			fail(name, "Unknown field %v", name)
+		}
+	}
+
+	return errs
+}
+
+// Reason why value does not fit, empty if it does
+func (f Field) check(name string, value interface{}) string {
+
+	size, sized := 0.0, false
+	kind := reflect.ValueOf(value).Kind()
+
+	switch f.Type {
+	case String:
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Sprintf("%v must be %v", name, fieldTypeNames[f.Type])
+		}
+		size, sized = float64(len([]rune(s))), true
+
+		if f.Pattern != "" {
+			pattern := f.pattern
+			if pattern == nil {
+				pattern = regexp.MustCompile(f.Pattern)
+			}
+			if !pattern.MatchString(s) {
+				return fmt.Sprintf("%v must match %v", name, f.Pattern)
+			}
+		}
+
+	case Number, Integer:
+		n, ok := toFloat(value)
+		if !ok || (f.Type == Integer && n != math.Trunc(n)) {
+			return fmt.Sprintf("%v must be %v", name, fieldTypeNames[f.Type])
+		}
+		size, sized = n, true
+
+	case Bool:
+		if _, ok := value.(bool); !ok {
+			return fmt.Sprintf("%v must be %v", name, fieldTypeNames[f.Type])
+		}
+
+	case Object:
+		if kind != reflect.Map && kind != reflect.Struct {
+			return fmt.Sprintf("%v must be %v", name, fieldTypeNames[f.Type])
+		}
+
+	case List:
+		if kind != reflect.Slice && kind != reflect.Array {
+			return fmt.Sprintf("%v must be %v", name, fieldTypeNames[f.Type])
+		}
+		size, sized = float64(reflect.ValueOf(value).Len()), true
+	}
+
+	if sized && f.Min != nil && size < *f.Min {
+		return fmt.Sprintf("%v must be at least %v", name, *f.Min)
+	}
+
+	if sized && f.Max != nil && size > *f.Max {
+		return fmt.Sprintf("%v must be at most %v", name, *f.Max)
+	}
+
+	if len(f.Enum) > 0 {
+		for _, allowed := range f.Enum {
+			if equal(value, allowed) {
+				return ""
+			}
+		}
+		return fmt.Sprintf("%v must be one of %v", name, f.Enum)
+	}
+
+	return ""
+}
+
+// Fill v, a pointer to a struct, with the RequestMap of msg. The fields are
+// matched like for encoding/json.
+func DecodeRequest(msg PureMsg, v interface{}) error {
+
+	data, err := json.Marshal(msg.RequestMap)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,551 @@
+package pure
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Header (or query parameter "session") identifying the session of a request
+const SessionHeader = "Pure-Session"
+
+type SessionOptions struct {
+	Timeout      time.Duration // Sessions without request nor stream for that long are closed
+	PollTimeout  time.Duration // Time a long-poll waits for a message
+	PingInterval time.Duration // Comments sent on idle event streams to keep proxies happy
+	BufferSize   int           // Messages kept for the client, the oldest are dropped
+	MaxBodySize  int64
+
+	// Without authenticators every session is anonymous, the user of a
+	// session can not change
+	Auth []Authenticator
+}
+
+func DefaultSessionOptions() SessionOptions {
+	return SessionOptions{
+		Timeout:      2 * time.Minute,
+		PollTimeout:  30 * time.Second,
+		PingInterval: 15 * time.Second,
+		BufferSize:   256,
+		MaxBodySize:  1 << 20,
+	}
+}
+
+// Serve the pure protocol over plain HTTP, for the clients that can not use
+// websockets:
+//
+//	POST               a PureMsg, answered with the list of its responses.
+//	                   An empty body only creates the session.
+//	GET                the other messages (pushes...) since the seq given by
+//	                   the "since" parameter, as {"Seq", "Messages"}, waiting
+//	                   for one if there is none (long-polling)
+//	GET, event-stream  the same messages as Server-Sent Events, the seq is the
+//	                   event id (Last-Event-ID works)
+//	DELETE             close the session
+//
+// The session id is sent back in the Pure-Session header. Messages up to the
+// seq given by the client are forgotten, so a client can switch between the
+// event stream and long-polling, or reconnect, without losing messages.
+// Messages written to a transport are also kept, in case the client did not
+// get them, until BufferSize messages are waiting: they are the first
+// dropped.
+type SessionHandler struct {
+	muxer    *PureMux
+	options  SessionOptions
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewSessionHandler(mux *PureMux, options SessionOptions) *SessionHandler {
+	return &SessionHandler{muxer: mux, options: options, sessions: make(map[string]*Session)}
+}
+
+// Message waiting to be read by the client
+type sessionMsg struct {
+	seq uint64
+	msg PureMsg
+}
+
+// PureConnection of the HTTP clients, lives across requests
+type Session struct {
+	Id       string
+	muxer    *PureMux
+	handler  *SessionHandler
+	identity *Identity
+	mu       sync.Mutex
+	seq      uint64
+	buffer   []sessionMsg
+	written  uint64               // Last seq written to a transport
+	wake     chan struct{}        // Closed when a message is buffered
+	calls    map[string][]PureMsg // Responses of the requests being handled, by RequestId
+	counter  uint64               // RequestIds given by the server
+	streams  int                  // Transports waiting for messages
+	timer    *time.Timer
+	done     chan struct{}
+	once     sync.Once
+}
+
+func (handler *SessionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	identity := handler.authenticate(r)
+	if identity == nil && len(handler.options.Auth) > 0 {
+		writeError(w, http.StatusUnauthorized, ErrorMsg(PureMsg{}, CodeUnauthenticated, "Authentication required"))
+		return
+	}
+
+	id := r.Header.Get(SessionHeader)
+	if id == "" {
+		id = r.URL.Query().Get("session")
+	}
+
+	var session *Session
+
+	if id == "" {
+		if r.Method != "POST" {
+			writeError(w, http.StatusBadRequest, ErrorMsg(PureMsg{}, CodeMalformed, "No session"))
+			return
+		}
+		session = handler.newSession(identity)
+	} else {
+		session = handler.Session(id)
+
+		if session == nil {
+			writeError(w, http.StatusNotFound, ErrorMsg(PureMsg{}, CodeNotFound, "Unknown session"))
+			return
+		}
+
+		if !sameIdentity(identity, session.identity) {
+			writeError(w, http.StatusForbidden, ErrorMsg(PureMsg{}, CodeForbidden, "Session of another user"))
+			return
+		}
+	}
+
+	w.Header().Set(SessionHeader, session.Id)
+
+	switch r.Method {
+	case "POST":
+		handler.post(session, w, r)
+	case "GET":
+		if r.Header.Get("Accept") == "text/event-stream" {
+			handler.stream(session, w, r)
+		} else {
+			handler.poll(session, w, r)
+		}
+	case "DELETE":
+		session.Close()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Open session, nil if it does not exist or expired
+func (handler *SessionHandler) Session(id string) *Session {
+
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+
+	return handler.sessions[id]
+}
+
+func (handler *SessionHandler) authenticate(r *http.Request) *Identity {
+	for _, auth := range handler.options.Auth {
+		if identity := auth.Authenticate(r); identity != nil {
+			return identity
+		}
+	}
+	return nil
+}
+
+func sameIdentity(a *Identity, b *Identity) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Name == b.Name
+}
+
+func (handler *SessionHandler) newSession(identity *Identity) *Session {
+
+	session := &Session{
+		Id:       newSessionId(),
+		muxer:    handler.muxer,
+		handler:  handler,
+		identity: identity,
+		wake:     make(chan struct{}),
+		calls:    make(map[string][]PureMsg),
+		done:     make(chan struct{}),
+	}
+
+	handler.mu.Lock()
+	handler.sessions[session.Id] = session
+	handler.mu.Unlock()
+
+	// Sessions never expire without timeout
+	if handler.options.Timeout > 0 {
+		session.timer = time.AfterFunc(handler.options.Timeout, func() {
+			session.mu.Lock()
+			idle := session.streams == 0
+			session.mu.Unlock()
+
+			if idle {
+				session.Close()
+			}
+		})
+	}
+
+	handler.muxer.Connect(session)
+
+	return session
+}
+
+func newSessionId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+func (handler *SessionHandler) post(session *Session, w http.ResponseWriter, r *http.Request) {
+
+	session.touch()
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, handler.options.MaxBodySize+1))
+	if err != nil {
+		return
+	}
+
+	if len(body) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"Session": session.Id})
+		return
+	}
+
+	msg := PureMsg{}
+
+	if int64(len(body)) > handler.options.MaxBodySize {
+		writeError(w, http.StatusRequestEntityTooLarge, ErrorMsg(msg, CodeMalformed, "Message too large"))
+		return
+	}
+
+	if err := json.Unmarshal(body, &msg); err != nil {
+		log.Printf("[Pure] Error (%v) Unmarshalling message: %v\n", err, string(body))
+		writeError(w, http.StatusBadRequest, ErrorMsg(msg, CodeMalformed, err.Error()))
+		return
+	}
+
+	resps, ok := session.call(msg)
+	if !ok {
+		writeError(w, http.StatusConflict, ErrorMsg(msg, CodeConflict, "RequestId already in use"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resps)
+}
+
+// Messages after since, as {"Seq": last seq, "Messages": [...]}
+func (handler *SessionHandler) poll(session *Session, w http.ResponseWriter, r *http.Request) {
+
+	since, _ := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+
+	session.Ack(since)
+
+	session.attach()
+	defer session.detach()
+
+	timeout := time.NewTimer(handler.options.PollTimeout)
+	defer timeout.Stop()
+
+	for {
+		msgs, wake := session.after(since)
+
+		if len(msgs) > 0 {
+			since = msgs[len(msgs)-1].seq
+		}
+
+		if len(msgs) == 0 {
+			select {
+			case <-wake:
+				continue
+			case <-timeout.C:
+			case <-r.Context().Done():
+				return
+			case <-session.done:
+			}
+		}
+
+		resp := struct {
+			Seq      uint64
+			Messages []PureMsg
+		}{since, make([]PureMsg, 0, len(msgs))}
+
+		for _, m := range msgs {
+			resp.Messages = append(resp.Messages, m.msg)
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+		session.delivered(since)
+		return
+	}
+}
+
+// Server-Sent Events, until the client leaves
+func (handler *SessionHandler) stream(session *Session, w http.ResponseWriter, r *http.Request) {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, ErrorMsg(PureMsg{}, CodeInternal, "Streaming not supported"))
+		return
+	}
+
+	since, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	if param := r.URL.Query().Get("since"); param != "" {
+		since, _ = strconv.ParseUint(param, 10, 64)
+	}
+
+	// Events sent on this stream are only forgotten when acknowledged by the
+	// next stream or poll
+	session.Ack(since)
+
+	session.attach()
+	defer session.detach()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var ping <-chan time.Time
+	if handler.options.PingInterval > 0 {
+		ticker := time.NewTicker(handler.options.PingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	for {
+		msgs, wake := session.after(since)
+
+		for _, m := range msgs {
+			data, err := json.Marshal(m.msg)
+			if err != nil {
+				log.Printf("Error serializing event %v", m.msg)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", m.seq, data); err != nil {
+				return
+			}
+			since = m.seq
+		}
+		flusher.Flush()
+		session.delivered(since)
+
+		select {
+		case <-wake:
+		case <-ping:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-session.done:
+			return
+		}
+	}
+}
+
+// Handle msg and collect the responses sent back to the session, false if
+// its RequestId is used by another request in progress
+func (s *Session) call(msg PureMsg) ([]PureMsg, bool) {
+
+	s.mu.Lock()
+	if msg.RequestId == "" {
+		s.counter++
+		msg.RequestId = "http-" + strconv.FormatUint(s.counter, 10)
+	}
+	if _, ok := s.calls[msg.RequestId]; ok {
+		s.mu.Unlock()
+		return nil, false
+	}
+	s.calls[msg.RequestId] = []PureMsg{}
+	s.mu.Unlock()
+
+	s.Handle(msg)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resps := s.calls[msg.RequestId]
+	delete(s.calls, msg.RequestId)
+
+	return resps, true
+}
+
+func (s *Session) Send(msg PureMsg) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if resps, ok := s.calls[msg.RequestId]; ok && msg.RequestId != "" {
+		s.calls[msg.RequestId] = append(resps, msg)
+		return
+	}
+
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+
+	s.seq++
+	msg.Seq = s.seq
+	s.buffer = append(s.buffer, sessionMsg{s.seq, msg})
+
+	if size := s.handler.options.BufferSize; size > 0 && len(s.buffer) > size {
+		dropped := s.buffer[:len(s.buffer)-size]
+		s.buffer = s.buffer[len(dropped):]
+
+		// Only the messages never written are a loss
+		lost := 0
+		for _, m := range dropped {
+			if m.seq > s.written {
+				lost++
+			}
+		}
+		if lost > 0 {
+			log.Printf("[Pure] Session %v buffer full, dropping %v messages\n", s.Id, lost)
+		}
+	}
+
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+func (s *Session) Handle(msg PureMsg) {
+	s.handle(context.Background(), msg)
+}
+
+func (s *Session) handle(ctx context.Context, msg PureMsg) {
+	s.muxer.Handle(PureReq{Msg: msg, Conn: s, Identity: s.identity, Context: ctx})
+}
+
+func (s *Session) capabilities() []string {
+	return []string{CapabilitySessions}
+}
+
+func (s *Session) Identity() *Identity {
+	return s.identity
+}
+
+// The client received the messages up to seq, they are not kept anymore
+func (s *Session) Ack(seq uint64) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx := 0
+	for idx < len(s.buffer) && s.buffer[idx].seq <= seq {
+		idx++
+	}
+	s.buffer = s.buffer[idx:]
+}
+
+// The messages up to seq were written to a transport
+func (s *Session) delivered(seq uint64) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if seq > s.written {
+		s.written = seq
+	}
+}
+
+// Buffered messages after seq, wake is closed when new messages are
+// available
+func (s *Session) after(seq uint64) (msgs []sessionMsg, wake chan struct{}) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.buffer {
+		if m.seq > seq {
+			msgs = append(msgs, m)
+		}
+	}
+
+	return msgs, s.wake
+}
+
+// The session is in use, restart the expiration
+func (s *Session) touch() {
+	if s.timer != nil {
+		s.timer.Reset(s.handler.options.Timeout)
+	}
+}
+
+func (s *Session) attach() {
+	s.mu.Lock()
+	s.streams++
+	s.mu.Unlock()
+}
+
+func (s *Session) detach() {
+	s.mu.Lock()
+	s.streams--
+	s.mu.Unlock()
+	s.touch()
+}
+
+// Forget the session, its transports are closed
+func (s *Session) Close() {
+	s.once.Do(func() {
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+		close(s.done)
+
+		s.handler.mu.Lock()
+		delete(s.handler.sessions, s.Id)
+		s.handler.mu.Unlock()
+
+		s.muxer.Disconnect(s)
+	})
+}
+
+// Open sessions
+func (handler *SessionHandler) Sessions() []*Session {
+
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+
+	sessions := make([]*Session, 0, len(handler.sessions))
+	for _, s := range handler.sessions {
+		sessions = append(sessions, s)
+	}
+
+	return sessions
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[Pure] Error writing response: %v\n", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg PureMsg) {
+	writeJSON(w, status, []PureMsg{msg})
+}
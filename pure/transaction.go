@@ -0,0 +1,306 @@
+package pure
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Transactions spanning several messages of a connection:
+//
+//	begin     opens a transaction, its id is in TransactionMap["transaction"]
+//	          of the response
+//	commit    commits the transaction of TransactionMap["transaction"]
+//	rollback  cancels it
+//
+// The messages with the id in TransactionMap["transaction"] are handled in
+// the transaction: their handlers must be TransactionalHandlers and are given
+// the Transaction of their DataType in PureReq.Tx, begun on the first
+// message of the DataType. The operations of a transaction are run one at a
+// time, a failed operation does not end the transaction.
+// The responses sent to other connections are held until the commit, what
+// handlers Publish is not.
+// Transactions are rolled back when their connection goes away, or when they
+// are not used for the timeout of the mux (the client gets an ERROR message
+// with the ROLLED_BACK code).
+// Like in atomic batches, atomicity only holds per DataType: when the commit
+// of a DataType fails the ones committed before stay applied, the commit then
+// fails with PARTIALLY_COMMITTED and ResponseMap["committed"] lists them.
+const (
+	BeginAction    = "begin"
+	CommitAction   = "commit"
+	RollbackAction = "rollback"
+)
+
+const TransactionKey = "transaction"
+
+const DefaultTransactionTimeout = 30 * time.Second
+
+const DefaultMaxTransactions = 16
+
+// Transaction opened by a client
+type openTx struct {
+	id      string
+	conn    PureConnection
+	mu      sync.Mutex // Held while an operation runs
+	txs     map[string]Transaction
+	order   []string // DataTypes in the order their transaction began
+	pending []pendingMsg
+	timeout time.Duration
+	timer   *time.Timer
+	closed  bool
+}
+
+type transactions struct {
+	mu      sync.Mutex
+	open    map[string]*openTx
+	counter uint64
+	timeout time.Duration
+	max     int // Open transactions of a connection
+}
+
+func newTransactions() *transactions {
+	return &transactions{open: make(map[string]*openTx), timeout: DefaultTransactionTimeout, max: DefaultMaxTransactions}
+}
+
+// Transactions a connection can have open at once, begin fails with
+// RATE_LIMITED beyond. No limit if 0.
+func (p *PureMux) SetMaxTransactions(max int) {
+	p.txs.mu.Lock()
+	p.txs.max = max
+	p.txs.mu.Unlock()
+}
+
+// Transactions not used for timeout are rolled back, never if 0
+func (p *PureMux) SetTransactionTimeout(timeout time.Duration) {
+	p.txs.mu.Lock()
+	p.txs.timeout = timeout
+	p.txs.mu.Unlock()
+}
+
+func (p *PureMux) handleTransaction(m PureReq, rw *PureResponseWriter) {
+
+	if m.Msg.Action == BeginAction {
+		open, err := p.txs.begin(m.Conn)
+		if err != nil {
+			rw.FailWith(CodeRateLimited, err.Error())
+			return
+		}
+
+		rw.msg.TransactionMap = map[string]string{}
+		for key, value := range m.Msg.TransactionMap {
+			rw.msg.TransactionMap[key] = value
+		}
+		rw.msg.TransactionMap[TransactionKey] = open.id
+
+		return
+	}
+
+	id := m.Msg.TransactionMap[TransactionKey]
+
+	open := p.txs.remove(id, m.Conn)
+	if open == nil {
+		rw.FailWith(CodeNoTransaction, fmt.Sprintf("No transaction %q", id))
+		return
+	}
+
+	if m.Msg.Action == RollbackAction {
+		open.rollback()
+		return
+	}
+
+	if committed, err := open.commit(); err != nil {
+		log.Printf("[Pure] Error committing transaction %v: %v\n", id, err)
+		if len(committed) > 0 {
+			rw.FailWith(CodePartialCommit, err.Error())
+			rw.AddValue("committed", committed)
+		} else {
+			rw.FailWith(CodeRolledBack, err.Error())
+		}
+	}
+}
+
+func (t *transactions) begin(conn PureConnection) (*openTx, error) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.max > 0 {
+		count := 0
+		for _, open := range t.open {
+			if open.conn == conn {
+				count++
+			}
+		}
+		if count >= t.max {
+			return nil, fmt.Errorf("Too many open transactions, %v at most", t.max)
+		}
+	}
+
+	t.counter++
+	open := &openTx{id: strconv.FormatUint(t.counter, 10), conn: conn, txs: make(map[string]Transaction), timeout: t.timeout}
+	t.open[open.id] = open
+
+	if open.timeout > 0 {
+		open.timer = time.AfterFunc(open.timeout, func() {
+			if t.remove(open.id, conn) != nil {
+				open.rollback()
+				conn.Send(ErrorMsg(PureMsg{TransactionMap: map[string]string{TransactionKey: open.id}}, CodeRolledBack, "Transaction timed out"))
+			}
+		})
+	}
+
+	return open, nil
+}
+
+// Open transaction of conn, nil if there is none
+func (t *transactions) get(id string, conn PureConnection) *openTx {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if open, ok := t.open[id]; ok && open.conn == conn {
+		return open
+	}
+
+	return nil
+}
+
+// Forget a transaction of conn, nil if it was not open
+func (t *transactions) remove(id string, conn PureConnection) *openTx {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	open, ok := t.open[id]
+	if !ok || open.conn != conn {
+		return nil
+	}
+
+	delete(t.open, id)
+
+	return open
+}
+
+// Roll back the transactions of a connection that went away
+func (t *transactions) drop(conn PureConnection) {
+
+	t.mu.Lock()
+	dropped := []*openTx{}
+	for id, open := range t.open {
+		if open.conn == conn {
+			delete(t.open, id)
+			dropped = append(dropped, open)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, open := range dropped {
+		open.rollback()
+	}
+}
+
+// Take the transaction for an operation, until release. Returns the
+// Transaction of the DataType of m.
+func (open *openTx) acquire(p *PureMux, m PureReq) (Transaction, error) {
+
+	open.mu.Lock()
+
+	if open.closed {
+		open.mu.Unlock()
+		return nil, fmt.Errorf("Transaction %v is over", open.id)
+	}
+
+	if open.timer != nil {
+		open.timer.Reset(open.timeout)
+	}
+
+	tx, err := p.transaction(m, open.txs)
+	if err != nil {
+		open.mu.Unlock()
+		return nil, err
+	}
+
+	if _, ok := open.txs[m.Msg.DataType]; !ok {
+		open.txs[m.Msg.DataType] = tx
+		open.order = append(open.order, m.Msg.DataType)
+	}
+
+	return tx, nil
+}
+
+func (open *openTx) release() {
+	open.mu.Unlock()
+}
+
+// Send msg to conn once committed
+func (open *openTx) later(conn PureConnection, msg PureMsg) {
+
+	open.mu.Lock()
+	defer open.mu.Unlock()
+
+	if !open.closed {
+		open.pending = append(open.pending, pendingMsg{conn, msg})
+	}
+}
+
+// Commit every transaction, the ones after a failure are rolled back.
+// Returns the DataTypes committed.
+func (open *openTx) commit() ([]string, error) {
+
+	open.mu.Lock()
+	defer open.mu.Unlock()
+
+	open.close()
+
+	committed := []string{}
+	var err error
+
+	for idx, dataType := range open.order {
+		if err = open.txs[dataType].Commit(); err != nil {
+			for _, remaining := range open.order[idx+1:] {
+				open.txs[remaining].Rollback()
+			}
+			err = fmt.Errorf("Commit failed on %v: %v", dataType, err)
+			break
+		}
+		committed = append(committed, dataType)
+	}
+
+	// What was applied is told to the others
+	for _, pm := range open.pending {
+		for _, dataType := range committed {
+			if pm.msg.DataType == dataType {
+				pm.conn.Send(pm.msg)
+				break
+			}
+		}
+	}
+
+	return committed, err
+}
+
+func (open *openTx) rollback() {
+
+	open.mu.Lock()
+	defer open.mu.Unlock()
+
+	open.close()
+
+	for _, dataType := range open.order {
+		if err := open.txs[dataType].Rollback(); err != nil {
+			log.Printf("[Pure] Error rolling back transaction %v on %v: %v\n", open.id, dataType, err)
+		}
+	}
+}
+
+func (open *openTx) close() {
+
+	open.closed = true
+
+	if open.timer != nil {
+		open.timer.Stop()
+	}
+}
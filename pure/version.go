@@ -0,0 +1,189 @@
+package pure
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+// Handshake a client can send first:
+//
+//	RequestMap["versions"]      the versions the client speaks
+//	RequestMap["capabilities"]  the features it wants to use
+//
+// The response holds the highest version spoken by both sides in
+// ResponseMap["version"], and in ResponseMap["capabilities"] the features of
+// the server the client asked for (all of them when it asked for none).
+// When no version is common the response fails with UNSUPPORTED_VERSION and
+// ResponseMap["versions"] lists the versions of the server.
+// Clients without handshake speak ProtocolVersion, a message can also give
+// its own Version.
+// The hello goes through the middlewares like the other requests, see
+// Authorize for the anonymous connections.
+const HelloAction = "hello"
+
+// Version of the clients that do not tell, Version is left out of their
+// messages
+const ProtocolVersion = 1
+
+// Features a server can offer
+const (
+	CapabilityBatch        = "batch"
+	CapabilityPush         = "push"
+	CapabilityStream       = "stream"
+	CapabilityTransactions = "transactions"
+	CapabilityCompression  = "compression"
+	CapabilitySessions     = "sessions"
+)
+
+// Capabilities of every mux, the transports add theirs
+var muxCapabilities = []string{CapabilityBatch, CapabilityPush, CapabilityStream, CapabilityTransactions}
+
+// Connections telling what their transport supports
+type capableConnection interface {
+	capabilities() []string
+}
+
+type versions struct {
+	sync.Mutex
+	supported []int
+	handlers  map[string]map[int]PureHandler // DataType -> version -> handler
+	conns     map[PureConnection]int         // Negotiated by the hello
+}
+
+func newVersions() *versions {
+	return &versions{
+		supported: []int{ProtocolVersion},
+		handlers:  make(map[string]map[int]PureHandler),
+		conns:     make(map[PureConnection]int),
+	}
+}
+
+// Versions of the protocol spoken by the mux, ProtocolVersion only by default
+func (p *PureMux) SetVersions(supported ...int) {
+
+	sorted := append([]int{}, supported...)
+	sort.Ints(sorted)
+
+	p.versions.Lock()
+	p.versions.supported = sorted
+	p.versions.Unlock()
+}
+
+// Handler of the requests of a DataType in a version of the protocol, the
+// handler given to RegisterHandler serves the other versions
+func (p *PureMux) RegisterVersionHandler(dataType string, version int, handler PureHandler) {
+
+	p.versions.Lock()
+	defer p.versions.Unlock()
+
+	if p.versions.handlers[dataType] == nil {
+		p.versions.handlers[dataType] = make(map[int]PureHandler)
+	}
+	p.versions.handlers[dataType][version] = handler
+}
+
+// Handler of a request for its version, nil if there is none
+func (p *PureMux) handler(m PureReq) PureHandler {
+
+	p.versions.Lock()
+	handler, ok := p.versions.handlers[m.Msg.DataType][m.Version]
+	p.versions.Unlock()
+
+	if ok {
+		return handler
+	}
+
+	return p.handlers[m.Msg.DataType]
+}
+
+// Version of a message, false if it is not supported
+func (v *versions) of(m PureReq) (int, bool) {
+
+	v.Lock()
+	defer v.Unlock()
+
+	version := m.Msg.Version
+	if version == 0 {
+		version = ProtocolVersion
+		if negotiated, ok := v.conns[m.Conn]; ok {
+			version = negotiated
+		}
+	}
+
+	return version, v.supports(version)
+}
+
+func (v *versions) supports(version int) bool {
+	for _, supported := range v.supported {
+		if supported == version {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *versions) drop(conn PureConnection) {
+	v.Lock()
+	delete(v.conns, conn)
+	v.Unlock()
+}
+
+func (p *PureMux) negotiate(m PureReq, rw *PureResponseWriter) {
+
+	asked, ok := m.Msg.RequestMap["versions"].([]interface{})
+	if !ok || len(asked) == 0 {
+		rw.FieldError("versions", CodeInvalid, "versions must be a list of versions")
+		return
+	}
+
+	p.versions.Lock()
+	defer p.versions.Unlock()
+
+	version := 0
+	for _, a := range asked {
+		n, ok := toFloat(a)
+		if ok && n == math.Trunc(n) && int(n) > version && p.versions.supports(int(n)) {
+			version = int(n)
+		}
+	}
+
+	if version == 0 {
+		rw.FailWith(CodeUnsupportedVersion, fmt.Sprintf("No supported version in %v", asked))
+		rw.AddValue("versions", append([]int{}, p.versions.supported...))
+		return
+	}
+
+	p.versions.conns[m.Conn] = version
+
+	offered := append([]string{}, muxCapabilities...)
+	if c, ok := m.Conn.(capableConnection); ok {
+		offered = append(offered, c.capabilities()...)
+	}
+
+	capabilities := offered
+	if wanted, ok := m.Msg.RequestMap["capabilities"].([]interface{}); ok && len(wanted) > 0 {
+		capabilities = []string{}
+		for _, capability := range offered {
+			for _, w := range wanted {
+				if w == capability {
+					capabilities = append(capabilities, capability)
+					break
+				}
+			}
+		}
+	}
+
+	rw.AddValue("version", version)
+	rw.AddValue("capabilities", capabilities)
+	rw.msg.Version = versionField(version)
+}
+
+// Version of a message, left out for ProtocolVersion
+func versionField(version int) int {
+	if version == ProtocolVersion {
+		return 0
+	}
+	return version
+}
@@ -0,0 +1,619 @@
+package pure
+
+import (
+	"compress/flate"
+	"context"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What Send does when the outbound queue of a connection is full
+type Backpressure int
+
+const (
+	Block      Backpressure = iota // Wait for the client to catch up
+	Drop                           // Forget the message
+	Disconnect                     // Close the connection of the slow client
+)
+
+type WebsocketOptions struct {
+	PingInterval time.Duration // Delay between two pings sent to the client
+	PongTimeout  time.Duration // The connection is closed when nothing was received for that long
+	WriteTimeout time.Duration
+	QueueSize    int // Messages waiting to be written to a connection
+	Backpressure Backpressure
+
+	// Without authenticators every connection is accepted anonymously.
+	// Auth are tried in order on the upgrade request, then Token on the first
+	// message if it is set.
+	Auth        []Authenticator
+	Token       TokenAuthenticator
+	AuthTimeout time.Duration // Delay to send the token
+
+	// Encodings offered with the websocket subprotocols, DefaultCodecs if
+	// empty. Clients asking for no subprotocol use JSON.
+	Codecs []Codec
+
+	ReadBufferSize  int
+	WriteBufferSize int
+	ReadLimit       int64 // Size of the largest message accepted, no limit if 0
+
+	// permessage-deflate, used when the client supports it.
+	// Messages smaller than CompressionThreshold are not compressed.
+	EnableCompression    bool
+	CompressionLevel     int
+	CompressionThreshold int
+
+	// When set, the connections are sessions of Sessions: they survive
+	// disconnections for the Timeout of the sessions and can be resumed, see
+	// SessionAction. The same sessions can be used over HTTP, they must be
+	// created with the same PureMux.
+	Sessions *SessionHandler
+
+	// How the requests of a connection are run, see Ordering. Workers is the
+	// number of requests of a connection running or waiting at the same
+	// time, the connection is not read while they are all taken.
+	Ordering Ordering
+	Workers  int
+}
+
+// Action of the first message sent on the connections with sessions, with the
+// id of the session in ResponseMap["session"] and ResponseMap["resumed"] set
+// to false when a new session was opened.
+// A client resumes a session by connecting with the Pure-Session and Pure-Seq
+// headers (or "session" and "seq" parameters), Pure-Seq being the Seq of the
+// last message it received. The messages sent after it are sent again.
+const SessionAction = "SESSION"
+
+// Header (or query parameter "seq") holding the last Seq received by the client
+const SeqHeader = "Pure-Seq"
+
+func DefaultWebsocketOptions() WebsocketOptions {
+	return WebsocketOptions{
+		PingInterval: 30 * time.Second,
+		PongTimeout:  60 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		QueueSize:    64,
+		Backpressure: Block,
+		AuthTimeout:  10 * time.Second,
+
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+		ReadLimit:       1 << 20,
+
+		EnableCompression:    true,
+		CompressionLevel:     flate.DefaultCompression,
+		CompressionThreshold: 1024,
+
+		Ordering: Sequential,
+		Workers:  16,
+	}
+}
+
+// Serve the pure protocol over websocket and keep track of the live
+// connections
+type HttpHandler struct {
+	muxer    *PureMux
+	options  WebsocketOptions
+	mu       sync.Mutex
+	conns    map[*WebsocketConn]struct{}
+	closing  bool
+	finished sync.WaitGroup
+	upgrader websocket.Upgrader
+}
+
+func NewWebsocketHandler(mux *PureMux, options WebsocketOptions) *HttpHandler {
+
+	if len(options.Codecs) == 0 {
+		options.Codecs = DefaultCodecs
+	}
+
+	handler := &HttpHandler{muxer: mux, options: options, conns: make(map[*WebsocketConn]struct{})}
+
+	handler.upgrader = websocket.Upgrader{
+		ReadBufferSize:    options.ReadBufferSize,
+		WriteBufferSize:   options.WriteBufferSize,
+		Subprotocols:      codecNames(options.Codecs),
+		EnableCompression: options.EnableCompression,
+	}
+
+	return handler
+}
+
+func (handler *HttpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	conn, err := handler.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		fmt.Fprintf(w, "Upgrade failed: %v", err)
+		return
+	}
+
+	// Create the PureConnection
+	// Every message from this conn will be handled here so no need to store it outside
+	pureConn := newWebsocketConn(conn, handler.muxer, handler.options)
+	pureConn.codec = codecFor(conn.Subprotocol(), handler.options.Codecs)
+
+	if handler.options.ReadLimit > 0 {
+		conn.SetReadLimit(handler.options.ReadLimit)
+	}
+	if handler.options.EnableCompression {
+		conn.SetCompressionLevel(handler.options.CompressionLevel)
+		pureConn.deflate = strings.Contains(r.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+	}
+
+	if !handler.register(pureConn) {
+		pureConn.closeFrame(websocket.CloseGoingAway, "Server shutdown")
+		conn.Close()
+		return
+	}
+
+	if !handler.authenticate(pureConn, r) {
+		pureConn.closeFrame(websocket.ClosePolicyViolation, "Authentication required")
+		handler.unregister(pureConn)
+		return
+	}
+	defer handler.unregister(pureConn)
+
+	// The connection known by the mux
+	handle := pureConn.handle
+	var session *Session
+
+	if handler.options.Sessions != nil {
+		var since uint64
+		session, since = handler.session(pureConn, r)
+		handle = session.handle
+
+		session.attach()
+		defer session.detach()
+
+		go pureConn.forward(session, since)
+	} else {
+		handler.muxer.Connect(pureConn)
+		defer handler.muxer.Disconnect(pureConn)
+	}
+
+	// Any message, pongs included, proves that the client is still there
+	conn.SetReadDeadline(pureConn.readDeadline())
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(pureConn.readDeadline())
+	})
+
+	defer pureConn.stop()
+	go pureConn.writer()
+	go pureConn.keepalive()
+
+	// The requests of a session can still be answered after the connection
+	workers := newWorkers(handler.options.Ordering, handler.options.Workers, handle)
+	defer func() {
+		workers.close(session == nil)
+	}()
+
+	for {
+
+		// We might want to add logging at sone point
+		// TODO
+
+		//  Discard message Type, if it does not match the codec the unmarshaling will fail anyway
+		_, p, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("[WebSocket] Error Reading message: %v\n", err)
+			} else if session != nil && websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				// The client left on purpose
+				session.Close()
+			}
+			return
+		}
+
+		conn.SetReadDeadline(pureConn.readDeadline())
+
+		msg := PureMsg{}
+
+		err = pureConn.codec.Unmarshal(p, &msg)
+
+		if err != nil {
+			log.Printf("[WebSocket] Error (%v) Unmarshalling message: %v\n", err, string(p))
+			pureConn.Send(ErrorMsg(msg, CodeMalformed, err.Error()))
+			continue
+		}
+
+		// Pass the request to the Pureconn that will transmit it to the Muxer
+		// The Muxer will then use the PureConn to send the response
+		workers.submit(msg)
+	}
+
+}
+
+// Find the identity of the connection, an error is sent to the client when
+// there is none
+func (handler *HttpHandler) authenticate(c *WebsocketConn, r *http.Request) bool {
+
+	options := handler.options
+
+	if len(options.Auth) == 0 && options.Token == nil {
+		return true
+	}
+
+	for _, auth := range options.Auth {
+		if c.identity = auth.Authenticate(r); c.identity != nil {
+			return true
+		}
+	}
+
+	if options.Token == nil {
+		c.write(ErrorMsg(PureMsg{}, CodeUnauthenticated, "Authentication required"))
+		return false
+	}
+
+	if options.AuthTimeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(options.AuthTimeout))
+	}
+
+	msg := PureMsg{}
+	_, p, err := c.Conn.ReadMessage()
+	if err == nil {
+		err = c.codec.Unmarshal(p, &msg)
+	}
+	if err != nil {
+		c.write(ErrorMsg(msg, CodeUnauthenticated, "Authentication required"))
+		return false
+	}
+
+	token, _ := msg.RequestMap["token"].(string)
+
+	if msg.Action != AuthenticateAction || token == "" {
+		c.write(ErrorMsg(msg, CodeUnauthenticated, "Authentication required"))
+		return false
+	}
+
+	if c.identity = options.Token(token); c.identity == nil {
+		c.write(ErrorMsg(msg, CodeUnauthenticated, "Invalid token"))
+		return false
+	}
+
+	resp := PureMsg{
+		Action:         GetResponseAction(AuthenticateAction, true),
+		ResponseMap:    map[string]interface{}{"user": c.identity.Name},
+		TransactionMap: msg.TransactionMap,
+		RequestId:      msg.RequestId,
+	}
+
+	return c.write(resp) == nil
+}
+
+// Resume the session asked by the client, or open a new one, and tell the
+// client. Returns the session and the last Seq received by the client.
+func (handler *HttpHandler) session(c *WebsocketConn, r *http.Request) (*Session, uint64) {
+
+	sessions := handler.options.Sessions
+
+	id := r.Header.Get(SessionHeader)
+	if id == "" {
+		id = r.URL.Query().Get("session")
+	}
+
+	param := r.Header.Get(SeqHeader)
+	if param == "" {
+		param = r.URL.Query().Get("seq")
+	}
+	since, _ := strconv.ParseUint(param, 10, 64)
+
+	session := sessions.Session(id)
+	resumed := session != nil && sameIdentity(session.identity, c.identity)
+
+	if resumed {
+		session.Ack(since)
+	} else {
+		session = sessions.newSession(c.identity)
+		since = 0
+	}
+
+	// Before any message of the session
+	c.Send(PureMsg{
+		Action:      SessionAction,
+		ResponseMap: map[string]interface{}{"session": session.Id, "resumed": resumed},
+	})
+
+	return session, since
+}
+
+func (handler *HttpHandler) register(conn *WebsocketConn) bool {
+
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+
+	if handler.closing {
+		return false
+	}
+
+	handler.conns[conn] = struct{}{}
+	handler.finished.Add(1)
+
+	return true
+}
+
+func (handler *HttpHandler) unregister(conn *WebsocketConn) {
+
+	handler.mu.Lock()
+	delete(handler.conns, conn)
+	handler.mu.Unlock()
+
+	conn.Conn.Close()
+	handler.finished.Done()
+}
+
+// Live connections
+func (handler *HttpHandler) Conns() []PureConnection {
+
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+
+	conns := make([]PureConnection, 0, len(handler.conns))
+	for conn := range handler.conns {
+		conns = append(conns, conn)
+	}
+
+	return conns
+}
+
+// Send a close frame to every client and wait for them to leave.
+// The connections still open when ctx is done are closed abruptly.
+func (handler *HttpHandler) Shutdown(ctx context.Context) error {
+
+	handler.mu.Lock()
+	handler.closing = true
+	conns := make([]*WebsocketConn, 0, len(handler.conns))
+	for conn := range handler.conns {
+		conns = append(conns, conn)
+	}
+	handler.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.closeFrame(websocket.CloseGoingAway, "Server shutdown")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		handler.finished.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		for _, conn := range conns {
+			conn.stop()
+		}
+		<-done
+		return ctx.Err()
+	}
+}
+
+func WebsocketHandler(mux *PureMux) (handler http.Handler) {
+	handler = NewWebsocketHandler(mux, DefaultWebsocketOptions())
+	return
+}
+
+// The transactions the client has with the server are tracked by the mux,
+// see BeginAction
+//
+// Send can be called from any goroutine, the messages are queued and written
+// by a single writer goroutine.
+type WebsocketConn struct {
+	Conn     *websocket.Conn
+	Muxer    *PureMux
+	options  WebsocketOptions
+	queue    chan PureMsg
+	done     chan struct{} // Closed when the connection is over
+	stopOnce sync.Once
+	writeMu  sync.Mutex // Only used without queue
+	identity *Identity
+	codec    Codec // JSON if nil
+	deflate  bool  // permessage-deflate was negotiated
+}
+
+func newWebsocketConn(conn *websocket.Conn, mux *PureMux, options WebsocketOptions) *WebsocketConn {
+
+	size := options.QueueSize
+	if size < 1 {
+		size = 1
+	}
+
+	return &WebsocketConn{
+		Conn:    conn,
+		Muxer:   mux,
+		options: options,
+		queue:   make(chan PureMsg, size),
+		done:    make(chan struct{}),
+		codec:   JSON,
+	}
+}
+
+func (c *WebsocketConn) Send(msg PureMsg) {
+
+	// Connection built by hand, write directly
+	if c.queue == nil {
+		c.writeMu.Lock()
+		defer c.writeMu.Unlock()
+		c.write(msg)
+		return
+	}
+
+	select {
+	case <-c.done:
+		return
+	case c.queue <- msg:
+		return
+	default:
+	}
+
+	// The queue is full
+	switch c.options.Backpressure {
+	case Drop:
+		log.Printf("[WebSocket] Queue full, dropping %v %v message\n", msg.DataType, msg.Action)
+	case Disconnect:
+		log.Printf("[WebSocket] Queue full, disconnecting slow client %v\n", c.Conn.RemoteAddr())
+		c.stop()
+	default:
+		select {
+		case <-c.done:
+		case c.queue <- msg:
+		}
+	}
+}
+
+// Write the queued messages until the connection is over
+func (c *WebsocketConn) writer() {
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case msg := <-c.queue:
+			if err := c.write(msg); err != nil {
+				log.Printf("[WebSocket] Error writing message: %v\n", err)
+				c.stop()
+				return
+			}
+		}
+	}
+}
+
+func (c *WebsocketConn) write(msg PureMsg) error {
+
+	codec := c.codec
+	if codec == nil {
+		codec = JSON
+	}
+
+	// Serialization of the PureMsg
+	data, err := codec.Marshal(msg)
+	if err != nil {
+		log.Printf("Error serializing Websocket response %v", msg)
+		return nil
+	}
+
+	messageType := websocket.TextMessage
+	if codec.Binary() {
+		messageType = websocket.BinaryMessage
+	}
+
+	// Only done when negotiated
+	if c.options.EnableCompression {
+		c.Conn.EnableWriteCompression(len(data) >= c.options.CompressionThreshold)
+	}
+
+	// Send using the websocket conn
+	c.Conn.SetWriteDeadline(c.writeDeadline())
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+// End the connection, the read loop fails and the client is disconnected
+func (c *WebsocketConn) stop() {
+	c.stopOnce.Do(func() {
+		close(c.done)
+		c.Conn.Close()
+	})
+}
+
+func (c *WebsocketConn) Handle(msg PureMsg) {
+	c.handle(context.Background(), msg)
+}
+
+func (c *WebsocketConn) capabilities() []string {
+	if c.deflate {
+		return []string{CapabilityCompression}
+	}
+	return nil
+}
+
+func (c *WebsocketConn) handle(ctx context.Context, msg PureMsg) {
+	req := PureReq{Msg: msg, Conn: c, Identity: c.identity, Context: ctx}
+	c.Muxer.Handle(req)
+}
+
+// Send the messages of the session after since, until the connection or the
+// session is over
+func (c *WebsocketConn) forward(s *Session, since uint64) {
+
+	for {
+		msgs, wake := s.after(since)
+
+		for _, m := range msgs {
+			c.Send(m.msg)
+			since = m.seq
+		}
+
+		select {
+		case <-c.done:
+			return
+		default:
+			s.delivered(since)
+		}
+
+		select {
+		case <-wake:
+		case <-c.done:
+			return
+		case <-s.done:
+			c.closeFrame(websocket.CloseNormalClosure, "Session closed")
+			c.stop()
+			return
+		}
+	}
+}
+
+// User authenticated by the handler, nil if anonymous
+func (c *WebsocketConn) Identity() *Identity {
+	return c.identity
+}
+
+// Ping the client until the connection is over
+func (c *WebsocketConn) keepalive() {
+
+	if c.options.PingInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(c.options.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			// WriteControl can be used concurrently with the other writes
+			err := c.Conn.WriteControl(websocket.PingMessage, nil, c.writeDeadline())
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *WebsocketConn) closeFrame(code int, reason string) error {
+	return c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), c.writeDeadline())
+}
+
+// Zero values disable the timeouts
+func (c *WebsocketConn) readDeadline() time.Time {
+	if c.options.PongTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(c.options.PongTimeout)
+}
+
+func (c *WebsocketConn) writeDeadline() time.Time {
+	if c.options.WriteTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(c.options.WriteTimeout)
+}
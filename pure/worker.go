@@ -0,0 +1,169 @@
+package pure
+
+import (
+	"context"
+	"sync"
+)
+
+// How the requests read from a websocket are handled
+type Ordering int
+
+const (
+	// One request at a time, in the order they were received. The responses
+	// come in the same order.
+	Sequential Ordering = iota
+	// Up to Workers requests at the same time, the responses come in any
+	// order and are matched to the requests by their RequestId.
+	Parallel
+	// The requests of a DataType are handled one at a time in the order they
+	// were received, different DataTypes at the same time. Batches are
+	// ordered with the other messages of the DataType of the batch message.
+	PerDataType
+)
+
+// Action of the message a client sends to give up a request, RequestId being
+// the id of the request. A request that did not start fails with an ABORTED
+// error, a running one has the Context of its PureReq cancelled and the
+// handler answers what it wants. Aborts are not answered.
+const AbortAction = "abort"
+
+// Handles the requests of a connection according to an Ordering
+type workers struct {
+	ordering Ordering
+	handle   func(ctx context.Context, msg PureMsg)
+	slots    chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+	jobs     map[string]*job   // In flight, by RequestId
+	queues   map[string][]*job // Waiting, by ordering key
+	wg       sync.WaitGroup
+}
+
+type job struct {
+	msg    PureMsg
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// size is the number of requests handled or waiting at the same time
+func newWorkers(ordering Ordering, size int, handle func(context.Context, PureMsg)) *workers {
+
+	if size < 1 {
+		size = 1
+	}
+
+	w := &workers{
+		ordering: ordering,
+		handle:   handle,
+		slots:    make(chan struct{}, size),
+		jobs:     make(map[string]*job),
+		queues:   make(map[string][]*job),
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+
+	return w
+}
+
+// Queue a request, waits while all the slots are taken
+func (w *workers) submit(msg PureMsg) {
+
+	if msg.Action == AbortAction {
+		w.abort(msg.RequestId)
+		return
+	}
+
+	w.slots <- struct{}{}
+
+	j := &job{msg: msg}
+	j.ctx, j.cancel = context.WithCancel(w.ctx)
+
+	w.mu.Lock()
+	if msg.RequestId != "" {
+		w.jobs[msg.RequestId] = j
+	}
+
+	if w.ordering == Parallel {
+		w.mu.Unlock()
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			w.run(j)
+		}()
+		return
+	}
+
+	key := ""
+	if w.ordering == PerDataType {
+		key = msg.DataType
+	}
+
+	w.queues[key] = append(w.queues[key], j)
+	start := len(w.queues[key]) == 1
+	w.mu.Unlock()
+
+	if start {
+		w.wg.Add(1)
+		go w.drain(key)
+	}
+}
+
+// Run the requests of a queue until it is empty
+func (w *workers) drain(key string) {
+
+	defer w.wg.Done()
+
+	for {
+		w.mu.Lock()
+		j := w.queues[key][0]
+		w.mu.Unlock()
+
+		w.run(j)
+
+		w.mu.Lock()
+		queue := w.queues[key][1:]
+		if len(queue) == 0 {
+			delete(w.queues, key)
+			w.mu.Unlock()
+			return
+		}
+		w.queues[key] = queue
+		w.mu.Unlock()
+	}
+}
+
+func (w *workers) run(j *job) {
+
+	w.handle(j.ctx, j.msg)
+
+	j.cancel()
+
+	w.mu.Lock()
+	if w.jobs[j.msg.RequestId] == j {
+		delete(w.jobs, j.msg.RequestId)
+	}
+	w.mu.Unlock()
+
+	<-w.slots
+}
+
+func (w *workers) abort(id string) {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if j, ok := w.jobs[id]; ok {
+		j.cancel()
+	}
+}
+
+// Wait for the requests to be handled, they are aborted if abort is set
+func (w *workers) close(abort bool) {
+
+	if abort {
+		w.cancel()
+	}
+
+	w.wg.Wait()
+	w.cancel()
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 )
 
 type PersistentSQL struct {
@@ -34,12 +36,20 @@ var typeMapping = map[string]string{
 }
 
 func (m *DbManager) NewPersistentSQL(objType reflect.Type) (object *PersistentSQL, err error) {
-	object, err = m.CreatePersistentSQL(objType)
+
+	m.sqlMu.Lock()
+	defer m.sqlMu.Unlock()
+
+	return m.newPersistentSQL(objType)
+}
+
+func (m *DbManager) newPersistentSQL(objType reflect.Type) (object *PersistentSQL, err error) {
+	object, err = m.createPersistentSQL(objType)
 	if err != nil {
 		return nil, err
 	}
 
-	err = m.GenStmts(object)
+	err = m.genStmts(object)
 	if err != nil {
 		return nil, err
 	}
@@ -50,6 +60,14 @@ func (m *DbManager) NewPersistentSQL(objType reflect.Type) (object *PersistentSQ
 
 func (m *DbManager) CreatePersistentSQL(objType reflect.Type) (object *PersistentSQL, err error) {
 
+	m.sqlMu.Lock()
+	defer m.sqlMu.Unlock()
+
+	return m.createPersistentSQL(objType)
+}
+
+func (m *DbManager) createPersistentSQL(objType reflect.Type) (object *PersistentSQL, err error) {
+
 	object = new(PersistentSQL)
 
 	object.structure = make(map[string]string)
@@ -98,6 +116,14 @@ func (m *DbManager) CreatePersistentSQL(objType reflect.Type) (object *Persisten
 
 func (m *DbManager) GenStmts(object *PersistentSQL) error {
 
+	m.sqlMu.Lock()
+	defer m.sqlMu.Unlock()
+
+	return m.genStmts(object)
+}
+
+func (m *DbManager) genStmts(object *PersistentSQL) error {
+
 	// Generating the Statements
 	objType := object.objectType
 
@@ -147,7 +173,7 @@ func (m *DbManager) GenStmts(object *PersistentSQL) error {
 			targetType = targetType.Elem()
 		}
 
-		targetSQL, err := m.GetPersistentSQLByType(targetType.Elem())
+		targetSQL, err := m.persistentSQL(targetType.Elem())
 		if err != nil {
 			return err
 		}
@@ -194,10 +220,25 @@ func (m *DbManager) GenStmts(object *PersistentSQL) error {
 	return nil
 }
 
+// Returned by Update when there is no object with the id
+var ErrNothingUpdated = errors.New("Nothing updated")
+
 type DbManager struct {
 	db         *sql.DB
 	objectsSQL map[string]*PersistentSQL
+	sqlMu      *sync.Mutex // Guards objectsSQL, shared with the transactions
 	store      map[string]interface{}
+	tx         *sql.Tx               // Set for the DbManager of a Tx
+	evicted    map[string]bool       // Deleted in the transaction
+	flushed    map[reflect.Type]bool // Flushed in the transaction
+}
+
+// Statement run in the transaction, if any
+func (m *DbManager) stmt(s *sql.Stmt) *sql.Stmt {
+	if m.tx == nil {
+		return s
+	}
+	return m.tx.Stmt(s)
 }
 
 /*
@@ -280,11 +321,20 @@ func (m *DbManager) GetPersistentSQL(obj interface{}) (objSQL *PersistentSQL, er
 
 func (m *DbManager) GetPersistentSQLByType(objType reflect.Type) (objSQL *PersistentSQL, err error) {
 
+	m.sqlMu.Lock()
+	defer m.sqlMu.Unlock()
+
+	return m.persistentSQL(objType)
+}
+
+// GetPersistentSQLByType, with sqlMu held
+func (m *DbManager) persistentSQL(objType reflect.Type) (objSQL *PersistentSQL, err error) {
+
 	name := objType.Name()
 	objSQL, ok := m.objectsSQL[name]
 
 	if !ok {
-		objSQL, err = m.NewPersistentSQL(objType)
+		objSQL, err = m.newPersistentSQL(objType)
 		if err != nil {
 			return nil, err
 		}
@@ -292,7 +342,7 @@ func (m *DbManager) GetPersistentSQLByType(objType reflect.Type) (objSQL *Persis
 	}
 
 	if !objSQL.hasStmts() {
-		err = m.GenStmts(objSQL)
+		err = m.genStmts(objSQL)
 		if err != nil {
 			return nil, err
 		}
@@ -313,7 +363,7 @@ func (m *DbManager) Save(obj interface{}) error {
 		return err
 	}
 
-	results, err := objectSQL.saveStmt.Exec(values...)
+	results, err := m.stmt(objectSQL.saveStmt).Exec(values...)
 	if err != nil {
 		return err
 	}
@@ -348,7 +398,7 @@ func (m *DbManager) Update(obj interface{}) error {
 		return err
 	}
 
-	result, err := objectSQL.updateStmt.Exec(values...)
+	result, err := m.stmt(objectSQL.updateStmt).Exec(values...)
 	if err != nil {
 		return err
 	}
@@ -358,14 +408,36 @@ func (m *DbManager) Update(obj interface{}) error {
 		return err
 	}
 
+	// MySQL does not count the rows whose values did not change
 	if affected < 1 {
-		return errors.New("Nothing updated")
+		exists, err := m.exists(objectSQL, field.Int())
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNothingUpdated
+		}
 	}
 
-	return err
+	return nil
 
 }
 
+func (m *DbManager) exists(objectSQL *PersistentSQL, ID int64) (bool, error) {
+
+	query := fmt.Sprintf("SELECT COUNT(*) FROM `%v` WHERE %v = ?;", objectSQL.name, objectSQL.id)
+
+	var count int
+	var err error
+	if m.tx != nil {
+		err = m.tx.QueryRow(query, ID).Scan(&count)
+	} else {
+		err = m.db.QueryRow(query, ID).Scan(&count)
+	}
+
+	return count > 0, err
+}
+
 func (m *DbManager) getObjValues(obj interface{}) ([]interface{}, error) {
 
 	objType := reflect.TypeOf(obj).Elem()
@@ -451,10 +523,13 @@ func (m *DbManager) Delete(obj interface{}) error {
 	// Delete in the cache
 	key := fmt.Sprintf("%v%v", objectSQL.name, ID)
 	delete(m.store, key)
+	if m.evicted != nil {
+		m.evicted[key] = true
+	}
 
 	// Take care of dependencies in SQL
 	for field := range objectSQL.relations {
-		_, err := objectSQL.relationsStmt[field].Exec(ID)
+		_, err := m.stmt(objectSQL.relationsStmt[field]).Exec(ID)
 		if err != nil {
 			return err
 		}
@@ -523,7 +598,7 @@ func (m *DbManager) Delete(obj interface{}) error {
 		}
 	}
 
-	result, err := objectSQL.deleteStmt.Exec(ID)
+	result, err := m.stmt(objectSQL.deleteStmt).Exec(ID)
 	if err != nil {
 		return err
 	}
@@ -540,6 +615,98 @@ func (m *DbManager) Delete(obj interface{}) error {
 	return nil
 }
 
+/*
+ * Delete every object of the type of obj, returns the number of objects
+ * deleted. Like with Delete the objects related to them are left without
+ * master.
+ */
+func (m *DbManager) Flush(obj interface{}) (int64, error) {
+	objectSQL, err := m.GetPersistentSQL(obj)
+	if err != nil {
+		return 0, err
+	}
+
+	// Take care of dependencies in SQL
+	for field, target := range objectSQL.relations {
+		targetF, _ := objectSQL.objectType.FieldByName(field)
+		targetType := targetF.Type
+
+		if targetType.Kind() == reflect.Slice {
+			targetType = targetType.Elem()
+		}
+
+		targetSQL, err := m.GetPersistentSQLByType(targetType.Elem())
+		if err != nil {
+			return 0, err
+		}
+
+		for key, master := range targetSQL.keys {
+			if master == objectSQL.name {
+				_, err := m.exec(fmt.Sprintf("UPDATE `%v` SET %v = NULL WHERE %v IS NOT NULL;", target, key, key))
+				if err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+
+	result, err := m.exec(fmt.Sprintf("DELETE FROM `%v`;", objectSQL.name))
+	if err != nil {
+		return 0, err
+	}
+
+	m.ejectType(objectSQL.objectType)
+	if m.flushed != nil {
+		m.flushed[objectSQL.objectType] = true
+	}
+
+	return result.RowsAffected()
+}
+
+// Run a query in the transaction, if any
+func (m *DbManager) exec(query string, args ...interface{}) (sql.Result, error) {
+	if m.tx != nil {
+		return m.tx.Exec(query, args...)
+	}
+	return m.db.Exec(query, args...)
+}
+
+// Remove the objects of a type from the cache, the cached objects related to
+// them are left without master or without slaves
+func (m *DbManager) ejectType(objType reflect.Type) {
+
+	name := objType.Name()
+
+	for key, value := range m.store {
+		cached := value.(reflect.Value).Elem()
+		if cached.Type() == objType {
+			delete(m.store, key)
+			continue
+		}
+
+		m.sqlMu.Lock()
+		cachedSQL, ok := m.objectsSQL[cached.Type().Name()]
+		m.sqlMu.Unlock()
+		if !ok {
+			continue
+		}
+
+		for field, master := range cachedSQL.keys {
+			if master == name {
+				element := cached.FieldByName(field)
+				element.Set(reflect.Zero(element.Type()))
+			}
+		}
+
+		for field, target := range cachedSQL.relations {
+			if target == name {
+				elements := cached.FieldByName(field)
+				elements.Set(reflect.Zero(elements.Type()))
+			}
+		}
+	}
+}
+
 func (m *DbManager) Populate(obj interface{}) error {
 	objectSQL, err := m.GetPersistentSQL(obj)
 	if err != nil {
@@ -552,18 +719,28 @@ func (m *DbManager) Populate(obj interface{}) error {
 
 	// Loading all relations
 	for field := range objectSQL.relations {
-		rows, err := objectSQL.populateStmt[field].Query(ID)
+		rows, err := m.stmt(objectSQL.populateStmt[field]).Query(ID)
 		if err != nil {
 			return err
 		}
-		defer rows.Close()
 
+		// The rows are read before the children, a transaction can only run
+		// one query at a time
+		childIds := []int{}
 		for rows.Next() {
 			var childId int
 			if err := rows.Scan(&childId); err != nil {
+				rows.Close()
 				return err
 			}
+			childIds = append(childIds, childId)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
 
+		for _, childId := range childIds {
 			fieldType, _ := reflect.TypeOf(obj).Elem().FieldByName(field)
 			tmp := reflect.New(fieldType.Type.Elem())
 			ff := tmp.Elem().Interface()
@@ -574,9 +751,6 @@ func (m *DbManager) Populate(obj interface{}) error {
 			}
 			objValue.FieldByName(field).Set(reflect.Append(objValue.FieldByName(field), reflect.ValueOf(ff)))
 		}
-		if err := rows.Err(); err != nil {
-			return err
-		}
 	}
 
 	return nil
@@ -622,7 +796,7 @@ func (m *DbManager) Retrieve(ID int, dst interface{}) error {
 		}
 	}
 
-	err = objectSQL.getStmt.QueryRow(ID).Scan(values...)
+	err = m.stmt(objectSQL.getStmt).QueryRow(ID).Scan(values...)
 	if err != nil {
 		return err
 	}
@@ -670,6 +844,7 @@ func NewDbManager(credentials string) (dbManager *DbManager, err error) {
 	}
 
 	dbManager.objectsSQL = make(map[string]*PersistentSQL)
+	dbManager.sqlMu = new(sync.Mutex)
 	dbManager.store = make(map[string]interface{})
 
 	return
@@ -682,3 +857,280 @@ func min(a int, b int) int {
 	}
 	return b
 }
+
+/*
+ * Operations done in a SQL transaction, applied by Commit or forgotten by
+ * Rollback. Objects are read from the database, the cache of the DbManager
+ * is only updated on Commit.
+ * Tx implements pure.Transaction.
+ */
+type Tx struct {
+	manager *DbManager
+	parent  *DbManager
+}
+
+func (m *DbManager) Begin() (*Tx, error) {
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	manager := &DbManager{
+		db:         m.db,
+		objectsSQL: m.objectsSQL,
+		sqlMu:      m.sqlMu,
+		store:      make(map[string]interface{}),
+		tx:         tx,
+		evicted:    make(map[string]bool),
+		flushed:    make(map[reflect.Type]bool),
+	}
+
+	return &Tx{manager: manager, parent: m}, nil
+}
+
+func (t *Tx) Save(obj interface{}) error {
+	return t.manager.Save(obj)
+}
+
+func (t *Tx) Update(obj interface{}) error {
+	return t.manager.Update(obj)
+}
+
+func (t *Tx) Delete(obj interface{}) error {
+	return t.manager.Delete(obj)
+}
+
+func (t *Tx) Retrieve(ID int, dst interface{}) error {
+	return t.manager.Retrieve(ID, dst)
+}
+
+func (t *Tx) Populate(obj interface{}) error {
+	return t.manager.Populate(obj)
+}
+
+func (t *Tx) Flush(obj interface{}) (int64, error) {
+	return t.manager.Flush(obj)
+}
+
+func (t *Tx) Commit() error {
+
+	if err := t.Apply(); err != nil {
+		return err
+	}
+
+	t.Merge()
+
+	return nil
+}
+
+// Commit the database transaction, the objects of the parent DbManager are
+// left unchanged until Merge. Apply does not use the parent.
+func (t *Tx) Apply() error {
+	return t.manager.tx.Commit()
+}
+
+// Give the parent DbManager the objects of an applied transaction
+func (t *Tx) Merge() {
+
+	for key := range t.manager.evicted {
+		delete(t.parent.store, key)
+	}
+
+	for objType := range t.manager.flushed {
+		t.parent.ejectType(objType)
+	}
+
+	for key, value := range t.manager.store {
+		t.parent.store[key] = value
+	}
+}
+
+func (t *Tx) Rollback() error {
+	return t.manager.tx.Rollback()
+}
+
+// Condition on a field: Op is one of =, !=, <, <=, >, >= and in, Value is
+// then a slice
+type Condition struct {
+	Field string
+	Op    string
+	Value interface{}
+}
+
+type Order struct {
+	Field string
+	Desc  bool
+}
+
+/*
+ * Objects matching every condition of Where, sorted by Order then by id.
+ * After holds the values of the Order fields then the id of the last object
+ * of the previous page, to get the next one.
+ */
+type Query struct {
+	Where []Condition
+	Order []Order
+	After []interface{}
+	Limit int // No limit if 0
+}
+
+var operators = map[string]bool{"=": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true, "in": true}
+
+/*
+ * Fill dst, a pointer to a slice of pointers to objects, with the objects
+ * of the query
+ */
+func (m *DbManager) Find(q Query, dst interface{}) error {
+
+	sliceValue := reflect.ValueOf(dst).Elem()
+
+	objectSQL, err := m.GetPersistentSQLByType(sliceValue.Type().Elem().Elem())
+	if err != nil {
+		return err
+	}
+
+	query, args, err := objectSQL.findQuery(q)
+	if err != nil {
+		return err
+	}
+
+	var rows *sql.Rows
+	if m.tx != nil {
+		rows, err = m.tx.Query(query, args...)
+	} else {
+		rows, err = m.db.Query(query, args...)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Like Populate, the ids are read before the objects
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	objects := reflect.MakeSlice(sliceValue.Type(), 0, len(ids))
+
+	for _, id := range ids {
+		obj := reflect.New(sliceValue.Type().Elem())
+		if err := m.Retrieve(id, obj.Interface()); err != nil {
+			return err
+		}
+		objects = reflect.Append(objects, obj.Elem())
+	}
+
+	sliceValue.Set(objects)
+
+	return nil
+}
+
+func (t *Tx) Find(q Query, dst interface{}) error {
+	return t.manager.Find(q, dst)
+}
+
+// SQL of a query, the fields are checked as they can not be parameters
+func (p *PersistentSQL) findQuery(q Query) (string, []interface{}, error) {
+
+	args := []interface{}{}
+	where := []string{}
+
+	for _, c := range q.Where {
+		if !p.hasField(c.Field) || !operators[c.Op] {
+			return "", nil, fmt.Errorf("Bad condition: %v %v", c.Field, c.Op)
+		}
+
+		if c.Op != "in" {
+			where = append(where, fmt.Sprintf("%v %v ?", c.Field, c.Op))
+			args = append(args, c.Value)
+			continue
+		}
+
+		values := reflect.ValueOf(c.Value)
+		if values.Kind() != reflect.Slice || values.Len() == 0 {
+			return "", nil, fmt.Errorf("Bad values for %v in: %v", c.Field, c.Value)
+		}
+
+		marks := strings.TrimSuffix(strings.Repeat("?, ", values.Len()), ", ")
+		where = append(where, fmt.Sprintf("%v IN (%v)", c.Field, marks))
+		for i := 0; i < values.Len(); i++ {
+			args = append(args, values.Index(i).Interface())
+		}
+	}
+
+	// The id makes the order total, for the pages
+	order := append(append([]Order{}, q.Order...), Order{Field: p.id})
+
+	for _, o := range order {
+		if !p.hasField(o.Field) {
+			return "", nil, fmt.Errorf("Bad order: %v", o.Field)
+		}
+	}
+
+	if len(q.After) > 0 {
+		if len(q.After) != len(order) {
+			return "", nil, errors.New("After must hold a value for each order and the id")
+		}
+
+		// (a > ?) OR (a = ? AND b > ?) OR ...
+		after := []string{}
+		for i, o := range order {
+			terms := []string{}
+			for j := 0; j < i; j++ {
+				terms = append(terms, fmt.Sprintf("%v = ?", order[j].Field))
+				args = append(args, q.After[j])
+			}
+
+			op := ">"
+			if o.Desc {
+				op = "<"
+			}
+			terms = append(terms, fmt.Sprintf("%v %v ?", o.Field, op))
+			args = append(args, q.After[i])
+
+			after = append(after, "("+strings.Join(terms, " AND ")+")")
+		}
+		where = append(where, "("+strings.Join(after, " OR ")+")")
+	}
+
+	query := fmt.Sprintf("SELECT %v FROM `%v`", p.id, p.name)
+
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	orderBy := []string{}
+	for _, o := range order {
+		if o.Desc {
+			orderBy = append(orderBy, o.Field+" DESC")
+		} else {
+			orderBy = append(orderBy, o.Field+" ASC")
+		}
+	}
+	query += " ORDER BY " + strings.Join(orderBy, ", ")
+
+	if q.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", q.Limit)
+	}
+
+	return query + ";", args, nil
+}
+
+func (p *PersistentSQL) hasField(field string) bool {
+	for _, f := range p.fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
@@ -2,8 +2,10 @@ package saver_test
 
 import (
 	"database/sql"
+	"fmt"
 	"github.com/th3osmith/greader/saver"
 	"os"
+	"sync"
 	"testing"
 )
 
@@ -283,6 +285,248 @@ func TestComplexObject(t *testing.T) {
 
 }
 
+func TestFlushRelations(t *testing.T) {
+
+	obj := testSQL{1, "master", "yoyo", 25, 42, nil}
+	slave := copain{1, "slave", &obj}
+
+	if err := db.Save(&obj); err != nil {
+		t.Error(err)
+	}
+	if err := db.Save(&slave); err != nil {
+		t.Error(err)
+	}
+
+	// Flushing the masters leaves the slaves without master
+	if _, err := db.Flush(&testSQL{}); err != nil {
+		t.Error("Error flushing masters", err)
+	}
+
+	var copainA *copain
+	err := db.Retrieve(slave.Id, &copainA)
+	if err != nil || copainA.Master != nil || slave.Master != nil {
+		t.Error("Error in flush propagation to the slaves", err)
+	}
+
+	// Flushing the slaves empties the relations of the masters
+	objB := testSQL{1, "master", "yoyo", 25, 42, nil}
+	slaveB := copain{1, "slave", &objB}
+	db.Save(&objB)
+	db.Save(&slaveB)
+
+	if err := db.Populate(&objB); err != nil || len(objB.Copains) != 1 {
+		t.Error("Error retrieving relations", err, len(objB.Copains))
+	}
+
+	if _, err := db.Flush(&copain{}); err != nil {
+		t.Error("Error flushing slaves", err)
+	}
+
+	if len(objB.Copains) != 0 {
+		t.Error("Error in flush propagation to the masters", len(objB.Copains))
+	}
+
+	db.Delete(&objB)
+}
+
+func TestTransaction(t *testing.T) {
+
+	obj := testSQL{1, "committed", "yoyo", 25, 42, nil}
+	rolledBack := testSQL{1, "rolled back", "yoyo", 25, 42, nil}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tx.Save(&obj); err != nil {
+		t.Error(err)
+	}
+
+	// Seen in the transaction only
+	var objA *testSQL
+	if err := tx.Retrieve(obj.Id, &objA); err != nil || objA.Name != "committed" {
+		t.Error("Error in transaction", err)
+	}
+
+	var objB *testSQL
+	if err := db.Retrieve(obj.Id, &objB); err != sql.ErrNoRows {
+		t.Error("Object seen before the commit", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Error(err)
+	}
+
+	var objC *testSQL
+	if err := db.Retrieve(obj.Id, &objC); err != nil || objC.Name != "committed" {
+		t.Error("Error in Commit", err)
+	}
+
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tx.Save(&rolledBack); err != nil {
+		t.Error(err)
+	}
+
+	if err := tx.Delete(&obj); err != nil {
+		t.Error(err)
+	}
+
+	if err := tx.Rollback(); err != nil {
+		t.Error(err)
+	}
+
+	var objD *testSQL
+	if err := db.Retrieve(rolledBack.Id, &objD); err != sql.ErrNoRows {
+		t.Error("Error in Rollback", err)
+	}
+
+	db.EjectFromCache(&obj)
+
+	var objE *testSQL
+	if err := db.Retrieve(obj.Id, &objE); err != nil || objE.Name != "committed" {
+		t.Error("Deletion not rolled back", err)
+	}
+
+	db.Delete(&obj)
+}
+
+func TestConcurrentTransactions(t *testing.T) {
+
+	// The types are registered by the first use, from any transaction
+	fresh, err := saver.NewDbManager("root:mypass@tcp(127.0.0.1:3306)/greader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			tx, err := fresh.Begin()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer tx.Rollback()
+
+			var obj *testSQL
+			if err := tx.Retrieve(-1, &obj); err != sql.ErrNoRows {
+				t.Error("Error in transaction", err)
+			}
+		}()
+	}
+
+	var obj *copain
+	if err := fresh.Retrieve(-1, &obj); err != sql.ErrNoRows {
+		t.Error(err)
+	}
+
+	wg.Wait()
+}
+
+func TestUpdateUnchanged(t *testing.T) {
+
+	obj := testSQL{1, "unchanged", "yoyo", 25, 42, nil}
+	if err := db.Save(&obj); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(&obj); err != nil {
+		t.Error("Update without changes failed", err)
+	}
+
+	missing := obj
+	missing.Id = obj.Id + 1000
+	if err := db.Update(&missing); err != saver.ErrNothingUpdated {
+		t.Error("Update of a missing object", err)
+	}
+
+	db.Delete(&obj)
+}
+
+func TestFlush(t *testing.T) {
+
+	// Objects left by the other tests, the copains first for the foreign keys
+	if _, err := db.Flush(&copain{}); err != nil {
+		t.Error(err)
+	}
+	if _, err := db.Flush(&testSQL{}); err != nil {
+		t.Error(err)
+	}
+
+	for _, name := range []string{"a", "b"} {
+		obj := testSQL{1, name, "yoyo", 25, 42, nil}
+		if err := db.Save(&obj); err != nil {
+			t.Error(err)
+		}
+	}
+
+	flushed, err := db.Flush(&testSQL{})
+	if err != nil || flushed != 2 {
+		t.Error("Error in Flush", flushed, err)
+	}
+
+	flushed, err = db.Flush(&testSQL{})
+	if err != nil || flushed != 0 {
+		t.Error("Nothing to flush", flushed, err)
+	}
+}
+
+func TestFind(t *testing.T) {
+
+	if _, err := db.Flush(&copain{}); err != nil {
+		t.Error(err)
+	}
+	if _, err := db.Flush(&testSQL{}); err != nil {
+		t.Error(err)
+	}
+
+	for idx, keyb := range []int{3, 1, 5, 3} {
+		obj := testSQL{1, fmt.Sprint("find", idx), "yoyo", keyb, 42, nil}
+		if err := db.Save(&obj); err != nil {
+			t.Error(err)
+		}
+	}
+
+	query := saver.Query{
+		Where: []saver.Condition{{Field: "Keyb", Op: ">", Value: 1}},
+		Order: []saver.Order{{Field: "Keyb", Desc: true}},
+		Limit: 2,
+	}
+
+	var page []*testSQL
+	if err := db.Find(query, &page); err != nil || len(page) != 2 || page[0].Name != "find2" || page[1].Name != "find0" {
+		t.Fatal("Error in Find", page, err)
+	}
+
+	// Next page
+	last := page[1]
+	query.After = []interface{}{last.Keyb, last.Id}
+
+	if err := db.Find(query, &page); err != nil || len(page) != 1 || page[0].Name != "find3" {
+		t.Error("Error in Find after", page, err)
+	}
+
+	query = saver.Query{Where: []saver.Condition{{Field: "Name", Op: "in", Value: []interface{}{"find1", "find3"}}}}
+	if err := db.Find(query, &page); err != nil || len(page) != 2 {
+		t.Error("Error in Find in", page, err)
+	}
+
+	// Fields can not be injected
+	query = saver.Query{Where: []saver.Condition{{Field: "Keyb = 1 OR 1", Op: "=", Value: 1}}}
+	if err := db.Find(query, &page); err == nil {
+		t.Error("Unknown field accepted")
+	}
+}
+
 func TestMain(m *testing.M) {
 
 	// Setup DB
@@ -10,10 +10,23 @@ type MyHandler struct {
 	data  map[string]interface{}
 	conns []pure.PureConnection
 	owner map[string]pure.PureConnection
+	mux   *pure.PureMux // Changes are published when set
 }
 
 func NewPureHandler() MyHandler {
 	return MyHandler{data: make(map[string]interface{}), owner: make(map[string]pure.PureConnection)}
+}
+
+func NewPushHandler(mux *pure.PureMux) MyHandler {
+	h := NewPureHandler()
+	h.mux = mux
+	return h
+}
+
+func (h MyHandler) publish(m pure.PureReq, id string) {
+	if h.mux != nil {
+		h.mux.Publish(m.Msg.DataType, m.Msg.Action, map[string]interface{}{"id": id, "value": h.data[id]})
+	}
 
 }
 
@@ -22,24 +35,67 @@ func (h MyHandler) Create(m pure.PureReq, rw pure.ResponseWriter) {
 	fmt.Println("Create")
 	rww := rw.(*pure.PureResponseWriter)
 	msg := m.Msg
-	id := msg.RequestMap["id"].(string)
+	id, ok := msg.RequestMap["id"].(string)
+
+	if !ok {
+		rww.FieldError("id", pure.CodeInvalid, "id must be a string")
+		return
+	}
 
 	if _, ok := h.data[id]; ok {
-		rww.Fail()
+		rww.FailWith(pure.CodeConflict, "id already used")
 		return
 	}
 
 	h.data[id] = msg.RequestMap["value"]
 	h.owner[id] = m.Conn
+	h.publish(m, id)
 
 	return
 
 }
-func (h MyHandler) Update(m pure.PureReq) {
+func (h MyHandler) Update(m pure.PureReq, rw pure.ResponseWriter) {
+
+	fmt.Println("Update")
+	rww := rw.(*pure.PureResponseWriter)
+	id := m.Msg.RequestMap["id"].(string)
+
+	if _, ok := h.data[id]; !ok {
+		rww.FailWith(pure.CodeNotFound, "Unknown id")
+		return
+	}
+
+	h.data[id] = m.Msg.RequestMap["value"]
+	rww.AddValue("data", h.data[id])
+	h.publish(m, id)
+
+	// The Owner is told about the modification
+	if owner, ok := h.owner[id]; ok {
+		rw.AddConn(owner)
+	}
+
 	return
 
 }
-func (h MyHandler) Delete(m pure.PureReq) {
+func (h MyHandler) Delete(m pure.PureReq, rw pure.ResponseWriter) {
+
+	fmt.Println("Delete")
+	rww := rw.(*pure.PureResponseWriter)
+	id := m.Msg.RequestMap["id"].(string)
+
+	if _, ok := h.data[id]; !ok {
+		rww.FailWith(pure.CodeNotFound, "Unknown id")
+		return
+	}
+
+	if owner, ok := h.owner[id]; ok {
+		rw.AddConn(owner)
+	}
+
+	h.publish(m, id)
+	delete(h.data, id)
+	delete(h.owner, id)
+
 	return
 
 }
@@ -70,7 +126,17 @@ func (h MyHandler) Retrieve(m pure.PureReq, rw pure.ResponseWriter) {
 	return
 
 }
-func (h MyHandler) Flush(m pure.PureReq) {
+func (h MyHandler) Flush(m pure.PureReq, rw pure.ResponseWriter) {
+
+	fmt.Println("Flush")
+	rww := rw.(*pure.PureResponseWriter)
+	rww.AddValue("flushed", len(h.data))
+
+	for id := range h.data {
+		delete(h.data, id)
+		delete(h.owner, id)
+	}
+
 	return
 
 }
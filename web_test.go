@@ -2,6 +2,7 @@ package main_test
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"github.com/gorilla/websocket"
 	"github.com/th3osmith/greader"
@@ -122,7 +123,10 @@ func TestPureWebSocket(t *testing.T) {
 
 	u := url.URL{Scheme: "ws", Host: "localhost:3000", Path: "/pure"}
 
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	header := http.Header{}
+	header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("tata:yoyo")))
+
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), header)
 	if err != nil {
 		t.Error("dial:", err)
 		return
@@ -170,6 +174,28 @@ func TestPureWebSocket(t *testing.T) {
 
 }
 
+func TestPureWebSocketAuth(t *testing.T) {
+
+	u := url.URL{Scheme: "ws", Host: "localhost:3000", Path: "/pure"}
+
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		t.Error("dial:", err)
+		return
+	}
+	defer c.Close()
+
+	msg := pure.PureMsg{}
+	if err := c.ReadJSON(&msg); err != nil || msg.ErrorCode() != pure.CodeUnauthenticated {
+		t.Error("Unauthenticated connection accepted", msg, err)
+	}
+
+	if _, _, err := c.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Error("Connection not closed", err)
+	}
+
+}
+
 func TestMain(m *testing.M) {
 
 	// Test Setup